@@ -0,0 +1,135 @@
+// kubectl-sts-resize is a kubectl plugin to inspect and control resizes of the StatefulSet Resize Controller.
+//
+// Place the binary in your PATH and run it as `kubectl sts-resize <command> <statefulset>`.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+const usage = `Inspect and control resizes of the StatefulSet Resize Controller.
+
+Usage:
+  kubectl sts-resize <command> <statefulset> [flags]
+
+Commands:
+  status           Show the state of the resize and the progress of every PVC
+  plan             Show the PVCs the controller would resize now, without changing anything
+  retry            Retry a failed or aborted resize from where it stopped
+  abort            Abort a resize at the next safe point and scale the StatefulSet back up
+  rollback         Scale a failed resize back up, if no PVC was replaced yet
+  cleanup-backups  Delete the backups of a StatefulSet that is not resizing
+
+Flags:
+`
+
+type options struct {
+	kubeconfig    string
+	context       string
+	namespace     string
+	outOfRange    string
+	copyMode      string
+	dryRun        bool
+	deleteBackups bool
+	positionals   []string
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, out, errOut io.Writer) error {
+	opts, fs, err := parseArgs(args, errOut)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(opts.positionals) != 2 {
+		fs.Usage()
+		return errors.New("expected a command and the name of a StatefulSet")
+	}
+
+	loading := clientcmd.NewDefaultClientConfigLoadingRules()
+	loading.ExplicitPath = opts.kubeconfig
+	cc := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loading, &clientcmd.ConfigOverrides{CurrentContext: opts.context})
+	namespace := opts.namespace
+	if namespace == "" {
+		namespace, _, err = cc.Namespace()
+		if err != nil {
+			return err
+		}
+	}
+	cfg, err := cc.ClientConfig()
+	if err != nil {
+		return err
+	}
+	c, err := client.New(cfg, client.Options{Scheme: scheme.Scheme})
+	if err != nil {
+		return err
+	}
+	policy, err := statefulset.ParseOutOfRangePolicy(opts.outOfRange)
+	if err != nil {
+		return err
+	}
+	mode, err := statefulset.ParseCopyMode(opts.copyMode)
+	if err != nil {
+		return err
+	}
+
+	p := plugin{
+		client:        c,
+		namespace:     namespace,
+		out:           out,
+		policy:        policy,
+		mode:          mode,
+		dryRun:        opts.dryRun,
+		deleteBackups: opts.deleteBackups,
+	}
+	return p.run(context.Background(), opts.positionals[0], opts.positionals[1])
+}
+
+// parseArgs parses the flags, which may appear before, between, and after the command and the name of the StatefulSet
+func parseArgs(args []string, errOut io.Writer) (options, *flag.FlagSet, error) {
+	opts := options{}
+	fs := flag.NewFlagSet("kubectl sts-resize", flag.ContinueOnError)
+	fs.SetOutput(errOut)
+	fs.Usage = func() {
+		fmt.Fprint(errOut, usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file.")
+	fs.StringVar(&opts.context, "context", "", "The kubeconfig context to use.")
+	fs.StringVar(&opts.namespace, "namespace", "", "The namespace of the StatefulSet. Defaults to the namespace of the context.")
+	fs.StringVar(&opts.namespace, "n", "", "Shorthand for --namespace.")
+	fs.StringVar(&opts.outOfRange, "out-of-range-pvcs", string(statefulset.OutOfRangeResize), "The --out-of-range-pvcs default of the controller, used by plan.")
+	fs.StringVar(&opts.copyMode, "copy-mode", string(statefulset.CopyModeBackup), "The --copy-mode default of the controller, used by plan.")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "Only print what would change.")
+	fs.BoolVar(&opts.deleteBackups, "delete-backups", false, "Delete the backups when aborting.")
+
+	for {
+		if err := fs.Parse(args); err != nil {
+			return opts, fs, err
+		}
+		if fs.NArg() == 0 {
+			return opts, fs, nil
+		}
+		opts.positionals = append(opts.positionals, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
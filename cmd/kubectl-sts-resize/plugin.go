@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/vshn/statefulset-resize-controller/controllers"
+	"github.com/vshn/statefulset-resize-controller/pvc"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+// fieldOwner is the field manager of the changes the plugin makes to StatefulSets
+const fieldOwner = client.FieldOwner("kubectl-sts-resize")
+
+type plugin struct {
+	client    client.Client
+	namespace string
+	out       io.Writer
+
+	// policy and mode are the defaults of the controller, to plan the same resize
+	policy statefulset.OutOfRangePolicy
+	mode   statefulset.CopyMode
+	dryRun bool
+	// deleteBackups deletes the backups when aborting
+	deleteBackups bool
+}
+
+func (p plugin) run(ctx context.Context, command, name string) error {
+	sts := &appsv1.StatefulSet{}
+	if err := p.client.Get(ctx, client.ObjectKey{Name: name, Namespace: p.namespace}, sts); err != nil {
+		return err
+	}
+	si, err := statefulset.NewEntity(sts)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "status":
+		return p.status(si)
+	case "plan":
+		return p.plan(ctx, si)
+	case "retry":
+		return p.retry(ctx, si)
+	case "abort":
+		return p.abort(ctx, si)
+	case "rollback":
+		return p.rollback(ctx, si)
+	case "cleanup-backups":
+		return p.cleanupBackups(ctx, si)
+	}
+	return fmt.Errorf("unknown command %q", command)
+}
+
+func (p plugin) status(si *statefulset.Entity) error {
+	fmt.Fprintf(p.out, "StatefulSet %s/%s: %s\n", si.Old.Namespace, si.Old.Name, describeState(si))
+	conds, err := si.Conditions()
+	if err != nil {
+		return err
+	}
+	if len(conds) > 0 {
+		printConditions(p.out, conds)
+	}
+	if len(si.Pvcs) > 0 {
+		printPVCs(p.out, si.Pvcs)
+	}
+	return nil
+}
+
+func (p plugin) plan(ctx context.Context, si *statefulset.Entity) error {
+	if si.Started() {
+		fmt.Fprintln(p.out, "A resize is in progress, its plan does not change anymore")
+		return p.status(si)
+	}
+	pvcs, err := controllers.PlanResize(ctx, p.client, si, p.policy, p.mode)
+	if err != nil {
+		return err
+	}
+	if len(pvcs) == 0 {
+		fmt.Fprintln(p.out, "Nothing to resize")
+		return nil
+	}
+	si.Pvcs = pvcs
+	fmt.Fprintln(p.out, controllers.DescribePlan(si))
+	printPVCs(p.out, pvcs)
+	return nil
+}
+
+func (p plugin) retry(ctx context.Context, si *statefulset.Entity) error {
+	if !si.Failed() && !si.AbortRequested() {
+		return errors.New("the resize did not fail and was not aborted")
+	}
+	jobs, err := controllers.FailedJobs(ctx, p.client, si)
+	if err != nil {
+		return err
+	}
+	for i := range jobs {
+		fmt.Fprintf(p.out, "Deleting failed job %s\n", jobs[i].Name)
+		if p.dryRun {
+			continue
+		}
+		pol := metav1.DeletePropagationForeground
+		if err := p.client.Delete(ctx, &jobs[i], &client.DeleteOptions{PropagationPolicy: &pol}); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	si.ClearFailed()
+	si.ClearAbort()
+	if err := p.update(ctx, si); err != nil {
+		return err
+	}
+	if si.RestartRequired() {
+		fmt.Fprintln(p.out, "Cleared the failed state. The StatefulSet was scaled back up, the controller starts the resize over and scales it down again")
+		return nil
+	}
+	fmt.Fprintln(p.out, "Cleared the failed or aborted state, the controller picks up the resize again")
+	return nil
+}
+
+func (p plugin) abort(ctx context.Context, si *statefulset.Entity) error {
+	if !si.Started() && !si.Resizing() {
+		return errors.New("there is no planned resize")
+	}
+	si.RequestAbort(p.deleteBackups)
+	if err := p.update(ctx, si); err != nil {
+		return err
+	}
+	fmt.Fprintln(p.out, "Requested to abort the resize. The controller stops it at the next safe point and scales the StatefulSet back up. "+
+		"PVCs that were already replaced are restored first. Run the command retry to allow resizing it again")
+	return nil
+}
+
+func (p plugin) rollback(ctx context.Context, si *statefulset.Entity) error {
+	if !si.Failed() {
+		return errors.New("only a failed resize can be rolled back")
+	}
+	replaced, err := controllers.ReplacedSources(ctx, p.client, si.Pvcs)
+	if err != nil {
+		return err
+	}
+	if len(replaced) > 0 {
+		return fmt.Errorf("PVCs %s were already replaced, their data only exists in their backups. Restore them manually",
+			strings.Join(replaced, ", "))
+	}
+	if err := si.Rollback(); err != nil {
+		return err
+	}
+	if !p.dryRun {
+		if err := controllers.ResumeAutoscalers(ctx, p.client, si); err != nil {
+			return err
+		}
+	}
+	if err := p.update(ctx, si); err != nil {
+		return err
+	}
+	sts, err := si.StatefulSet()
+	if err != nil {
+		return err
+	}
+	replicas := int32(1)
+	if sts.Spec.Replicas != nil {
+		replicas = *sts.Spec.Replicas
+	}
+	fmt.Fprintf(p.out, "Rolled back the resize, scaled to %d replicas. The backups are kept, delete them with the command cleanup-backups\n", replicas)
+	return nil
+}
+
+func (p plugin) cleanupBackups(ctx context.Context, si *statefulset.Entity) error {
+	if si.Started() || (si.Resizing() && !si.Failed()) {
+		return errors.New("the StatefulSet is resizing, its backups are still needed")
+	}
+	backups, err := controllers.Backups(ctx, p.client, si)
+	if err != nil {
+		return err
+	}
+	if len(backups) == 0 {
+		fmt.Fprintln(p.out, "No backups found")
+		return nil
+	}
+	for i := range backups {
+		fmt.Fprintf(p.out, "Deleting backup %s\n", backups[i].Name)
+		if p.dryRun {
+			continue
+		}
+		if err := p.client.Delete(ctx, &backups[i]); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update patches the state of the resize, like the controller does.
+// The patch fails if the StatefulSet changed since it was read, the command was based on outdated state then.
+func (p plugin) update(ctx context.Context, si *statefulset.Entity) error {
+	if p.dryRun {
+		return nil
+	}
+	if _, err := si.StatefulSet(); err != nil {
+		return err
+	}
+	if err := si.UpdateConditions(metav1.Now()); err != nil {
+		return err
+	}
+	err := p.client.Patch(ctx, si.ApplyTo(si.Old), client.MergeFromWithOptions(si.Old, client.MergeFromWithOptimisticLock{}), fieldOwner)
+	if apierrors.IsConflict(err) {
+		return fmt.Errorf("the StatefulSet changed while running the command, run it again: %w", err)
+	}
+	return err
+}
+
+// describeState returns the state of the resize of the StatefulSet
+func describeState(si *statefulset.Entity) string {
+	switch {
+	case si.Failed():
+		return "failed, see the events of the StatefulSet"
+	case si.AbortRequested() && si.Started():
+		return "aborting, see the events of the StatefulSet"
+	case si.AbortRequested():
+		return "aborted"
+	case si.Old.Annotations[statefulset.ScaleUpAnnotation] == "true":
+		return "restored, scaling up"
+	case si.Started():
+		return fmt.Sprintf("in progress, scaled down from %s replicas", si.Old.Annotations[statefulset.ReplicasAnnotation])
+	case si.Resizing():
+		return "planned, waiting to start"
+	}
+	return "not resizing"
+}
+
+func printPVCs(out io.Writer, pvcs []pvc.Entity) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PVC\tSIZE\tTARGET\tMODE\tPRE-COPIED\tBACKED UP\tRESTORED")
+	for _, pi := range pvcs {
+		src := pi.SourceSize()
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%t\t%t\n",
+			pi.SourceName, src.String(), pi.TargetSize.String(), describeMode(pi), pi.PreCopied, pi.BackedUp, pi.Restored)
+	}
+	w.Flush()
+}
+
+func printConditions(out io.Writer, conds []metav1.Condition) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CONDITION\tSTATUS\tREASON\tSINCE")
+	for _, c := range conds {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Type, c.Status, c.Reason, c.LastTransitionTime.UTC().Format(time.RFC3339))
+	}
+	w.Flush()
+}
+
+func describeMode(pi pvc.Entity) string {
+	switch {
+	case pi.Discard:
+		return "delete"
+	case pi.TargetNamespace != "":
+		return "migrate to " + pi.TargetNamespace
+	case pi.Rebind:
+		return string(statefulset.CopyModeRebind)
+	}
+	return string(statefulset.CopyModeBackup)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+func newTestPVC(name, size string) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "foo", Labels: map[string]string{"app": "web"}},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(size)},
+			},
+		},
+	}
+}
+
+func newTestStatefulSet(annotations, labels map[string]string, replicas int32) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "foo", Annotations: annotations, Labels: labels},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{
+				ObjectMeta: metav1.ObjectMeta{Name: "data"},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("2G")},
+					},
+				},
+			}},
+		},
+	}
+}
+
+func newTestPlugin(objs ...client.Object) (plugin, *bytes.Buffer, client.Client) {
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(objs...).Build()
+	out := &bytes.Buffer{}
+	return plugin{
+		client:    c,
+		namespace: "foo",
+		out:       out,
+		policy:    statefulset.OutOfRangeResize,
+		mode:      statefulset.CopyModeBackup,
+	}, out, c
+}
+
+func TestStatus(t *testing.T) {
+	source := newTestPVC("data-web-0", "1G")
+	pi := pvc.NewEntity(*source, resource.MustParse("2G"), nil)
+	pi.BackedUp = true
+	si, err := statefulset.NewEntity(newTestStatefulSet(map[string]string{statefulset.ReplicasAnnotation: "3"}, nil, 0))
+	require.NoError(t, err)
+	si.Pvcs = []pvc.Entity{pi}
+	require.NoError(t, si.UpdateConditions(metav1.NewTime(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))))
+	sts, err := si.StatefulSet()
+	require.NoError(t, err)
+
+	p, out, _ := newTestPlugin(sts)
+	require.NoError(t, p.run(context.Background(), "status", "web"))
+	assert.Equal(t, `StatefulSet foo/web: in progress, scaled down from 3 replicas
+CONDITION   STATUS  REASON         SINCE
+Detected    True    ResizePlanned  2023-01-01T00:00:00Z
+ScaledDown  True    ScaledDown     2023-01-01T00:00:00Z
+BackedUp    True    BackedUp       2023-01-01T00:00:00Z
+Restored    False   Pending        2023-01-01T00:00:00Z
+ScaledUp    False   Pending        2023-01-01T00:00:00Z
+Failed      False   NotFailed      2023-01-01T00:00:00Z
+PVC         SIZE  TARGET  MODE    PRE-COPIED  BACKED UP  RESTORED
+data-web-0  1G    2G      backup  false       true       false
+`, out.String())
+}
+
+func TestPlan(t *testing.T) {
+	p, out, _ := newTestPlugin(
+		newTestStatefulSet(nil, nil, 1),
+		newTestPVC("data-web-0", "1G"),
+		newTestPVC("data-web-1", "2G"),
+	)
+	require.NoError(t, p.run(context.Background(), "plan", "web"))
+	assert.Contains(t, out.String(), "Planned resize of 1 PVCs (data-web-0 1G -> 2G)")
+	assert.Contains(t, out.String(), "data-web-0  1G    2G      backup")
+}
+
+func TestRetryAndAbort(t *testing.T) {
+	ctx := context.Background()
+	pi := pvc.NewEntity(*newTestPVC("data-web-0", "1G"), resource.MustParse("2G"), nil)
+	si, err := statefulset.NewEntity(newTestStatefulSet(map[string]string{statefulset.ReplicasAnnotation: "3"}, nil, 0))
+	require.NoError(t, err)
+	si.Pvcs = []pvc.Entity{pi}
+	sts, err := si.StatefulSet()
+	require.NoError(t, err)
+
+	p, out, c := newTestPlugin(sts)
+	assert.Error(t, p.run(ctx, "retry", "web"), "not failed")
+	p.deleteBackups = true
+	require.NoError(t, p.run(ctx, "abort", "web"))
+
+	found := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(sts), found))
+	assert.Equal(t, statefulset.AbortDeleteBackups, found.Annotations[statefulset.AbortAnnotation])
+
+	out.Reset()
+	require.NoError(t, p.run(ctx, "status", "web"))
+	assert.Contains(t, out.String(), "StatefulSet foo/web: aborting")
+
+	require.NoError(t, p.run(ctx, "retry", "web"))
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(sts), found))
+	assert.NotContains(t, found.Annotations, statefulset.AbortAnnotation)
+
+	found.Labels = map[string]string{statefulset.FailedLabel: "true"}
+	require.NoError(t, c.Update(ctx, found))
+	require.NoError(t, p.run(ctx, "retry", "web"))
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(sts), found))
+	assert.NotContains(t, found.Labels, statefulset.FailedLabel)
+}
+
+func TestRetryScaledUp(t *testing.T) {
+	ctx := context.Background()
+	pi := pvc.NewEntity(*newTestPVC("data-web-0", "1G"), resource.MustParse("2G"), nil)
+	pi.BackedUp = true
+	// The backup failed and the critical error scaled the StatefulSet back up to its original replicas
+	si, err := statefulset.NewEntity(newTestStatefulSet(
+		map[string]string{statefulset.ReplicasAnnotation: "3", statefulset.ScaleUpAnnotation: "true", statefulset.RestartAnnotation: "true"},
+		map[string]string{statefulset.FailedLabel: "true"}, 3))
+	require.NoError(t, err)
+	si.Pvcs = []pvc.Entity{pi}
+	sts, err := si.StatefulSet()
+	require.NoError(t, err)
+	failed := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "sync-data-web-0-to-data-web-0-backup-1g", Namespace: "foo"},
+		Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{{
+			Type:   batchv1.JobFailed,
+			Status: corev1.ConditionTrue,
+		}}},
+	}
+	done := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "hook-pre-scale-down-web", Namespace: "foo"},
+		Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{{
+			Type:   batchv1.JobComplete,
+			Status: corev1.ConditionTrue,
+		}}},
+	}
+
+	p, out, c := newTestPlugin(sts, failed, done)
+	p.dryRun = true
+	require.NoError(t, p.run(ctx, "retry", "web"))
+	assert.Contains(t, out.String(), "Deleting failed job sync-data-web-0-to-data-web-0-backup-1g")
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(failed), &batchv1.Job{}), "dry run")
+
+	p.dryRun = false
+	out.Reset()
+	require.NoError(t, p.run(ctx, "retry", "web"))
+	assert.Contains(t, out.String(), "Deleting failed job sync-data-web-0-to-data-web-0-backup-1g")
+	assert.NotContains(t, out.String(), done.Name)
+	assert.Contains(t, out.String(), "starts the resize over")
+	err = c.Get(ctx, client.ObjectKeyFromObject(failed), &batchv1.Job{})
+	assert.True(t, apierrors.IsNotFound(err), "failed job deleted")
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(done), &batchv1.Job{}), "completed job kept")
+
+	found := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(sts), found))
+	assert.NotContains(t, found.Labels, statefulset.FailedLabel)
+	assert.Equal(t, "true", found.Annotations[statefulset.RestartAnnotation], "the controller starts the resize over")
+	assert.Equal(t, int32(3), *found.Spec.Replicas)
+}
+
+func TestUpdateConflict(t *testing.T) {
+	ctx := context.Background()
+	p, _, c := newTestPlugin(newTestStatefulSet(nil, map[string]string{statefulset.FailedLabel: "true"}, 3))
+
+	read := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Name: "web", Namespace: "foo"}, read))
+	si, err := statefulset.NewEntity(read)
+	require.NoError(t, err)
+
+	// Someone else changes the StatefulSet after the plugin read it
+	changed := read.DeepCopy()
+	changed.Labels["app"] = "web"
+	require.NoError(t, c.Update(ctx, changed))
+
+	si.ClearFailed()
+	err = p.update(ctx, si)
+	require.Error(t, err)
+	assert.True(t, apierrors.IsConflict(errors.Unwrap(err)), "optimistic lock")
+
+	found := &appsv1.StatefulSet{}
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Name: "web", Namespace: "foo"}, found))
+	assert.Equal(t, "true", found.Labels[statefulset.FailedLabel], "not changed")
+	assert.Equal(t, "web", found.Labels["app"])
+
+	// Patching keeps the changes of others
+	require.NoError(t, p.run(ctx, "retry", "web"))
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Name: "web", Namespace: "foo"}, found))
+	assert.NotContains(t, found.Labels, statefulset.FailedLabel)
+	assert.Equal(t, "web", found.Labels["app"])
+}
+
+func TestRollback(t *testing.T) {
+	tcs := map[string]struct {
+		sourceSize string
+		fail       bool
+	}{
+		"sources intact": {
+			sourceSize: "1G",
+		},
+		"source replaced": {
+			sourceSize: "2G",
+			fail:       true,
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			ctx := context.Background()
+			pi := pvc.NewEntity(*newTestPVC("data-web-0", "1G"), resource.MustParse("2G"), nil)
+			pi.BackedUp = true
+			si, err := statefulset.NewEntity(newTestStatefulSet(
+				map[string]string{statefulset.ReplicasAnnotation: "3"},
+				map[string]string{statefulset.FailedLabel: "true"}, 0))
+			require.NoError(t, err)
+			si.Pvcs = []pvc.Entity{pi}
+			sts, err := si.StatefulSet()
+			require.NoError(t, err)
+
+			p, _, c := newTestPlugin(sts, newTestPVC("data-web-0", tc.sourceSize))
+			err = p.run(ctx, "rollback", "web")
+			found := &appsv1.StatefulSet{}
+			require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(sts), found))
+			if tc.fail {
+				assert.Error(t, err)
+				assert.Equal(t, int32(0), *found.Spec.Replicas)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, int32(3), *found.Spec.Replicas)
+			assert.NotContains(t, found.Annotations, statefulset.ReplicasAnnotation)
+		})
+	}
+}
+
+func TestCleanupBackups(t *testing.T) {
+	ctx := context.Background()
+	pi := pvc.NewEntity(*newTestPVC("data-web-0", "1G"), resource.MustParse("2G"), nil)
+	other := pvc.NewEntity(*newTestPVC("data-db-0", "1G"), resource.MustParse("2G"), nil)
+	p, out, c := newTestPlugin(
+		newTestStatefulSet(nil, nil, 1),
+		newTestPVC("data-web-0", "2G"),
+		newTestPVC("data-db-0", "2G"),
+		pi.GetBackup(),
+		other.GetBackup(),
+	)
+
+	p.dryRun = true
+	require.NoError(t, p.run(ctx, "cleanup-backups", "web"))
+	assert.Equal(t, "Deleting backup data-web-0-backup-1g\n", out.String())
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(pi.GetBackup()), &corev1.PersistentVolumeClaim{}))
+
+	p.dryRun = false
+	require.NoError(t, p.run(ctx, "cleanup-backups", "web"))
+	err := c.Get(ctx, client.ObjectKeyFromObject(pi.GetBackup()), &corev1.PersistentVolumeClaim{})
+	assert.True(t, apierrors.IsNotFound(err), "backup deleted")
+	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(other.GetBackup()), &corev1.PersistentVolumeClaim{}), "backup of other StatefulSet kept")
+}
+
+func TestParseArgs(t *testing.T) {
+	opts, _, err := parseArgs([]string{"-n", "foo", "status", "web", "--dry-run"}, io.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, "foo", opts.namespace)
+	assert.True(t, opts.dryRun)
+	assert.Equal(t, []string{"status", "web"}, opts.positionals)
+}
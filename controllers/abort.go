@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+// abortPlanned drops a resize that was requested to abort before it started.
+// Pre-copies in progress are stopped. The StatefulSet is held as long as the abort annotation is set.
+func (r *StatefulSetReconciler) abortPlanned(ctx context.Context, sts *statefulset.Entity) error {
+	recorded, err := statefulset.NewEntity(sts.Old)
+	if err != nil {
+		return err
+	}
+	// Without a recorded plan, nothing was started or the abort is already done
+	if len(recorded.Pvcs) > 0 {
+		for _, pi := range recorded.Pvcs {
+			if err := r.abortPVC(ctx, pi, sts.AbortDeletesBackups()); err != nil {
+				return err
+			}
+		}
+		if err := r.resumeHPAs(ctx, sts); err != nil {
+			return err
+		}
+		r.Recorder.Event(sts.Old, "Normal", "ResizeAborted",
+			fmt.Sprintf("Aborted the planned resize of PVCs %s%s", pvcNames(recorded.Pvcs), describeBackups(sts)))
+	}
+	sts.Pvcs = []pvc.Entity{}
+	return r.clearStalePlan(ctx, sts)
+}
+
+// abortPVCs stops the resize of all PVCs whose original PVC is still intact, and drops them from the StatefulSet.
+// The PVCs whose original was already deleted are kept, their restore must finish first.
+func (r *StatefulSetReconciler) abortPVCs(ctx context.Context, sts *statefulset.Entity) error {
+	remaining := []pvc.Entity{}
+	aborted := []pvc.Entity{}
+	for _, pi := range sts.Pvcs {
+		intact, err := r.sourceIntact(ctx, pi)
+		if err != nil {
+			return err
+		}
+		if !intact {
+			remaining = append(remaining, pi)
+			continue
+		}
+		if err := r.abortPVC(ctx, pi, sts.AbortDeletesBackups()); err != nil {
+			return err
+		}
+		aborted = append(aborted, pi)
+	}
+	sts.Pvcs = remaining
+
+	if len(aborted) > 0 {
+		msg := fmt.Sprintf("Aborted the resize of PVCs %s%s", pvcNames(aborted), describeBackups(sts))
+		if len(remaining) > 0 {
+			msg += fmt.Sprintf(". PVCs %s were already replaced and are restored first", pvcNames(remaining))
+		}
+		r.Recorder.Event(sts.Old, "Normal", "ResizeAborted", msg)
+	}
+	return nil
+}
+
+// abortPVC stops all Jobs working on the PVC, and cleans up what was created for it.
+// It must only be called while the original PVC is intact.
+func (r *StatefulSetReconciler) abortPVC(ctx context.Context, pi pvc.Entity, deleteBackups bool) error {
+	if err := r.stopJobs(ctx, pi); err != nil {
+		return err
+	}
+	pol := metav1.DeletePropagationForeground
+	objs := []client.Object{pi.GetClone()}
+	for _, src := range []string{pi.SourceName, pi.CloneName()} {
+		for _, dst := range []string{pi.BackupName(), pi.TargetName()} {
+			job := newPrecopyJob(pi.Namespace, "", "", src, dst)
+			objs = append(objs, &job)
+		}
+	}
+	if deleteBackups {
+		objs = append(objs, pi.GetBackup(), pi.GetTarget())
+	}
+	for _, obj := range objs {
+		err := r.Client.Delete(ctx, obj, &client.DeleteOptions{PropagationPolicy: &pol})
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	if pi.TargetNamespace != "" {
+		if err := r.deleteMigrationObjs(ctx, newMigrationName(pi.SourceName), pi.Namespace, pi.TargetNamespace); err != nil {
+			return err
+		}
+		if deleteBackups {
+			if err := r.deleteMigrated(ctx, pi); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Volumes we retained get back their original reclaim policy
+	for _, v := range []struct {
+		name   string
+		policy corev1.PersistentVolumeReclaimPolicy
+	}{
+		{pi.SourceVolumeName, pi.SourceReclaimPolicy},
+		{pi.TargetVolumeName, pi.TargetReclaimPolicy},
+	} {
+		if err := r.setReclaimPolicy(ctx, v.name, v.policy); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteMigrated deletes the copy of the PVC in the target namespace, if we created it
+func (r *StatefulSetReconciler) deleteMigrated(ctx context.Context, pi pvc.Entity) error {
+	found := corev1.PersistentVolumeClaim{}
+	err := r.Get(ctx, client.ObjectKey{Name: pi.SourceName, Namespace: pi.TargetNamespace}, &found)
+	if err != nil || found.Annotations[pvc.MigratedFromAnnotation] != pi.Namespace {
+		return client.IgnoreNotFound(err)
+	}
+	return client.IgnoreNotFound(r.Delete(ctx, &found))
+}
+
+// finishAbort scales the StatefulSet back up once no PVC is left to restore
+func (r *StatefulSetReconciler) finishAbort(ctx context.Context, sts *statefulset.Entity) (bool, error) {
+	l := log.FromContext(ctx)
+	if r.SyncClusterRole != "" {
+		name := rbacObjName(sts.Old.Name)
+		for _, obj := range []client.Object{
+			&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: sts.Old.Namespace}},
+			&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: sts.Old.Namespace}},
+		} {
+			if err := r.Delete(ctx, obj); client.IgnoreNotFound(err) != nil {
+				l.Info("Failed to delete Job RBAC objects", "error", err)
+			}
+		}
+	}
+	done, err := r.scaleUp(ctx, sts)
+	if done && err == nil {
+		r.Recorder.Event(sts.Old, "Normal", "ResizeAborted", "Scaled the StatefulSet back up after aborting the resize")
+	}
+	return done, err
+}
+
+func pvcNames(pvcs []pvc.Entity) string {
+	names := make([]string, 0, len(pvcs))
+	for _, pi := range pvcs {
+		names = append(names, pi.SourceName)
+	}
+	return strings.Join(names, ", ")
+}
+
+func describeBackups(sts *statefulset.Entity) string {
+	if sts.AbortDeletesBackups() {
+		return ", deleted their backups"
+	}
+	return ", kept their backups"
+}
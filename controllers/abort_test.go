@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+func newAbortPVC(name, size string) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "foo"},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(size)},
+			},
+		},
+	}
+}
+
+func newAbortStatefulSet(annotations map[string]string, replicas int32, pvcs ...pvc.Entity) (*appsv1.StatefulSet, error) {
+	si, err := statefulset.NewEntity(&appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "foo", Annotations: annotations},
+		Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+	})
+	if err != nil {
+		return nil, err
+	}
+	si.Pvcs = pvcs
+	return si.StatefulSet()
+}
+
+func TestAbortPVCs(t *testing.T) {
+	tcs := map[string]struct {
+		abort       string
+		backupKept  bool
+		description string
+	}{
+		"keep backups": {
+			abort:       "true",
+			backupKept:  true,
+			description: "Normal ResizeAborted Aborted the resize of PVCs data-web-0, kept their backups. PVCs data-web-1 were already replaced and are restored first",
+		},
+		"delete backups": {
+			abort:       statefulset.AbortDeleteBackups,
+			description: "Normal ResizeAborted Aborted the resize of PVCs data-web-0, deleted their backups. PVCs data-web-1 were already replaced and are restored first",
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			ctx := context.Background()
+			require := require.New(t)
+			assert := assert.New(t)
+
+			intact := pvc.NewEntity(*newAbortPVC("data-web-0", "1G"), resource.MustParse("2G"), nil)
+			replaced := pvc.NewEntity(*newAbortPVC("data-web-1", "1G"), resource.MustParse("2G"), nil)
+			replaced.BackedUp = true
+			job := newJob("foo", "rsync", "", intact.SourceName, intact.BackupName())
+			sts, err := newAbortStatefulSet(map[string]string{
+				statefulset.ReplicasAnnotation: "2",
+				statefulset.AbortAnnotation:    tc.abort,
+			}, 0, intact, replaced)
+			require.NoError(err)
+
+			c := fake.NewClientBuilder().WithScheme(scheme.Scheme).
+				WithObjects(sts, newAbortPVC("data-web-0", "1G"), newAbortPVC("data-web-1", "2G"),
+					intact.GetBackup(), replaced.GetBackup(), &job).
+				Build()
+			recorder := record.NewFakeRecorder(10)
+			r := StatefulSetReconciler{Client: c, Recorder: recorder}
+
+			si, err := statefulset.NewEntity(sts)
+			require.NoError(err)
+			require.NoError(r.abortPVCs(ctx, si))
+
+			require.Len(si.Pvcs, 1)
+			assert.Equal("data-web-1", si.Pvcs[0].SourceName, "replaced PVC is restored first")
+			err = c.Get(ctx, client.ObjectKeyFromObject(&job), &batchv1.Job{})
+			assert.True(apierrors.IsNotFound(err), "job stopped")
+			err = c.Get(ctx, client.ObjectKeyFromObject(intact.GetBackup()), &corev1.PersistentVolumeClaim{})
+			assert.Equal(tc.backupKept, err == nil, "backup of aborted PVC")
+			require.NoError(c.Get(ctx, client.ObjectKeyFromObject(replaced.GetBackup()), &corev1.PersistentVolumeClaim{}), "backup to restore")
+			assert.Equal(tc.description, <-recorder.Events)
+		})
+	}
+}
+
+func TestAbortScalesUp(t *testing.T) {
+	ctx := context.Background()
+	require := require.New(t)
+	assert := assert.New(t)
+
+	pi := pvc.NewEntity(*newAbortPVC("data-web-0", "1G"), resource.MustParse("2G"), nil)
+	sts, err := newAbortStatefulSet(map[string]string{
+		statefulset.ReplicasAnnotation: "2",
+		statefulset.AbortAnnotation:    "true",
+	}, 0, pi)
+	require.NoError(err)
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).
+		WithObjects(sts, newAbortPVC("data-web-0", "1G"), pi.GetBackup()).
+		Build()
+	recorder := record.NewFakeRecorder(10)
+	r := StatefulSetReconciler{Client: c, Recorder: recorder}
+
+	si, err := statefulset.NewEntity(sts)
+	require.NoError(err)
+	done, err := r.resizeStatefulSet(ctx, si)
+	require.NoError(err)
+	assert.False(done)
+
+	found := &appsv1.StatefulSet{}
+	require.NoError(c.Get(ctx, client.ObjectKeyFromObject(sts), found))
+	assert.Equal(int32(2), *found.Spec.Replicas)
+	si, err = statefulset.NewEntity(found)
+	require.NoError(err)
+	assert.Empty(si.Pvcs)
+	assert.Contains(<-recorder.Events, "Normal ResizeAborted")
+	assert.Equal("Normal ScalingUp Scaling up to 2 replicas", <-recorder.Events)
+}
+
+func TestAbortPlanned(t *testing.T) {
+	ctx := context.Background()
+	require := require.New(t)
+	assert := assert.New(t)
+
+	pi := pvc.NewEntity(*newAbortPVC("data-web-0", "1G"), resource.MustParse("2G"), nil)
+	job := newPrecopyJob("foo", "rsync", "", pi.CloneName(), pi.BackupName())
+	sts, err := newAbortStatefulSet(map[string]string{statefulset.AbortAnnotation: "true"}, 2, pi)
+	require.NoError(err)
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).
+		WithObjects(sts, newAbortPVC("data-web-0", "1G"), pi.GetBackup(), pi.GetClone(), &job).
+		Build()
+	recorder := record.NewFakeRecorder(10)
+	r := StatefulSetReconciler{Client: c, Recorder: recorder}
+
+	si, err := statefulset.NewEntity(sts)
+	require.NoError(err)
+	require.NoError(r.abortPlanned(ctx, si))
+	assert.Equal("Normal ResizeAborted Aborted the planned resize of PVCs data-web-0, kept their backups", <-recorder.Events)
+
+	err = c.Get(ctx, client.ObjectKeyFromObject(&job), &batchv1.Job{})
+	assert.True(apierrors.IsNotFound(err), "pre-copy stopped")
+	err = c.Get(ctx, client.ObjectKeyFromObject(pi.GetClone()), &corev1.PersistentVolumeClaim{})
+	assert.True(apierrors.IsNotFound(err), "clone removed")
+	require.NoError(c.Get(ctx, client.ObjectKeyFromObject(pi.GetBackup()), &corev1.PersistentVolumeClaim{}), "backup kept")
+
+	found := &appsv1.StatefulSet{}
+	require.NoError(c.Get(ctx, client.ObjectKeyFromObject(sts), found))
+	si, err = statefulset.NewEntity(found)
+	require.NoError(err)
+	assert.Empty(si.Pvcs)
+	require.NoError(r.abortPlanned(ctx, si))
+	assert.Empty(recorder.Events, "reported once")
+}
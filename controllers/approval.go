@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+// holdForApproval checks whether a resize that did not start yet has to wait for a human to approve it.
+// While waiting, the planned resize is recorded on the StatefulSet.
+// It returns true if the resize has to be held back.
+func (r *StatefulSetReconciler) holdForApproval(ctx context.Context, sts *statefulset.Entity) (bool, error) {
+	if !sts.ApprovalRequired(r.RequireApproval) {
+		return false, nil
+	}
+	approved, err := sts.Approved()
+	if err != nil || approved {
+		return false, err
+	}
+	id, err := sts.PlanID()
+	if err != nil {
+		return true, err
+	}
+
+	r.reportDetected(sts)
+	recorded := sts.Old.Annotations[statefulset.PvcAnnotation]
+	if err := r.updateStatefulSet(ctx, sts, nil); err != nil {
+		return true, err
+	}
+	stsv1, err := sts.StatefulSet()
+	if err != nil {
+		return true, err
+	}
+	if recorded == stsv1.Annotations[statefulset.PvcAnnotation] {
+		// We already announced this plan
+		return true, nil
+	}
+
+	log.FromContext(ctx).Info("Resize awaiting approval", "plan", id)
+	r.Recorder.Event(sts.Old, "Normal", "ResizeAwaitingApproval",
+		fmt.Sprintf("%s. Approve by setting annotation %s=%s", describePlan(sts), statefulset.ApproveAnnotation, id))
+	return true, nil
+}
+
+// describePlan returns a human readable summary of the planned resize
+func describePlan(sts *statefulset.Entity) string {
+	copyVolume := resource.Quantity{}
+	pvcs := make([]string, 0, len(sts.Pvcs))
+	for _, pi := range sts.Pvcs {
+		src := pi.SourceSize()
+		if pi.TargetNamespace != "" {
+			// The data is copied once, to the target namespace
+			copyVolume.Add(src)
+			pvcs = append(pvcs, fmt.Sprintf("%s %s -> %s/%s %s", pi.SourceName, src.String(), pi.TargetNamespace, pi.SourceName, pi.TargetSize.String()))
+			continue
+		}
+		if pi.Discard {
+			pvcs = append(pvcs, fmt.Sprintf("%s %s -> deleted", pi.SourceName, src.String()))
+			continue
+		}
+		if pi.Rebind {
+			// The data is copied once, to the PVC that is rebound
+			copyVolume.Add(src)
+			pvcs = append(pvcs, fmt.Sprintf("%s %s -> %s", pi.SourceName, src.String(), pi.TargetSize.String()))
+			continue
+		}
+		// The data is copied twice, to the backup and back to the resized PVC
+		copyVolume.Add(src)
+		copyVolume.Add(src)
+		pvcs = append(pvcs, fmt.Sprintf("%s %s -> %s", pi.SourceName, src.String(), pi.TargetSize.String()))
+	}
+	return fmt.Sprintf("Planned resize of %d PVCs (%s), copying up to %s",
+		len(sts.Pvcs), strings.Join(pvcs, ", "), copyVolume.String())
+}
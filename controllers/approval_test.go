@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+func TestHoldForApproval(t *testing.T) {
+	ctx := context.Background()
+	require := require.New(t)
+	assert := assert.New(t)
+
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test",
+			Namespace: "foo",
+			Annotations: map[string]string{
+				statefulset.RequireApprovalAnnotation: "true",
+			},
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(sts).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &StatefulSetReconciler{
+		Client:   c,
+		Recorder: recorder,
+	}
+	source := corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data-test-0", Namespace: "foo"},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1G")},
+			},
+		},
+	}
+
+	newEntity := func() *statefulset.Entity {
+		found := &appsv1.StatefulSet{}
+		require.NoError(c.Get(ctx, client.ObjectKeyFromObject(sts), found))
+		si, err := statefulset.NewEntity(found)
+		require.NoError(err)
+		si.Pvcs = []pvc.Entity{pvc.NewEntity(source, resource.MustParse("2G"), nil)}
+		return si
+	}
+
+	si := newEntity()
+	hold, err := r.holdForApproval(ctx, si)
+	require.NoError(err)
+	assert.True(hold, "hold back unapproved resize")
+	require.Len(recorder.Events, 2)
+	assert.Contains(<-recorder.Events, "Normal ResizeDetected Planned resize of 1 PVCs")
+	assert.Contains(<-recorder.Events, "(data-test-0 1G -> 2G), copying up to 2G")
+
+	si = newEntity()
+	assert.NotEmpty(si.Old.Annotations[statefulset.PvcAnnotation], "plan recorded")
+	hold, err = r.holdForApproval(ctx, si)
+	require.NoError(err)
+	assert.True(hold, "keep holding back unapproved resize")
+	assert.Len(recorder.Events, 0, "only announce a plan once")
+
+	id, err := si.PlanID()
+	require.NoError(err)
+	si.Old.Annotations[statefulset.ApproveAnnotation] = "someotherplan"
+	require.NoError(c.Update(ctx, si.Old))
+	hold, err = r.holdForApproval(ctx, newEntity())
+	require.NoError(err)
+	assert.True(hold, "hold back resize approved for a different plan")
+
+	si = newEntity()
+	si.Old.Annotations[statefulset.ApproveAnnotation] = id
+	require.NoError(c.Update(ctx, si.Old))
+	hold, err = r.holdForApproval(ctx, newEntity())
+	require.NoError(err)
+	assert.False(hold, "proceed with approved resize")
+}
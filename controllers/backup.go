@@ -2,7 +2,7 @@ package controllers
 
 import (
 	"context"
-	"errors"
+	"fmt"
 	"reflect"
 
 	"github.com/vshn/statefulset-resize-controller/pvc"
@@ -15,12 +15,29 @@ func (r StatefulSetReconciler) backupPVC(ctx context.Context, pi pvc.Entity) (pv
 	if pi.BackedUp {
 		return pi, true, nil
 	}
+	if pi.Discard {
+		// Nobody uses the PVC, there is nothing worth backing up
+		pi.BackedUp = true
+		return pi, true, nil
+	}
+	if pi.TargetNamespace != "" {
+		return r.migratePVC(ctx, pi)
+	}
+	if pi.Rebind {
+		return r.copyToTarget(ctx, pi)
+	}
 
-	err := r.createBackupIfNotExists(ctx, pi)
+	if err := r.createBackupIfNotExists(ctx, pi); err != nil {
+		return pi, false, err
+	}
 
-	done, err := r.copyPVC(ctx,
+	started, done, err := r.copyPVC(ctx,
 		client.ObjectKey{Name: pi.SourceName, Namespace: pi.Namespace},
 		client.ObjectKey{Name: pi.BackupName(), Namespace: pi.Namespace})
+	if started {
+		src := pi.SourceSize()
+		r.event(ctx, "BackupStarted", "Backing up PVC %s (%s) to %s", pi.SourceName, src.String(), pi.BackupName())
+	}
 	if err == nil && done {
 		pi.BackedUp = true
 	}
@@ -36,8 +53,15 @@ func (r StatefulSetReconciler) createBackupIfNotExists(ctx context.Context, pi p
 	if err != nil {
 		return err
 	}
-	if !reflect.DeepEqual(found.Spec, pi.GetBackup().Spec) {
-		return errors.New("exiting backup does not match requirements")
+	// Kubernetes fills in the volume and defaults of a bound PVC, we only compare what we requested
+	backup := pi.GetBackup()
+	q := found.Spec.Resources.Requests[corev1.ResourceStorage]
+	if q.Cmp(backup.Spec.Resources.Requests[corev1.ResourceStorage]) != 0 ||
+		(backup.Spec.StorageClassName != nil && !reflect.DeepEqual(found.Spec.StorageClassName, backup.Spec.StorageClassName)) {
+		return CriticalError{
+			Err:   fmt.Errorf("existing backup %s does not match requirements", backup.Name),
+			Event: fmt.Sprintf("PVC %s already exists and does not match the backup of PVC %s", backup.Name, pi.SourceName),
+		}
 	}
-	return err
+	return nil
 }
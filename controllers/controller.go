@@ -5,11 +5,16 @@ import (
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/vshn/statefulset-resize-controller/schedule"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
 )
 
 // StatefulSetReconciler reconciles a StatefulSet object
@@ -21,15 +26,40 @@ type StatefulSetReconciler struct {
 	SyncContainerImage string
 	SyncClusterRole    string
 	RequeueAfter       time.Duration
+
+	// MaintenanceWindows restrict when a resize may start, unless overridden by the StatefulSet.
+	// No windows means a resize can start at any time.
+	MaintenanceWindows schedule.Windows
+	// RequireApproval holds back every resize until it is approved, unless overridden by the StatefulSet.
+	RequireApproval bool
+	// OutOfRangePolicy defines how PVCs of ordinals outside the replicas of the StatefulSet are handled, unless overridden by the StatefulSet.
+	OutOfRangePolicy statefulset.OutOfRangePolicy
+	// Precopy copies the PVCs once while the StatefulSet is still running, unless overridden by the StatefulSet.
+	Precopy bool
+	// CopyMode defines how the data is moved to the resized PVCs, unless overridden by the StatefulSet.
+	CopyMode statefulset.CopyMode
+	// RetainSourceVolumes retains the volumes of the original PVCs until their data is restored, unless overridden by the StatefulSet.
+	RetainSourceVolumes bool
 }
 
 //+kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=apps,resources=statefulsets/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=apps,resources=statefulsets/finalizers,verbs=update
 //+kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=persistentvolumes,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=resourcequotas,verbs=get;list;watch
+//+kubebuilder:rbac:groups=autoscaling,resources=horizontalpodautoscalers,verbs=get;list;watch;update;patch
 //+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=batch,resources=jobs/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch
 //+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=rolebindings,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=storage.k8s.io,resources=storageclasses,verbs=get;list;watch
+//+kubebuilder:rbac:groups=storage.k8s.io,resources=csistoragecapacities,verbs=get;list;watch
 //+kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
 
 // Reconcile is the main work loop, reacting to changes in statefulsets and initiating resizing of StatefulSets.
@@ -37,12 +67,70 @@ func (r *StatefulSetReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	l := log.FromContext(ctx).WithValues("statefulset", req.NamespacedName)
 
 	sts, err := r.fetchStatefulSet(ctx, req.NamespacedName)
+	if apierrors.IsNotFound(err) {
+		// We might be in the middle of recreating the StatefulSet
+		restored, err := r.restoreStash(ctx, req.NamespacedName)
+		if err != nil || restored {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: r.RequeueAfter}, nil
+	}
 	if err != nil {
-		return ctrl.Result{}, client.IgnoreNotFound(err)
+		return ctrl.Result{}, err
+	}
+	if sts.Old.DeletionTimestamp != nil {
+		return ctrl.Result{}, nil
 	}
-	if !sts.Resizing() || sts.Failed() {
+	if sts.Failed() {
+		// A failed resize that scaled the StatefulSet back up hands it back to its autoscalers
+		if sts.ScalingUp() {
+			return ctrl.Result{}, r.resumeHPAs(ctx, sts)
+		}
 		return ctrl.Result{}, nil
 	}
+	if sts.ResetScaleUp() {
+		// The failure was cleared. The pods wrote to the original PVCs since the failed resize scaled them back up, so it starts over.
+		l.Info("Restarting resize that failed and scaled the StatefulSet back up")
+		return ctrl.Result{}, r.updateStatefulSet(ctx, sts, nil)
+	}
+	if err := r.cleanupStash(ctx, sts.Old); err != nil {
+		return ctrl.Result{}, err
+	}
+	if !sts.Started() {
+		if hold, err := r.applyDesiredTemplates(ctx, sts); hold || err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if sts.AbortRequested() && !sts.Started() {
+		return ctrl.Result{}, r.abortPlanned(ctx, sts)
+	}
+	if !sts.Resizing() && !sts.Started() {
+		// Clear a plan that was waiting for approval but is not needed anymore
+		return ctrl.Result{}, r.clearStalePlan(ctx, sts)
+	}
+
+	if !sts.Started() {
+		now := time.Now()
+		if hold, err := r.holdForApproval(ctx, sts); hold || err != nil {
+			return ctrl.Result{}, err
+		}
+		if res, hold, err := r.holdForMaintenanceWindow(ctx, sts, now); hold || err != nil {
+			return res, err
+		}
+		if res, hold, err := r.holdForDisruptionBudget(ctx, sts, now); hold || err != nil {
+			return res, err
+		}
+		if res, hold, err := r.holdForMigration(ctx, sts, now); hold || err != nil {
+			return res, err
+		}
+		if res, hold, err := r.holdForStorage(ctx, sts, now); hold || err != nil {
+			return res, err
+		}
+		// Nothing holds back the resize anymore, the cleared condition is written with the next update
+		if _, _, err := sts.SetBlocked("", "", metav1.NewTime(now)); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
 
 	done, err := r.resizeStatefulSet(ctx, sts)
 	if err != nil {
@@ -57,6 +145,38 @@ func (r *StatefulSetReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	return ctrl.Result{}, nil
 }
 
+// maxBlockedRequeue is the longest time between two checks of a blocked resize
+const maxBlockedRequeue = 5 * time.Minute
+
+// holdBlocked holds back the resize and records the reason in the Blocked condition.
+// The event is only emitted when the reason or message changes, and the checks back off the longer the resize is blocked.
+func (r *StatefulSetReconciler) holdBlocked(ctx context.Context, sts *statefulset.Entity, reason, event, msg string, now time.Time) (ctrl.Result, bool, error) {
+	changed, since, err := sts.SetBlocked(reason, msg, metav1.NewTime(now))
+	if err != nil {
+		return ctrl.Result{}, true, err
+	}
+	if changed {
+		log.FromContext(ctx).Info("Resize blocked", "reason", reason, "message", msg)
+		r.Recorder.Event(sts.Old, "Warning", event, msg)
+		if err := r.patchStatefulSet(ctx, sts); err != nil {
+			return ctrl.Result{}, true, err
+		}
+	}
+	return ctrl.Result{RequeueAfter: blockedRequeue(r.RequeueAfter, now.Sub(since))}, true, nil
+}
+
+// blockedRequeue backs off the checks of a blocked resize.
+// The longer it has been blocked, the longer we wait, between the configured requeue interval and maxBlockedRequeue.
+func blockedRequeue(requeue, blocked time.Duration) time.Duration {
+	if blocked < requeue {
+		return requeue
+	}
+	if blocked > maxBlockedRequeue {
+		return maxBlockedRequeue
+	}
+	return blocked
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *StatefulSetReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
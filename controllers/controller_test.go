@@ -16,8 +16,10 @@ import (
 
 	"github.com/vshn/statefulset-resize-controller/statefulset"
 	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -235,6 +237,10 @@ func eventuallyScaledUp(t *testing.T, ctx context.Context, c client.Client, sts
 	require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(sts), sts))
 	sts.Status.Replicas = replicas
 	sts.Status.CurrentReplicas = replicas
+	sts.Status.ReadyReplicas = replicas
+	sts.Status.AvailableReplicas = replicas
+	sts.Status.ObservedGeneration = sts.Generation
+	sts.Status.UpdatedReplicas = replicas
 	sts.Status.CurrentRevision = "revision"
 	require.NoError(t, c.Status().Update(ctx, sts)) // manualy do what k8s would do
 	return ok
@@ -343,6 +349,8 @@ func startTestReconciler(t *testing.T, ctx context.Context, crname string) (clie
 	req.NoError(corev1.AddToScheme(s))
 	req.NoError(batchv1.AddToScheme(s))
 	req.NoError(rbacv1.AddToScheme(s))
+	req.NoError(policyv1.AddToScheme(s))
+	req.NoError(autoscalingv2.AddToScheme(s))
 
 	mgr, err := ctrl.NewManager(conf, ctrl.Options{
 		Scheme: s,
@@ -99,7 +99,7 @@ func newTestJob(namespace string, src, dst client.ObjectKey, image string, sanam
 						{
 							Name:    "sync",
 							Image:   image,
-							Command: []string{"rsync", "-avhWHAX", "--no-compress", "--progress", "/src/", "/dst/"},
+							Command: []string{"rsync", "-avhWHAX", "--delete", "--no-compress", "--progress", "/src/", "/dst/"},
 							VolumeMounts: []corev1.VolumeMount{
 								{
 									MountPath: "/src",
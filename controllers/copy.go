@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/vshn/statefulset-resize-controller/naming"
+	"github.com/vshn/statefulset-resize-controller/pvc"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -17,36 +18,26 @@ import (
 // ManagedLabel is a label to mark resources to be managed by the controller
 const ManagedLabel = "sts-resize.vshn.net/managed"
 
-func (r *StatefulSetReconciler) copyPVC(ctx context.Context, src client.ObjectKey, dst client.ObjectKey) (bool, error) {
-	if src.Namespace != dst.Namespace {
-		return false, errors.New("unable to copy across namespaces")
-	}
-
-	var rbacObjs RbacObjects
-	if v := ctx.Value(RbacObjCtxKey); v != nil {
-		objs, ok := v.(RbacObjects)
-		if !ok {
-			return false, errors.New("Unexpected type for job RBAC config in context")
-		}
-		rbacObjs = objs
-	} else {
-		return false, errors.New("unable to extract job RBAC config from context")
+// copyPVC copies the data of src to dst with a Job.
+// It returns whether the Job was created by this call, and whether the copy is done.
+func (r *StatefulSetReconciler) copyPVC(ctx context.Context, src client.ObjectKey, dst client.ObjectKey) (bool, bool, error) {
+	saname, err := r.syncServiceAccount(ctx)
+	if err != nil {
+		return false, false, err
 	}
-
-	saname := ""
-	if rbacObjs.Created && r.SyncClusterRole != "" {
-		saname = rbacObjs.ServiceAccount.Name
+	if src.Namespace != dst.Namespace {
+		return r.copyPVCAcrossNamespaces(ctx, src, dst, saname)
 	}
 
 	job := newJob(src.Namespace, r.SyncContainerImage, saname, src.Name, dst.Name)
-	job, err := r.getOrCreateJob(ctx, job)
+	job, created, err := r.getOrCreateJob(ctx, job)
 	if err != nil {
-		return false, err
+		return false, false, err
 	}
 
 	done, err := isJobDone(job)
 	if err != nil {
-		return done, err
+		return created, done, err
 	}
 	if done {
 		// Let's clean up the Job
@@ -56,22 +47,63 @@ func (r *StatefulSetReconciler) copyPVC(ctx context.Context, src client.ObjectKe
 			PropagationPolicy: &pol,
 		})
 		if err != nil {
-			return false, err
+			return created, false, err
+		}
+	}
+	return created, done, nil
+}
+
+// syncServiceAccount returns the name of the ServiceAccount the copy Jobs run with
+func (r *StatefulSetReconciler) syncServiceAccount(ctx context.Context) (string, error) {
+	var rbacObjs RbacObjects
+	if v := ctx.Value(RbacObjCtxKey); v != nil {
+		objs, ok := v.(RbacObjects)
+		if !ok {
+			return "", errors.New("Unexpected type for job RBAC config in context")
 		}
+		rbacObjs = objs
+	} else {
+		return "", errors.New("unable to extract job RBAC config from context")
 	}
-	return done, nil
+
+	saname := ""
+	if rbacObjs.Created && r.SyncClusterRole != "" {
+		saname = rbacObjs.ServiceAccount.Name
+	}
+	return saname, nil
 }
 
-func (r *StatefulSetReconciler) getOrCreateJob(ctx context.Context, job batchv1.Job) (batchv1.Job, error) {
+// getOrCreateJob returns the existing Job, or creates it. It returns true if the Job was created.
+func (r *StatefulSetReconciler) getOrCreateJob(ctx context.Context, job batchv1.Job) (batchv1.Job, bool, error) {
 	found := batchv1.Job{}
 	err := r.Client.Get(ctx, client.ObjectKeyFromObject(&job), &found)
 	if apierrors.IsNotFound(err) {
-		return job, r.Client.Create(ctx, &job)
+		err := r.Client.Create(ctx, &job)
+		return job, err == nil, err
 	}
 	if err != nil {
-		return job, err
+		return job, false, err
+	}
+	return found, false, nil
+}
+
+// stopJobs deletes all copy Jobs of the PVC
+func (r *StatefulSetReconciler) stopJobs(ctx context.Context, pi pvc.Entity) error {
+	for _, name := range []string{
+		newJobName(pi.SourceName, pi.BackupName()),
+		newJobName(pi.BackupName(), pi.SourceName),
+		newJobName(pi.SourceName, pi.TargetName()),
+	} {
+		pol := metav1.DeletePropagationForeground
+		job := batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: pi.Namespace}}
+		err := r.Client.Delete(ctx, &job, &client.DeleteOptions{
+			PropagationPolicy: &pol,
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
 	}
-	return found, nil
+	return nil
 }
 
 func newJobName(src, dst string) string {
@@ -98,7 +130,7 @@ func newJob(namespace, image, saname, src, dst string) batchv1.Job {
 						{
 							Name:    "sync",
 							Image:   image,
-							Command: []string{"rsync", "-avhWHAX", "--no-compress", "--progress", "/src/", "/dst/"},
+							Command: []string{"rsync", "-avhWHAX", "--delete", "--no-compress", "--progress", "/src/", "/dst/"},
 							VolumeMounts: []corev1.VolumeMount{
 								{
 									MountPath: "/src",
@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+type eventTargetCtxKey string
+
+// EventTargetCtxKey holds the StatefulSet that events about the resize of its PVCs are recorded on
+const EventTargetCtxKey = eventTargetCtxKey("EventTarget")
+
+// event records a Normal event on the StatefulSet in the context.
+// Without a StatefulSet in the context, the event is dropped.
+func (r StatefulSetReconciler) event(ctx context.Context, reason, messageFmt string, args ...interface{}) {
+	sts, ok := ctx.Value(EventTargetCtxKey).(*appsv1.StatefulSet)
+	if !ok || r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(sts, "Normal", reason, messageFmt, args...)
+}
+
+// reportDetected records a ResizeDetected event, unless a plan was already recorded on the StatefulSet
+func (r StatefulSetReconciler) reportDetected(sts *statefulset.Entity) {
+	recorded, err := statefulset.NewEntity(sts.Old)
+	if err != nil || len(recorded.Pvcs) > 0 || len(sts.Pvcs) == 0 {
+		return
+	}
+	r.Recorder.Event(sts.Old, "Normal", "ResizeDetected", describePlan(sts))
+}
+
+// describePVCSizes lists the PVCs with their current and target size
+func describePVCSizes(pvcs []pvc.Entity) string {
+	sizes := make([]string, 0, len(pvcs))
+	for _, pi := range pvcs {
+		src := pi.SourceSize()
+		sizes = append(sizes, fmt.Sprintf("%s %s -> %s", pi.SourceName, src.String(), pi.TargetSize.String()))
+	}
+	return strings.Join(sizes, ", ")
+}
+
+// describeTemplateSizes lists the storage requested by each volumeClaimTemplate of the StatefulSet
+func describeTemplateSizes(sts *appsv1.StatefulSet) string {
+	sizes := make([]string, 0, len(sts.Spec.VolumeClaimTemplates))
+	for _, tpl := range sts.Spec.VolumeClaimTemplates {
+		size := tpl.Spec.Resources.Requests[corev1.ResourceStorage]
+		sizes = append(sizes, fmt.Sprintf("%s %s", tpl.Name, size.String()))
+	}
+	return strings.Join(sizes, ", ")
+}
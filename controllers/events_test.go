@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
+)
+
+func TestCopyEvents(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "foo"}}
+	ctx := context.WithValue(context.Background(), RbacObjCtxKey, RbacObjects{})
+	ctx = context.WithValue(ctx, EventTargetCtxKey, sts)
+
+	source := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data-web-0", Namespace: "foo"},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1G")},
+			},
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(source).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := StatefulSetReconciler{Client: c, Recorder: recorder, SyncContainerImage: "rsync"}
+	completeJob := func(src, dst string) {
+		job := batchv1.Job{}
+		require.NoError(c.Get(ctx, client.ObjectKey{Name: newJobName(src, dst), Namespace: "foo"}, &job))
+		job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+		require.NoError(c.Status().Update(ctx, &job))
+	}
+	pis := []pvc.Entity{pvc.NewEntity(*source, resource.MustParse("2G"), nil)}
+	var done bool
+	var err error
+
+	// The first call only records the intent
+	for i := 0; i < 2; i++ {
+		pis, done, err = r.backupPVCs(ctx, pis)
+		require.NoError(err)
+		assert.False(done)
+	}
+	completeJob("data-web-0", pis[0].BackupName())
+	pis, done, err = r.backupPVCs(ctx, pis)
+	require.NoError(err)
+	assert.True(done)
+
+	for i := 0; i < 3; i++ {
+		pis, err = r.restorePVCs(ctx, pis)
+		require.NoError(err)
+		require.Len(pis, 1)
+	}
+	completeJob(pis[0].BackupName(), "data-web-0")
+	pis, err = r.restorePVCs(ctx, pis)
+	require.NoError(err)
+	assert.Empty(pis)
+
+	events := []string{}
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	assert.Equal([]string{
+		"Normal BackupStarted Backing up PVC data-web-0 (1G) to data-web-0-backup-1g",
+		"Normal BackupCompleted Backed up PVC data-web-0 (1G)",
+		"Normal SourceRecreated Recreated PVC data-web-0 with 2G (was 1G)",
+		"Normal RestoreStarted Restoring PVC data-web-0 (2G) from data-web-0-backup-1g",
+		"Normal RestoreCompleted Restored PVC data-web-0, resized from 1G to 2G",
+	}, events)
+}
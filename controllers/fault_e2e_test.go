@@ -0,0 +1,68 @@
+//go:build integration
+// +build integration
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+)
+
+// shortFaultStride injects the faults only at every third call against envtest with -short, a resize takes seconds instead of milliseconds.
+// Without -short the faults are injected at every call, like against the fake client.
+const shortFaultStride = 3
+
+// TestFaultsEnvtest runs the fault scenarios against envtest.
+// Unlike the fake client, the API server validates and defaults the objects, and keeps deleted PVCs and Jobs with finalizers.
+// The reconciler is called directly instead of by a manager, so the faults are injected at the same calls on every run.
+func TestFaultsEnvtest(t *testing.T) {
+	ctx := context.Background()
+	testEnv := &envtest.Environment{}
+	conf, err := testEnv.Start()
+	require.NoError(t, err)
+	defer testEnv.Stop()
+	c, err := client.New(conf, client.Options{Scheme: scheme.Scheme})
+	require.NoError(t, err)
+
+	namespaces := 0
+	cluster := func(ctx context.Context, t *testing.T, objs ...client.Object) (client.Client, string) {
+		namespaces++
+		ns := fmt.Sprintf("fault-%d", namespaces)
+		createNamespace(t, ctx, c, ns)
+		for _, obj := range objs {
+			obj.SetNamespace(ns)
+			sts, ok := obj.(*appsv1.StatefulSet)
+			if !ok {
+				require.NoError(t, c.Create(ctx, obj))
+				continue
+			}
+			status := sts.Status
+			sts.Spec.ServiceName = sts.Name
+			require.NoError(t, c.Create(ctx, sts))
+			sts.Status = status
+			require.NoError(t, c.Status().Update(ctx, sts))
+		}
+		return c, ns
+	}
+
+	stride := 1
+	if testing.Short() {
+		stride = shortFaultStride
+	}
+	for k, sc := range faultScenarios() {
+		sc.cluster = cluster
+		sc.stride = stride
+		t.Run(k, func(t *testing.T) {
+			eachFault(ctx, t, sc, func(out faultOutcome, msg string) {
+				checkFaultResized(t, out, msg)
+			})
+		})
+	}
+}
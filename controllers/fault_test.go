@@ -0,0 +1,370 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+// fault is an error injected into the calls of the controller to the API
+type fault string
+
+const (
+	// faultKill fails the call and every call after it, as if the controller was killed
+	faultKill fault = "kill"
+	// faultError fails a single call with an internal server error
+	faultError fault = "error"
+	// faultConflict fails a single write with a conflict
+	faultConflict fault = "conflict"
+)
+
+var errKilled = errors.New("controller killed")
+
+// faultClient injects a fault into the nth call of the controller, and checks the invariants of a resize on every write.
+// Calls are counted over all calls, or over the writes for faultConflict.
+type faultClient struct {
+	client.Client
+	fault fault
+	at    int
+
+	calls      int
+	injected   bool
+	data       map[string]string
+	violations []string
+}
+
+func (c *faultClient) call(write bool) error {
+	if c.fault == faultKill && c.injected {
+		return errKilled
+	}
+	if c.fault == faultConflict && !write {
+		return nil
+	}
+	c.calls++
+	if c.calls != c.at {
+		return nil
+	}
+	c.injected = true
+	switch c.fault {
+	case faultKill:
+		return errKilled
+	case faultConflict:
+		return apierrors.NewConflict(schema.GroupResource{}, "", errors.New("injected conflict"))
+	default:
+		return apierrors.NewInternalError(errors.New("injected error"))
+	}
+}
+
+// restart returns whether the controller was killed, and restarts it
+func (c *faultClient) restart() bool {
+	if c.fault != faultKill || !c.injected {
+		return false
+	}
+	c.fault = ""
+	return true
+}
+
+func (c *faultClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	if err := c.call(false); err != nil {
+		return err
+	}
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+func (c *faultClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if err := c.call(false); err != nil {
+		return err
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+func (c *faultClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if err := c.call(true); err != nil {
+		return err
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c *faultClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if err := c.call(true); err != nil {
+		return err
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func (c *faultClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if err := c.call(true); err != nil {
+		return err
+	}
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func (c *faultClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	if err := c.call(true); err != nil {
+		return err
+	}
+	if p, ok := obj.(*corev1.PersistentVolumeClaim); ok {
+		c.checkSourceDeletion(ctx, p)
+	}
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+// checkSourceDeletion checks that an original PVC is only deleted once its backup is complete
+func (c *faultClient) checkSourceDeletion(ctx context.Context, p *corev1.PersistentVolumeClaim) {
+	data, ok := c.data[p.Name]
+	if !ok {
+		return
+	}
+	found := corev1.PersistentVolumeClaim{}
+	if err := c.Client.Get(ctx, client.ObjectKeyFromObject(p), &found); err != nil || found.Annotations[dataAnnotation] != data {
+		// It is not the original anymore
+		return
+	}
+	backup := corev1.PersistentVolumeClaim{}
+	err := c.Client.Get(ctx, client.ObjectKey{Name: p.Name + "-backup-1g", Namespace: p.Namespace}, &backup)
+	if err != nil || backup.Annotations[dataAnnotation] != data {
+		c.violations = append(c.violations, fmt.Sprintf("PVC %s deleted before its backup was complete", p.Name))
+	}
+}
+
+func newFaultPVC(name, data string) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "foo",
+			Labels:      map[string]string{"app": "web"},
+			Annotations: map[string]string{dataAnnotation: data},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1G")},
+			},
+		},
+	}
+}
+
+func newFaultStatefulSet() *appsv1.StatefulSet {
+	replicas := int32(2)
+	l := map[string]string{"app": "web"}
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "foo"},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: l},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: l},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "test", Image: "test"}}},
+			},
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{
+				ObjectMeta: metav1.ObjectMeta{Name: "data"},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("2G")},
+					},
+				},
+			}},
+		},
+		Status: appsv1.StatefulSetStatus{
+			Replicas: 2, ReadyReplicas: 2, AvailableReplicas: 2, UpdatedReplicas: 2, CurrentRevision: "1",
+		},
+	}
+}
+
+// faultScenario describes a resize of the StatefulSet web with two PVCs, and the faults injected into it
+type faultScenario struct {
+	fault fault
+	at    int
+	sim   clusterSim
+
+	// cluster holds the objects of the scenario, the fake client if nil
+	cluster faultCluster
+	// stride injects the fault only at every nth call, for clusters where a resize is slow
+	stride int
+}
+
+// faultCluster creates the objects of a scenario in a new namespace of a cluster.
+// It returns the client of the cluster and the namespace.
+type faultCluster func(ctx context.Context, t *testing.T, objs ...client.Object) (client.Client, string)
+
+func fakeCluster(_ context.Context, _ *testing.T, objs ...client.Object) (client.Client, string) {
+	return fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(objs...).Build(), "foo"
+}
+
+// faultOutcome is what a resize left behind
+type faultOutcome struct {
+	injected bool
+	failed   bool
+	replicas int32
+	// data holds the data of every PVC, and of its backup if it was kept
+	data, backups map[string]string
+	sizes         map[string]string
+	// jobs holds the names of the Jobs left behind, that are not being deleted
+	jobs []string
+}
+
+// runFaultScenario runs the reconciler until the resize completed or failed.
+// The invariants checked on every call are reported as test errors.
+func runFaultScenario(ctx context.Context, t *testing.T, sc faultScenario) faultOutcome {
+	data := map[string]string{"data-web-0": "zero", "data-web-1": "one"}
+	cluster := sc.cluster
+	if cluster == nil {
+		cluster = fakeCluster
+	}
+	c, ns := cluster(ctx, t, newFaultStatefulSet(), newFaultPVC("data-web-0", data["data-web-0"]), newFaultPVC("data-web-1", data["data-web-1"]))
+	sim := sc.sim
+	sim.Client = c
+	sim.Namespace = ns
+	fc := &faultClient{Client: c, fault: sc.fault, at: sc.at, data: data}
+	newReconciler := func() StatefulSetReconciler {
+		return StatefulSetReconciler{Client: fc, Recorder: &record.FakeRecorder{}, SyncContainerImage: "rsync"}
+	}
+	r := newReconciler()
+	req := ctrl.Request{NamespacedName: client.ObjectKey{Name: "web", Namespace: ns}}
+	msg := fmt.Sprintf("%s at call %d", sc.fault, sc.at)
+
+	out := faultOutcome{}
+	started := false
+	for i := 0; i < 100; i++ {
+		// Errors are retried by the next reconcile
+		_, _ = r.Reconcile(ctx, req)
+		if fc.restart() {
+			// The restarted controller only knows what it recorded in the cluster
+			r = newReconciler()
+		}
+		require.NoError(t, sim.step(ctx))
+
+		sts := appsv1.StatefulSet{}
+		require.NoError(t, c.Get(ctx, req.NamespacedName, &sts), msg)
+		si, err := statefulset.NewEntity(&sts)
+		require.NoError(t, err, msg)
+		out.failed = si.Failed()
+		out.replicas = *sts.Spec.Replicas
+		started = started || si.Started()
+		if out.failed || (started && !si.Started() && !si.Resizing() && out.replicas == 2) {
+			break
+		}
+	}
+	assert.Empty(t, fc.violations, msg)
+
+	out.injected = fc.injected
+	out.data = map[string]string{}
+	out.backups = map[string]string{}
+	out.sizes = map[string]string{}
+	for name := range data {
+		found := corev1.PersistentVolumeClaim{}
+		if err := c.Get(ctx, client.ObjectKey{Name: name, Namespace: ns}, &found); err == nil {
+			q := found.Spec.Resources.Requests[corev1.ResourceStorage]
+			out.data[name] = found.Annotations[dataAnnotation]
+			out.sizes[name] = q.String()
+		}
+		if err := c.Get(ctx, client.ObjectKey{Name: name + "-backup-1g", Namespace: ns}, &found); err == nil {
+			out.backups[name] = found.Annotations[dataAnnotation]
+		}
+	}
+	jobs := batchv1.JobList{}
+	require.NoError(t, c.List(ctx, &jobs, client.InNamespace(ns)), msg)
+	for _, j := range jobs.Items {
+		if j.DeletionTimestamp == nil {
+			out.jobs = append(out.jobs, j.Name)
+		}
+	}
+	return out
+}
+
+// eachFault runs the scenario with its fault injected at every call, until a resize completes before the fault is injected
+func eachFault(ctx context.Context, t *testing.T, sc faultScenario, check func(faultOutcome, string)) {
+	stride := sc.stride
+	if stride < 1 {
+		stride = 1
+	}
+	for at := 1; ; at += stride {
+		sc.at = at
+		out := runFaultScenario(ctx, t, sc)
+		if t.Failed() || !out.injected {
+			return
+		}
+		check(out, fmt.Sprintf("%s at call %d", sc.fault, at))
+	}
+}
+
+// faultScenarios are the scenarios of TestFaults, the resize completes despite each of their faults
+func faultScenarios() map[string]faultScenario {
+	return map[string]faultScenario{
+		"kill":                     {fault: faultKill},
+		"kill with slow deletions": {fault: faultKill, sim: clusterSim{DeletionDelay: 2}},
+		"api errors":               {fault: faultError},
+		"conflicts":                {fault: faultConflict},
+	}
+}
+
+// checkFaultResized checks that the resize completed with the data of every PVC
+func checkFaultResized(t *testing.T, out faultOutcome, msg string) {
+	assert.False(t, out.failed, msg)
+	assert.Equal(t, int32(2), out.replicas, msg)
+	assert.Equal(t, map[string]string{"data-web-0": "zero", "data-web-1": "one"}, out.data, msg)
+	assert.Equal(t, map[string]string{"data-web-0": "2G", "data-web-1": "2G"}, out.sizes, msg)
+	assert.Empty(t, out.jobs, "%s: jobs cleaned up", msg)
+}
+
+func TestFaults(t *testing.T) {
+	ctx := context.Background()
+	for k, sc := range faultScenarios() {
+		t.Run(k, func(t *testing.T) {
+			eachFault(ctx, t, sc, func(out faultOutcome, msg string) {
+				checkFaultResized(t, out, msg)
+			})
+		})
+	}
+}
+
+// TestJobFailures fails every copy Job in turn.
+// The StatefulSet is scaled back up, unless a PVC was already replaced. Its data is always kept in the original PVC or its backup.
+func TestJobFailures(t *testing.T) {
+	ctx := context.Background()
+	expected := map[string]string{"data-web-0": "zero", "data-web-1": "one"}
+
+	for n := 1; ; n++ {
+		msg := fmt.Sprintf("job %d failed", n)
+		out := runFaultScenario(ctx, t, faultScenario{sim: clusterSim{
+			FailJob: func(i int, _ batchv1.Job) bool { return i == n },
+		}})
+		if !out.failed {
+			// The resize needs less than n Jobs
+			assert.Equal(t, expected, out.data, msg)
+			return
+		}
+
+		replaced := false
+		for name, data := range expected {
+			if out.data[name] != data {
+				replaced = true
+				assert.Equal(t, data, out.backups[name], "%s: backup of replaced PVC %s is kept", msg, name)
+			}
+		}
+		if replaced {
+			assert.Equal(t, int32(0), out.replicas, "%s: StatefulSet stays scaled down", msg)
+		} else {
+			assert.Equal(t, int32(2), out.replicas, "%s: StatefulSet is scaled up", msg)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+
+	"github.com/vshn/statefulset-resize-controller/naming"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+// HookJobKey is the key of the Job manifest in a hook ConfigMap
+const HookJobKey = "job.yaml"
+
+// HookLabel marks the ConfigMaps that may be used as hooks.
+// Without it, anyone allowed to edit a ConfigMap could have the controller run its content as a Job.
+const HookLabel = "sts-resize.vshn.net/hook"
+
+// runHook runs the Job defined for the hook, if any, and waits for it to complete.
+// It returns true if the hook completed during this resize or if there is no hook defined.
+func (r StatefulSetReconciler) runHook(ctx context.Context, sts *statefulset.Entity, h statefulset.Hook) (bool, error) {
+	cmName := sts.HookTemplate(h)
+	if cmName == "" || sts.HookCompleted(h) {
+		return true, nil
+	}
+	l := log.FromContext(ctx).WithValues("hook", h)
+
+	// If we fail before scaling down, there is nothing to scale back up
+	saveToScaleUp := h != statefulset.HookPreScaleDown
+
+	cm := corev1.ConfigMap{}
+	err := r.Get(ctx, client.ObjectKey{Name: cmName, Namespace: sts.Old.Namespace}, &cm)
+	if apierrors.IsNotFound(err) {
+		return false, CriticalError{
+			Err:           err,
+			Event:         fmt.Sprintf("ConfigMap %s of hook %s not found", cmName, h),
+			SaveToScaleUp: saveToScaleUp,
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	job, err := newHookJob(cm, sts.Old, h)
+	if err != nil {
+		return false, CriticalError{
+			Err:           err,
+			Event:         fmt.Sprintf("Invalid Job template for hook %s in ConfigMap %s: %s", h, cmName, err),
+			SaveToScaleUp: saveToScaleUp,
+		}
+	}
+
+	job, _, err = r.getOrCreateJob(ctx, job)
+	if err != nil {
+		return false, err
+	}
+	done, err := isJobDone(job)
+	if err != nil {
+		return false, CriticalError{
+			Err:           err,
+			Event:         fmt.Sprintf("Hook %s failed, see Job %s", h, job.Name),
+			SaveToScaleUp: saveToScaleUp,
+		}
+	}
+	if !done {
+		return false, nil
+	}
+
+	l.Info("Hook completed")
+	pol := metav1.DeletePropagationForeground
+	err = r.Client.Delete(ctx, &job, &client.DeleteOptions{
+		PropagationPolicy: &pol,
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return false, err
+	}
+	sts.SetHookCompleted(h)
+	return true, nil
+}
+
+func newHookJobName(stsName string, h statefulset.Hook) string {
+	maxNameLength := 63
+	prefix := fmt.Sprintf("hook-%s-", h)
+	// The ignored error is impossible
+	stsName, _ = naming.ShortenName(stsName, maxNameLength-len(prefix))
+	return strings.ToLower(prefix + stsName)
+}
+
+// newHookJob creates the Job of a hook from the manifest in the ConfigMap.
+// The Job runs with the service account of the pods of the StatefulSet, so a hook can not do more than the StatefulSet itself.
+func newHookJob(cm corev1.ConfigMap, sts *appsv1.StatefulSet, h statefulset.Hook) (batchv1.Job, error) {
+	tpl := batchv1.Job{}
+	if cm.Labels[HookLabel] != "true" {
+		return tpl, fmt.Errorf("ConfigMap %s is not labeled %s=true", cm.Name, HookLabel)
+	}
+	manifest, ok := cm.Data[HookJobKey]
+	if !ok {
+		return tpl, fmt.Errorf("ConfigMap %s does not contain key %s", cm.Name, HookJobKey)
+	}
+	if err := yaml.UnmarshalStrict([]byte(manifest), &tpl); err != nil {
+		return tpl, fmt.Errorf("unable to parse Job in ConfigMap %s: %w", cm.Name, err)
+	}
+
+	sa := sts.Spec.Template.Spec.ServiceAccountName
+	pod := tpl.Spec.Template.Spec
+	if (pod.ServiceAccountName != "" && pod.ServiceAccountName != sa) ||
+		(pod.DeprecatedServiceAccount != "" && pod.DeprecatedServiceAccount != sa) {
+		return tpl, fmt.Errorf("Job in ConfigMap %s may only use the service account of StatefulSet %s", cm.Name, sts.Name)
+	}
+	tpl.Spec.Template.Spec.ServiceAccountName = sa
+	tpl.Spec.Template.Spec.DeprecatedServiceAccount = ""
+
+	labels := map[string]string{}
+	for k, v := range tpl.Labels {
+		labels[k] = v
+	}
+	labels[ManagedLabel] = "true"
+
+	job := batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        newHookJobName(sts.Name, h),
+			Namespace:   sts.Namespace,
+			Labels:      labels,
+			Annotations: tpl.Annotations,
+		},
+		Spec: tpl.Spec,
+	}
+	env := []corev1.EnvVar{
+		{Name: "STS_RESIZE_HOOK", Value: string(h)},
+		{Name: "STS_RESIZE_STATEFULSET", Value: sts.Name},
+	}
+	for i := range job.Spec.Template.Spec.Containers {
+		c := &job.Spec.Template.Spec.Containers[i]
+		c.Env = append(c.Env, env...)
+	}
+	return job, nil
+}
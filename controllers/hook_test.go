@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+func TestNewHookJob(t *testing.T) {
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "space"},
+		Spec: appsv1.StatefulSetSpec{Template: corev1.PodTemplateSpec{
+			Spec: corev1.PodSpec{ServiceAccountName: "web"},
+		}},
+	}
+	tcs := map[string]struct {
+		data      map[string]string
+		unlabeled bool
+		fail      bool
+	}{
+		"valid": {
+			data: map[string]string{HookJobKey: `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: ignored
+  labels:
+    app: flush
+spec:
+  backoffLimit: 2
+  template:
+    spec:
+      restartPolicy: Never
+      containers:
+      - name: flush
+        image: postgres
+        command: ["psql", "-c", "CHECKPOINT"]
+`},
+		},
+		"same service account": {
+			data: map[string]string{HookJobKey: `
+metadata:
+  labels:
+    app: flush
+spec:
+  backoffLimit: 2
+  template:
+    spec:
+      serviceAccountName: web
+      containers:
+      - name: flush
+        image: postgres
+`},
+		},
+		"other service account": {
+			data: map[string]string{HookJobKey: `
+spec:
+  template:
+    spec:
+      serviceAccountName: admin
+      containers:
+      - name: flush
+        image: postgres
+`},
+			fail: true,
+		},
+		"not labeled": {
+			data: map[string]string{HookJobKey: `
+spec:
+  template:
+    spec:
+      containers:
+      - name: flush
+        image: postgres
+`},
+			unlabeled: true,
+			fail:      true,
+		},
+		"missing key": {
+			data: map[string]string{"job": ""},
+			fail: true,
+		},
+		"unknown fields": {
+			data: map[string]string{HookJobKey: `
+spec:
+  templat: {}
+`},
+			fail: true,
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			cm := corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "hook", Namespace: "space", Labels: map[string]string{HookLabel: "true"}},
+				Data:       tc.data,
+			}
+			if tc.unlabeled {
+				cm.Labels = nil
+			}
+			job, err := newHookJob(cm, sts, statefulset.HookPreScaleDown)
+			if tc.fail {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			assert.Equal(t, "hook-pre-scale-down-web", job.Name)
+			assert.Equal(t, "space", job.Namespace)
+			assert.Equal(t, "true", job.Labels[ManagedLabel])
+			assert.Equal(t, "flush", job.Labels["app"])
+			assert.Equal(t, int32(2), *job.Spec.BackoffLimit)
+			assert.Equal(t, "web", job.Spec.Template.Spec.ServiceAccountName, "runs as the StatefulSet")
+			require.Len(t, job.Spec.Template.Spec.Containers, 1)
+			assert.Contains(t, job.Spec.Template.Spec.Containers[0].Env,
+				corev1.EnvVar{Name: "STS_RESIZE_STATEFULSET", Value: "web"})
+		})
+	}
+}
+
+func TestNewHookJobName(t *testing.T) {
+	name := newHookJobName("mysuperlongstsnamewhichwillbeshortenedbythecontrolleroratleastitshould", statefulset.HookPostScaleUp)
+	assert.Regexp(t, regexValidKubeName, name)
+	assert.LessOrEqual(t, len(name), 63)
+}
@@ -58,7 +58,7 @@ func (r *InplaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		return ctrl.Result{}, err
 	}
 
-	stsEntity.Pvcs, err = fetchResizablePVCs(ctx, r.Client, *stsEntity)
+	stsEntity.Pvcs, err = fetchResizablePVCs(ctx, r.Client, *stsEntity, statefulset.OutOfRangeResize)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// matchPVC matches the PVC to one of the volumeClaimTemplates of the StatefulSet.
+// It returns the matching template and the ordinal of the replica the PVC belongs to.
+//
+// StS managed PVCs are created according to the VolumeClaimTemplate.
+// The name of the resulting PVC will be in the following format:
+// <template.name>-<sts.name>-<ordinal-number>
+// A PVC with such a name matches, even if its labels drifted from the selector of the StatefulSet.
+// Names are ambiguous though: StatefulSet `a-b` with template `data` and StatefulSet `b` with template `data-a` both name their PVCs `data-a-b-<ordinal>`.
+// If one of the other StatefulSets in the namespace could produce the same name, the PVC only matches if it is owned by the StatefulSet or its pod,
+// or if its labels match the selector of the StatefulSet and of none of the colliding StatefulSets.
+// PVCs owned by another StatefulSet or by a pod of another StatefulSet, as set by the persistentVolumeClaimRetentionPolicy, never match.
+func matchPVC(ctx context.Context, sts appsv1.StatefulSet, others []appsv1.StatefulSet, p corev1.PersistentVolumeClaim) (corev1.PersistentVolumeClaim, int, bool) {
+	// Very spammy but could help in error cases
+	l := log.FromContext(ctx).WithValues("Namespace", p.Namespace, "Pvc", p.Name, "StatefulSet", sts.Name).V(2)
+	if p.Namespace != sts.Namespace {
+		return corev1.PersistentVolumeClaim{}, 0, false
+	}
+	for _, tpl := range sts.Spec.VolumeClaimTemplates {
+		ordinal, ok := parsePVCName(p.Name, tpl.Name, sts.Name)
+		if !ok {
+			continue
+		}
+		owned, foreign := pvcOwnership(sts, p, ordinal)
+		if foreign {
+			l.Info("pvc is owned by another resource")
+			return corev1.PersistentVolumeClaim{}, 0, false
+		}
+		if owned {
+			return tpl, ordinal, true
+		}
+		colliding := collidingStatefulSets(sts, others, p)
+		if len(colliding) == 0 {
+			return tpl, ordinal, true
+		}
+		if !matchesSelector(sts, p) {
+			l.Info("pvc name collides with another StatefulSet, its labels do not match the selector", "colliding", colliding[0].Name)
+			return corev1.PersistentVolumeClaim{}, 0, false
+		}
+		for _, o := range colliding {
+			if matchesSelector(o, p) {
+				l.Info("pvc name collides with another StatefulSet whose selector matches as well", "colliding", o.Name)
+				return corev1.PersistentVolumeClaim{}, 0, false
+			}
+		}
+		return tpl, ordinal, true
+	}
+	l.Info("pvc does not match any template")
+	return corev1.PersistentVolumeClaim{}, 0, false
+}
+
+// collidingStatefulSets returns the other StatefulSets in the namespace of the PVC that could produce its name
+func collidingStatefulSets(sts appsv1.StatefulSet, others []appsv1.StatefulSet, p corev1.PersistentVolumeClaim) []appsv1.StatefulSet {
+	colliding := []appsv1.StatefulSet{}
+	for _, o := range others {
+		if o.Name == sts.Name || o.Namespace != p.Namespace {
+			continue
+		}
+		for _, tpl := range o.Spec.VolumeClaimTemplates {
+			if _, ok := parsePVCName(p.Name, tpl.Name, o.Name); ok {
+				colliding = append(colliding, o)
+				break
+			}
+		}
+	}
+	return colliding
+}
+
+// listStatefulSets returns the StatefulSets in the namespace, whose PVC names could collide with the ones of the resized StatefulSet
+func listStatefulSets(ctx context.Context, cl client.Client, namespace string) ([]appsv1.StatefulSet, error) {
+	list := appsv1.StatefulSetList{}
+	if err := cl.List(ctx, &list, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// parsePVCName returns the ordinal of a PVC named after the template and the StatefulSet.
+func parsePVCName(name, tpl, sts string) (int, bool) {
+	prefix := fmt.Sprintf("%s-%s-", tpl, sts)
+	if !strings.HasPrefix(name, prefix) {
+		return 0, false
+	}
+	n := strings.TrimPrefix(name, prefix)
+	ordinal, err := strconv.Atoi(n)
+	if err != nil || ordinal < 0 || strconv.Itoa(ordinal) != n {
+		return 0, false
+	}
+	return ordinal, true
+}
+
+// pvcOwnership checks the owner references of the PVC.
+// It returns whether the PVC is owned by the StatefulSet or its pod with the ordinal, and whether it is owned by another StatefulSet or pod.
+func pvcOwnership(sts appsv1.StatefulSet, p corev1.PersistentVolumeClaim, ordinal int) (owned bool, foreign bool) {
+	for _, ref := range p.OwnerReferences {
+		switch {
+		case ref.Kind == "StatefulSet" && strings.HasPrefix(ref.APIVersion, "apps/"):
+			// The UID changes if the StatefulSet is recreated, so we only compare the name
+			if ref.Name == sts.Name {
+				owned = true
+			} else {
+				foreign = true
+			}
+		case ref.Kind == "Pod" && ref.APIVersion == "v1":
+			if ref.Name == fmt.Sprintf("%s-%d", sts.Name, ordinal) {
+				owned = true
+			} else {
+				foreign = true
+			}
+		}
+	}
+	return owned, foreign
+}
+
+func matchesSelector(sts appsv1.StatefulSet, p corev1.PersistentVolumeClaim) bool {
+	sel, err := metav1.LabelSelectorAsSelector(sts.Spec.Selector)
+	if err != nil {
+		return false
+	}
+	return sel.Matches(labels.Set(p.Labels))
+}
@@ -0,0 +1,184 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestMatchPVC(t *testing.T) {
+	sts := appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "foo", UID: "1234"},
+		Spec: appsv1.StatefulSetSpec{
+			Selector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{
+					Key:      "app",
+					Operator: metav1.LabelSelectorOpIn,
+					Values:   []string{"web", "nginx"},
+				}},
+			},
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{
+				{ObjectMeta: metav1.ObjectMeta{Name: "data"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "data-log"}},
+			},
+		},
+	}
+	owner := func(apiVersion, kind, name, uid string) []metav1.OwnerReference {
+		return []metav1.OwnerReference{{APIVersion: apiVersion, Kind: kind, Name: name, UID: types.UID(uid)}}
+	}
+
+	tcs := map[string]struct {
+		name      string
+		namespace string
+		labels    map[string]string
+		owners    []metav1.OwnerReference
+		match     bool
+		template  string
+		ordinal   int
+	}{
+		"by selector": {
+			name:     "data-web-0",
+			labels:   map[string]string{"app": "nginx"},
+			match:    true,
+			template: "data",
+			ordinal:  0,
+		},
+		"drifted labels without owner references": {
+			name:     "data-web-3",
+			labels:   map[string]string{"app": "old"},
+			match:    true,
+			template: "data",
+			ordinal:  3,
+		},
+		"drifted labels owned by statefulset": {
+			name:     "data-web-3",
+			labels:   map[string]string{"app": "old"},
+			owners:   owner("apps/v1", "StatefulSet", "web", "1234"),
+			match:    true,
+			template: "data",
+			ordinal:  3,
+		},
+		"second template": {
+			name:     "data-log-web-12",
+			labels:   map[string]string{"app": "web"},
+			match:    true,
+			template: "data-log",
+			ordinal:  12,
+		},
+		"owned by statefulset": {
+			name:     "data-web-1",
+			owners:   owner("apps/v1", "StatefulSet", "web", "1234"),
+			match:    true,
+			template: "data",
+			ordinal:  1,
+		},
+		"owned by pod": {
+			name:     "data-web-2",
+			owners:   owner("v1", "Pod", "web-2", "5678"),
+			match:    true,
+			template: "data",
+			ordinal:  2,
+		},
+		"owned by recreated statefulset": {
+			name:     "data-web-1",
+			owners:   owner("apps/v1", "StatefulSet", "web", "0000"),
+			match:    true,
+			template: "data",
+			ordinal:  1,
+		},
+		"owned by other statefulset": {
+			name:   "data-web-1",
+			owners: owner("apps/v1", "StatefulSet", "db", "1234"),
+			match:  false,
+		},
+		"owned by other pod": {
+			name:   "data-web-2",
+			owners: owner("v1", "Pod", "web-3", "5678"),
+			match:  false,
+		},
+		"other statefulset": {
+			name:  "data-webapp-0",
+			match: false,
+		},
+		"no ordinal": {
+			name:  "data-web-pvc",
+			match: false,
+		},
+		"padded ordinal": {
+			name:  "data-web-01",
+			match: false,
+		},
+		"other namespace": {
+			name:      "data-web-0",
+			namespace: "bar",
+			match:     false,
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			ns := tc.namespace
+			if ns == "" {
+				ns = "foo"
+			}
+			p := corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            tc.name,
+					Namespace:       ns,
+					Labels:          tc.labels,
+					OwnerReferences: tc.owners,
+				},
+			}
+			tpl, ordinal, ok := matchPVC(context.Background(), sts, []appsv1.StatefulSet{sts}, p)
+			assert.Equal(t, tc.match, ok)
+			if tc.match {
+				assert.Equal(t, tc.template, tpl.Name)
+				assert.Equal(t, tc.ordinal, ordinal)
+			}
+		})
+	}
+}
+
+// TestMatchPVCNameCollision checks the PVCs of two StatefulSets whose PVC names collide.
+// StatefulSet a-b with template data and StatefulSet b with template data-a both name their first PVC data-a-b-0.
+func TestMatchPVCNameCollision(t *testing.T) {
+	newSts := func(name, tpl string) appsv1.StatefulSet {
+		return appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "foo"},
+			Spec: appsv1.StatefulSetSpec{
+				Selector:             &metav1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+				VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{ObjectMeta: metav1.ObjectMeta{Name: tpl}}},
+			},
+		}
+	}
+	ab := newSts("a-b", "data")
+	b := newSts("b", "data-a")
+	others := []appsv1.StatefulSet{ab, b}
+	newPVC := func(labels map[string]string, owners []metav1.OwnerReference) corev1.PersistentVolumeClaim {
+		return corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "data-a-b-0", Namespace: "foo", Labels: labels, OwnerReferences: owners},
+		}
+	}
+
+	p := newPVC(map[string]string{"app": "b"}, nil)
+	_, _, ok := matchPVC(context.Background(), b, others, p)
+	assert.True(t, ok, "PVC of b")
+	_, _, ok = matchPVC(context.Background(), ab, others, p)
+	assert.False(t, ok, "a-b does not take the PVC of b")
+
+	drifted := newPVC(map[string]string{"app": "old"}, nil)
+	_, _, ok = matchPVC(context.Background(), b, others, drifted)
+	assert.False(t, ok, "drifted labels are ambiguous for b")
+	_, _, ok = matchPVC(context.Background(), ab, others, drifted)
+	assert.False(t, ok, "drifted labels are ambiguous for a-b")
+	_, _, ok = matchPVC(context.Background(), b, []appsv1.StatefulSet{b}, drifted)
+	assert.True(t, ok, "no collision without a-b")
+
+	owned := newPVC(map[string]string{"app": "old"}, []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "a-b"}})
+	_, _, ok = matchPVC(context.Background(), ab, others, owned)
+	assert.True(t, ok, "the owner reference resolves the collision")
+}
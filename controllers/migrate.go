@@ -0,0 +1,443 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/vshn/statefulset-resize-controller/naming"
+	"github.com/vshn/statefulset-resize-controller/pvc"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+// MigrationLabel selects the rsync server and client of a migration
+const MigrationLabel = "sts-resize.vshn.net/migration"
+
+const (
+	migrationUser   = "sync"
+	migrationPort   = 873
+	migrationModule = "data"
+)
+
+// MigrationSourcesAnnotation on a Namespace lists the namespaces that may migrate PVCs into it, separated by commas.
+// Annotating a StatefulSet is not enough to have the controller create objects in another namespace, the target has to opt in.
+const MigrationSourcesAnnotation = "sts-resize.vshn.net/accept-migrations-from"
+
+// holdForMigration holds back a migration as long as the target namespace does not accept it, or a HorizontalPodAutoscaler targets the StatefulSet.
+// The StatefulSet stays scaled down after the migration, which an autoscaler would undo.
+func (r *StatefulSetReconciler) holdForMigration(ctx context.Context, sts *statefulset.Entity, now time.Time) (ctrl.Result, bool, error) {
+	ns := sts.MigrateTo()
+	if ns == "" {
+		return ctrl.Result{}, false, nil
+	}
+	accepted, err := r.migrationAccepted(ctx, sts.Old.Namespace, ns)
+	if err != nil {
+		return ctrl.Result{}, false, err
+	}
+	if !accepted {
+		return r.holdBlocked(ctx, sts, "MigrationNotAccepted", "MigrationBlocked",
+			fmt.Sprintf("Not migrating, namespace %s does not accept migrations from namespace %s. Add it to the annotation %s of the namespace to migrate",
+				ns, sts.Old.Namespace, MigrationSourcesAnnotation), now)
+	}
+	hpas, err := r.fetchHPAs(ctx, sts)
+	if err != nil || len(hpas) == 0 {
+		return ctrl.Result{}, false, err
+	}
+	names := make([]string, 0, len(hpas))
+	for _, hpa := range hpas {
+		names = append(names, hpa.Name)
+	}
+	return r.holdBlocked(ctx, sts, "Autoscaled", "MigrationBlocked",
+		fmt.Sprintf("Not migrating, HorizontalPodAutoscaler %s would scale up the StatefulSet after the migration. Remove it to migrate", strings.Join(names, ", ")), now)
+}
+
+// migrationAccepted returns whether the target namespace accepts migrations from the source namespace
+func (r StatefulSetReconciler) migrationAccepted(ctx context.Context, source, target string) (bool, error) {
+	ns := corev1.Namespace{}
+	err := r.Get(ctx, client.ObjectKey{Name: target}, &ns)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, s := range strings.Split(ns.Annotations[MigrationSourcesAnnotation], ",") {
+		if strings.TrimSpace(s) == source {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// migratePVC copies the PVC to a PVC with the same name in the target namespace.
+// The original PVC is not modified.
+func (r StatefulSetReconciler) migratePVC(ctx context.Context, pi pvc.Entity) (pvc.Entity, bool, error) {
+	// The target namespace is checked again, as it is read from the state of the resize
+	accepted, err := r.migrationAccepted(ctx, pi.Namespace, pi.TargetNamespace)
+	if err != nil {
+		return pi, false, err
+	}
+	if !accepted {
+		return pi, false, CriticalError{
+			Err:           fmt.Errorf("namespace %s does not accept migrations from namespace %s", pi.TargetNamespace, pi.Namespace),
+			Event:         fmt.Sprintf("Namespace %s does not accept migrations from namespace %s", pi.TargetNamespace, pi.Namespace),
+			SaveToScaleUp: true,
+		}
+	}
+	if err := r.createMigratedIfNotExists(ctx, pi); err != nil {
+		return pi, false, err
+	}
+	started, done, err := r.copyPVC(ctx,
+		client.ObjectKey{Name: pi.SourceName, Namespace: pi.Namespace},
+		client.ObjectKey{Name: pi.SourceName, Namespace: pi.TargetNamespace})
+	if started {
+		src := pi.SourceSize()
+		r.event(ctx, "BackupStarted", "Copying PVC %s (%s) to namespace %s (%s)",
+			pi.SourceName, src.String(), pi.TargetNamespace, pi.TargetSize.String())
+	}
+	if err == nil && done {
+		pi.BackedUp = true
+	}
+	return pi, done, err
+}
+
+func (r StatefulSetReconciler) createMigratedIfNotExists(ctx context.Context, pi pvc.Entity) error {
+	found := corev1.PersistentVolumeClaim{}
+	err := r.Get(ctx, client.ObjectKey{Name: pi.SourceName, Namespace: pi.TargetNamespace}, &found)
+	if apierrors.IsNotFound(err) {
+		return r.Create(ctx, pi.GetMigrated())
+	}
+	if err != nil {
+		return err
+	}
+	if found.Annotations[pvc.MigratedFromAnnotation] != pi.Namespace {
+		// Never overwrite data we did not create
+		return CriticalError{
+			Err: fmt.Errorf("PVC %s already exists in namespace %s", pi.SourceName, pi.TargetNamespace),
+		}
+	}
+	return nil
+}
+
+// copyPVCAcrossNamespaces copies the data of src to dst through rsync.
+// An rsync daemon serves the destination PVC in its namespace and a Job in the namespace of src pushes the data.
+// The daemon authenticates the Job with a random password, shared through a Secret in both namespaces.
+// The rsync protocol is not encrypted, so a NetworkPolicy only admits the Job to the daemon.
+// The data is only as confidential as the network of the cluster, use a CNI that enforces NetworkPolicies and encrypts traffic between nodes if needed.
+func (r *StatefulSetReconciler) copyPVCAcrossNamespaces(ctx context.Context, src, dst client.ObjectKey, saname string) (bool, bool, error) {
+	name := newMigrationName(src.Name)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: dst.Namespace}}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(&secret), &secret); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return false, false, err
+		}
+		secret, err = newMigrationSecret(dst.Namespace, name)
+		if err != nil {
+			return false, false, err
+		}
+		if err := r.Create(ctx, &secret); err != nil {
+			return false, false, err
+		}
+	}
+	srcSecret := secret.DeepCopy()
+	srcSecret.ObjectMeta = metav1.ObjectMeta{Name: name, Namespace: src.Namespace, Labels: secret.Labels}
+	if err := r.getOrCreate(ctx, srcSecret); err != nil {
+		return false, false, err
+	}
+	netpol := newMigrationNetworkPolicy(dst.Namespace, name, src.Namespace)
+	if err := r.getOrCreate(ctx, &netpol); err != nil {
+		return false, false, err
+	}
+	svc := newMigrationService(dst.Namespace, name)
+	if err := r.getOrCreate(ctx, &svc); err != nil {
+		return false, false, err
+	}
+
+	server, _, err := r.getOrCreateJob(ctx, newMigrationServer(dst.Namespace, r.SyncContainerImage, name, dst.Name))
+	if err != nil {
+		return false, false, err
+	}
+	if _, err := isJobDone(server); err != nil {
+		return false, false, err
+	}
+
+	job, created, err := r.getOrCreateJob(ctx, newMigrationClient(src.Namespace, r.SyncContainerImage, saname, name, src.Name, dst.Namespace))
+	if err != nil {
+		return false, false, err
+	}
+	done, err := isJobDone(job)
+	if err != nil || !done {
+		return created, done, err
+	}
+	return created, true, r.deleteMigrationObjs(ctx, name, src.Namespace, dst.Namespace)
+}
+
+func (r *StatefulSetReconciler) deleteMigrationObjs(ctx context.Context, name, srcNamespace, dstNamespace string) error {
+	pol := metav1.DeletePropagationForeground
+	for _, obj := range []client.Object{
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: name + "-client", Namespace: srcNamespace}},
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: name + "-server", Namespace: dstNamespace}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: dstNamespace}},
+		&networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: dstNamespace}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: dstNamespace}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: srcNamespace}},
+	} {
+		err := r.Client.Delete(ctx, obj, &client.DeleteOptions{PropagationPolicy: &pol})
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *StatefulSetReconciler) getOrCreate(ctx context.Context, obj client.Object) error {
+	err := r.Client.Get(ctx, client.ObjectKeyFromObject(obj), obj)
+	if apierrors.IsNotFound(err) {
+		return r.Client.Create(ctx, obj)
+	}
+	return err
+}
+
+func newMigrationName(pvcName string) string {
+	// Leave room for the suffix of the Jobs
+	maxNameLength := 48
+	// The ignored error is impossible
+	name, _ := naming.ShortenName(pvcName, maxNameLength)
+	return strings.ToLower(fmt.Sprintf("migrate-%s", name))
+}
+
+func newMigrationSecret(namespace, name string) (corev1.Secret, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return corev1.Secret{}, err
+	}
+	password := hex.EncodeToString(b)
+	conf := fmt.Sprintf(`uid = root
+gid = root
+use chroot = no
+[%s]
+    path = /dst
+    read only = false
+    auth users = %s
+    secrets file = /etc/rsyncd/rsyncd.secrets
+`, migrationModule, migrationUser)
+
+	return corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				ManagedLabel: "true",
+			},
+		},
+		Data: map[string][]byte{
+			"rsyncd.conf":    []byte(conf),
+			"rsyncd.secrets": []byte(fmt.Sprintf("%s:%s\n", migrationUser, password)),
+			"password":       []byte(password + "\n"),
+		},
+	}, nil
+}
+
+func newMigrationService(namespace, name string) corev1.Service {
+	return corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				ManagedLabel: "true",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{
+				MigrationLabel: name,
+			},
+			Ports: []corev1.ServicePort{{
+				Name:       "rsync",
+				Port:       migrationPort,
+				TargetPort: intstr.FromInt(migrationPort),
+			}},
+		},
+	}
+}
+
+// newMigrationNetworkPolicy only admits the client Job of the migration in the source namespace to the rsync daemon
+func newMigrationNetworkPolicy(namespace, name, srcNamespace string) networkingv1.NetworkPolicy {
+	port := intstr.FromInt(migrationPort)
+	return networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				ManagedLabel: "true",
+			},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: map[string]string{MigrationLabel: name},
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{{
+				From: []networkingv1.NetworkPolicyPeer{{
+					NamespaceSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{corev1.LabelMetadataName: srcNamespace},
+					},
+					PodSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{MigrationLabel: name},
+					},
+				}},
+				Ports: []networkingv1.NetworkPolicyPort{{Port: &port}},
+			}},
+		},
+	}
+}
+
+func newMigrationServer(namespace, image, name, dst string) batchv1.Job {
+	mode := int32(0400)
+	return batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name + "-server",
+			Namespace: namespace,
+			Labels: map[string]string{
+				ManagedLabel: "true",
+			},
+		},
+		Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						MigrationLabel: name,
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:    "rsyncd",
+							Image:   image,
+							Command: []string{"rsync", "--daemon", "--no-detach", "--config=/etc/rsyncd/rsyncd.conf", fmt.Sprintf("--port=%d", migrationPort)},
+							Ports: []corev1.ContainerPort{{
+								Name:          "rsync",
+								ContainerPort: migrationPort,
+							}},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									MountPath: "/dst",
+									Name:      "dst",
+								},
+								{
+									MountPath: "/etc/rsyncd",
+									Name:      "config",
+									ReadOnly:  true,
+								},
+							},
+						},
+					},
+					RestartPolicy: corev1.RestartPolicyOnFailure,
+					Volumes: []corev1.Volume{
+						{
+							Name: "dst",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: dst,
+								},
+							},
+						},
+						{
+							Name: "config",
+							VolumeSource: corev1.VolumeSource{
+								Secret: &corev1.SecretVolumeSource{
+									SecretName:  name,
+									DefaultMode: &mode,
+									Items: []corev1.KeyToPath{
+										{Key: "rsyncd.conf", Path: "rsyncd.conf"},
+										{Key: "rsyncd.secrets", Path: "rsyncd.secrets"},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func newMigrationClient(namespace, image, saname, name, src, dstNamespace string) batchv1.Job {
+	mode := int32(0400)
+	target := fmt.Sprintf("rsync://%s@%s.%s.svc:%d/%s/", migrationUser, name, dstNamespace, migrationPort, migrationModule)
+	return batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name + "-client",
+			Namespace: namespace,
+			Labels: map[string]string{
+				ManagedLabel: "true",
+			},
+		},
+		Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					// Admitted to the rsync daemon by the NetworkPolicy
+					Labels: map[string]string{
+						MigrationLabel: name,
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:    "sync",
+							Image:   image,
+							Command: []string{"rsync", "-avhWHAX", "--no-compress", "--progress", "--password-file=/etc/rsync/password", "/src/", target},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									MountPath: "/src",
+									Name:      "src",
+								},
+								{
+									MountPath: "/etc/rsync",
+									Name:      "password",
+									ReadOnly:  true,
+								},
+							},
+						},
+					},
+					RestartPolicy:      corev1.RestartPolicyOnFailure,
+					ServiceAccountName: saname,
+					Volumes: []corev1.Volume{
+						{
+							Name: "src",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: src,
+								},
+							},
+						},
+						{
+							Name: "password",
+							VolumeSource: corev1.VolumeSource{
+								Secret: &corev1.SecretVolumeSource{
+									SecretName:  name,
+									DefaultMode: &mode,
+									Items: []corev1.KeyToPath{
+										{Key: "password", Path: "password"},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
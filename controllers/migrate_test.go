@@ -0,0 +1,164 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+func TestMigratePVC(t *testing.T) {
+	ctx := context.WithValue(context.Background(), RbacObjCtxKey, RbacObjects{})
+	require := require.New(t)
+	assert := assert.New(t)
+
+	source := corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data-web-0", Namespace: "old"},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1G")},
+			},
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(&source, newTargetNamespace("new", "other, old")).Build()
+	r := StatefulSetReconciler{Client: c, Recorder: record.NewFakeRecorder(10), SyncContainerImage: "rsync"}
+
+	pi := pvc.NewEntity(source, resource.MustParse("2G"), nil)
+	pi.TargetNamespace = "new"
+
+	pi, done, err := r.backupPVC(ctx, pi)
+	require.NoError(err)
+	assert.False(done)
+
+	migrated := corev1.PersistentVolumeClaim{}
+	require.NoError(c.Get(ctx, client.ObjectKey{Name: "data-web-0", Namespace: "new"}, &migrated))
+	assert.Equal("2G", migrated.Spec.Resources.Requests.Storage().String())
+
+	name := newMigrationName("data-web-0")
+	dstSecret := corev1.Secret{}
+	require.NoError(c.Get(ctx, client.ObjectKey{Name: name, Namespace: "new"}, &dstSecret))
+	srcSecret := corev1.Secret{}
+	require.NoError(c.Get(ctx, client.ObjectKey{Name: name, Namespace: "old"}, &srcSecret))
+	assert.NotEmpty(dstSecret.Data["password"])
+	assert.Equal(dstSecret.Data, srcSecret.Data, "password shared across namespaces")
+	require.NoError(c.Get(ctx, client.ObjectKey{Name: name, Namespace: "new"}, &corev1.Service{}))
+	require.NoError(c.Get(ctx, client.ObjectKey{Name: name + "-server", Namespace: "new"}, &batchv1.Job{}))
+	netpol := networkingv1.NetworkPolicy{}
+	require.NoError(c.Get(ctx, client.ObjectKey{Name: name, Namespace: "new"}, &netpol))
+	assert.Equal(map[string]string{MigrationLabel: name}, netpol.Spec.PodSelector.MatchLabels)
+	require.Len(netpol.Spec.Ingress, 1)
+	assert.Equal(map[string]string{corev1.LabelMetadataName: "old"}, netpol.Spec.Ingress[0].From[0].NamespaceSelector.MatchLabels, "only admits the source namespace")
+
+	job := batchv1.Job{}
+	require.NoError(c.Get(ctx, client.ObjectKey{Name: name + "-client", Namespace: "old"}, &job))
+	assert.Contains(job.Spec.Template.Spec.Containers[0].Command, "rsync://sync@"+name+".new.svc:873/data/")
+	assert.Equal(name, job.Spec.Template.Labels[MigrationLabel], "admitted by the NetworkPolicy")
+
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	require.NoError(c.Status().Update(ctx, &job))
+
+	pi, done, err = r.backupPVC(ctx, pi)
+	require.NoError(err)
+	assert.True(done)
+	assert.True(pi.BackedUp)
+	for _, obj := range []client.Object{
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: name + "-client", Namespace: "old"}},
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: name + "-server", Namespace: "new"}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "new"}},
+		&networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "new"}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "new"}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "old"}},
+	} {
+		err := c.Get(ctx, client.ObjectKeyFromObject(obj), obj)
+		assert.True(apierrors.IsNotFound(err), "%T %s removed", obj, obj.GetName())
+	}
+
+	pi, done, err = r.restorePVC(ctx, pi)
+	require.NoError(err)
+	assert.True(done)
+	require.NoError(c.Get(ctx, client.ObjectKeyFromObject(&source), &corev1.PersistentVolumeClaim{}), "source is kept")
+}
+
+func TestMigratePVCExisting(t *testing.T) {
+	ctx := context.WithValue(context.Background(), RbacObjCtxKey, RbacObjects{})
+
+	existing := corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data-web-0", Namespace: "new"},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(&existing, newTargetNamespace("new", "old")).Build()
+	r := StatefulSetReconciler{Client: c, Recorder: record.NewFakeRecorder(10)}
+
+	pi := pvc.NewEntity(corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data-web-0", Namespace: "old"},
+	}, resource.MustParse("1G"), nil)
+	pi.TargetNamespace = "new"
+
+	_, _, err := r.backupPVC(ctx, pi)
+	assert.Error(t, err)
+	assert.NotNil(t, isCritical(err), "never overwrite foreign PVCs")
+	assert.Contains(t, err.Error(), "already exists")
+}
+
+func newTargetNamespace(name, sources string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        name,
+		Annotations: map[string]string{MigrationSourcesAnnotation: sources},
+	}}
+}
+
+func TestMigrationNotAccepted(t *testing.T) {
+	ctx := context.WithValue(context.Background(), RbacObjCtxKey, RbacObjects{})
+	tcs := map[string]*corev1.Namespace{
+		"not annotated":     {ObjectMeta: metav1.ObjectMeta{Name: "kube-system"}},
+		"other source":      newTargetNamespace("kube-system", "other,old-2"),
+		"missing namespace": nil,
+	}
+	for k, ns := range tcs {
+		t.Run(k, func(t *testing.T) {
+			sts := newFaultStatefulSet()
+			sts.Annotations = map[string]string{statefulset.MigrateToAnnotation: "kube-system"}
+			b := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(sts)
+			if ns != nil {
+				b = b.WithObjects(ns)
+			}
+			c := b.Build()
+			recorder := record.NewFakeRecorder(10)
+			r := StatefulSetReconciler{Client: c, Recorder: recorder, RequeueAfter: time.Second}
+
+			found := &appsv1.StatefulSet{}
+			require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(sts), found))
+			si, err := statefulset.NewEntity(found)
+			require.NoError(t, err)
+			_, hold, err := r.holdForMigration(ctx, si, time.Now())
+			require.NoError(t, err)
+			assert.True(t, hold, "migration held back")
+			require.Len(t, recorder.Events, 1)
+			assert.Contains(t, <-recorder.Events, "Warning MigrationBlocked Not migrating, namespace kube-system does not accept migrations from namespace foo")
+
+			// A plan pointing to the namespace is rejected as well
+			pi := pvc.NewEntity(*newFaultPVC("data-web-0", "zero"), resource.MustParse("2G"), nil)
+			pi.TargetNamespace = "kube-system"
+			_, _, err = r.backupPVC(ctx, pi)
+			assert.NotNil(t, isCritical(err))
+			pvcs := corev1.PersistentVolumeClaimList{}
+			require.NoError(t, c.List(ctx, &pvcs, client.InNamespace("kube-system")))
+			assert.Empty(t, pvcs.Items, "nothing created in the target namespace")
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+// holdForDisruptionBudget checks whether scaling down the StatefulSet would violate a PodDisruptionBudget.
+// It returns true and the result to return from the reconcile loop if the resize has to be held back.
+func (r *StatefulSetReconciler) holdForDisruptionBudget(ctx context.Context, sts *statefulset.Entity, now time.Time) (ctrl.Result, bool, error) {
+	if sts.IgnoreDisruptionBudgets() {
+		return ctrl.Result{}, false, nil
+	}
+	pdbs := policyv1.PodDisruptionBudgetList{}
+	if err := r.List(ctx, &pdbs, client.InNamespace(sts.Old.Namespace)); err != nil {
+		return ctrl.Result{}, false, err
+	}
+
+	replicas := int32(1)
+	if sts.Old.Spec.Replicas != nil {
+		replicas = *sts.Old.Spec.Replicas
+	}
+	podLabels := labels.Set(sts.Old.Spec.Template.Labels)
+
+	violated := []string{}
+	for _, pdb := range pdbs.Items {
+		selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		if err != nil || !selector.Matches(podLabels) {
+			continue
+		}
+		if blocksScaleDown(pdb, replicas) {
+			violated = append(violated, pdb.Name)
+		}
+	}
+	if len(violated) == 0 {
+		return ctrl.Result{}, false, nil
+	}
+
+	log.FromContext(ctx).V(1).Info("Scaling down would violate PodDisruptionBudgets", "pdbs", violated)
+	return r.holdBlocked(ctx, sts, "DisruptionBudget", "ResizeBlocked",
+		fmt.Sprintf("Not resizing, scaling down would violate PodDisruptionBudget %s. Set annotation %s=true to resize anyway",
+			strings.Join(violated, ", "), statefulset.IgnoreDisruptionBudgetsAnnotation), now)
+}
+
+// blocksScaleDown returns whether the PodDisruptionBudget forbids having none of the replicas available
+func blocksScaleDown(pdb policyv1.PodDisruptionBudget, replicas int32) bool {
+	if replicas == 0 {
+		return false
+	}
+	if pdb.Spec.MinAvailable != nil {
+		minAvailable, err := intstr.GetScaledValueFromIntOrPercent(pdb.Spec.MinAvailable, int(replicas), true)
+		return err != nil || minAvailable > 0
+	}
+	if pdb.Spec.MaxUnavailable != nil {
+		maxUnavailable, err := intstr.GetScaledValueFromIntOrPercent(pdb.Spec.MaxUnavailable, int(replicas), true)
+		return err != nil || maxUnavailable < int(replicas)
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+func TestBlocksScaleDown(t *testing.T) {
+	intOrStr := func(v intstr.IntOrString) *intstr.IntOrString {
+		return &v
+	}
+	tcs := map[string]struct {
+		minAvailable   *intstr.IntOrString
+		maxUnavailable *intstr.IntOrString
+		replicas       int32
+		blocks         bool
+	}{
+		"min available": {
+			minAvailable: intOrStr(intstr.FromInt(1)),
+			replicas:     3,
+			blocks:       true,
+		},
+		"min available zero": {
+			minAvailable: intOrStr(intstr.FromInt(0)),
+			replicas:     3,
+			blocks:       false,
+		},
+		"min available percent": {
+			minAvailable: intOrStr(intstr.FromString("10%")),
+			replicas:     3,
+			blocks:       true,
+		},
+		"max unavailable": {
+			maxUnavailable: intOrStr(intstr.FromInt(1)),
+			replicas:       3,
+			blocks:         true,
+		},
+		"max unavailable all": {
+			maxUnavailable: intOrStr(intstr.FromInt(3)),
+			replicas:       3,
+			blocks:         false,
+		},
+		"max unavailable 100 percent": {
+			maxUnavailable: intOrStr(intstr.FromString("100%")),
+			replicas:       3,
+			blocks:         false,
+		},
+		"already scaled to zero": {
+			minAvailable: intOrStr(intstr.FromInt(1)),
+			replicas:     0,
+			blocks:       false,
+		},
+		"invalid percent": {
+			minAvailable: intOrStr(intstr.FromString("lots")),
+			replicas:     3,
+			blocks:       true,
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			pdb := policyv1.PodDisruptionBudget{
+				Spec: policyv1.PodDisruptionBudgetSpec{
+					MinAvailable:   tc.minAvailable,
+					MaxUnavailable: tc.maxUnavailable,
+				},
+			}
+			assert.Equal(t, tc.blocks, blocksScaleDown(pdb, tc.replicas))
+		})
+	}
+}
+
+func TestHoldForDisruptionBudgetEvents(t *testing.T) {
+	ctx := context.Background()
+	newPDB := func(name string) *policyv1.PodDisruptionBudget {
+		minAvailable := intstr.FromInt(1)
+		return &policyv1.PodDisruptionBudget{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "foo"},
+			Spec: policyv1.PodDisruptionBudgetSpec{
+				MinAvailable: &minAvailable,
+				Selector:     &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			},
+		}
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(newFaultStatefulSet(), newPDB("web")).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := StatefulSetReconciler{Client: c, Recorder: recorder, RequeueAfter: 10 * time.Second}
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	hold := func(now time.Time) (time.Duration, bool) {
+		sts := &appsv1.StatefulSet{}
+		require.NoError(t, c.Get(ctx, client.ObjectKey{Name: "web", Namespace: "foo"}, sts))
+		si, err := statefulset.NewEntity(sts)
+		require.NoError(t, err)
+		res, held, err := r.holdForDisruptionBudget(ctx, si, now)
+		require.NoError(t, err)
+		return res.RequeueAfter, held
+	}
+
+	requeue, held := hold(start)
+	assert.True(t, held)
+	assert.Equal(t, 10*time.Second, requeue)
+	assert.Len(t, recorder.Events, 1)
+
+	requeue, held = hold(start.Add(time.Minute))
+	assert.True(t, held)
+	assert.Equal(t, time.Minute, requeue, "backs off")
+	requeue, _ = hold(start.Add(time.Hour))
+	assert.Equal(t, maxBlockedRequeue, requeue)
+	assert.Len(t, recorder.Events, 1, "no event while the blocking PodDisruptionBudgets stay the same")
+
+	require.NoError(t, c.Create(ctx, newPDB("web-2")))
+	_, held = hold(start.Add(2 * time.Hour))
+	assert.True(t, held)
+	assert.Len(t, recorder.Events, 2, "event when the blocking PodDisruptionBudgets change")
+
+	require.NoError(t, c.DeleteAllOf(ctx, &policyv1.PodDisruptionBudget{}, client.InNamespace("foo")))
+	_, held = hold(start.Add(3 * time.Hour))
+	assert.False(t, held)
+}
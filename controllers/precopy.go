@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/vshn/statefulset-resize-controller/naming"
+	"github.com/vshn/statefulset-resize-controller/pvc"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+// precopyPVCs copies all PVCs to their backups while the StatefulSet is still running.
+// After scaling down, the backup only needs to catch up with the changes since then.
+// It returns true if all PVCs are pre-copied.
+func (r *StatefulSetReconciler) precopyPVCs(ctx context.Context, sts *statefulset.Entity) (bool, error) {
+	objs, err := r.createRbacObjs(ctx, sts)
+	if err != nil {
+		return false, err
+	}
+	ctx = context.WithValue(ctx, RbacObjCtxKey, objs)
+
+	allDone := true
+	for i, pi := range sts.Pvcs {
+		pi, done, err := r.precopyPVC(ctx, pi)
+		if err != nil {
+			if errors.As(err, &CriticalError{}) {
+				err = CriticalError{
+					Err:   err,
+					Event: fmt.Sprintf("Failed to pre-copy PVC %s", pi.SourceName),
+				}
+			}
+			return false, err
+		}
+		allDone = allDone && done
+		sts.Pvcs[i] = pi
+	}
+	return allDone, nil
+}
+
+// precopyPVC copies the PVC to its backup while it is in use.
+// PVCs that can be mounted by multiple pods are copied directly.
+// All other PVCs are cloned first, which requires a CSI driver supporting volume cloning.
+func (r *StatefulSetReconciler) precopyPVC(ctx context.Context, pi pvc.Entity) (pvc.Entity, bool, error) {
+	if pi.PreCopied || pi.Discard || pi.TargetNamespace != "" {
+		return pi, true, nil
+	}
+	dst, dstName := pi.GetBackup(), pi.BackupName()
+	if pi.Rebind {
+		dst, dstName = pi.GetTarget(), pi.TargetName()
+	}
+	if err := r.getOrCreate(ctx, dst); err != nil {
+		return pi, false, err
+	}
+
+	src := pi.SourceName
+	if !pi.SharedAccess() {
+		if err := r.getOrCreate(ctx, pi.GetClone()); err != nil {
+			return pi, false, err
+		}
+		src = pi.CloneName()
+	}
+
+	saname, err := r.syncServiceAccount(ctx)
+	if err != nil {
+		return pi, false, err
+	}
+	job, _, err := r.getOrCreateJob(ctx, newPrecopyJob(pi.Namespace, r.SyncContainerImage, saname, src, dstName))
+	if err != nil {
+		return pi, false, err
+	}
+	done, err := isJobDone(job)
+	if err != nil || !done {
+		return pi, done, err
+	}
+
+	pol := metav1.DeletePropagationForeground
+	if err := r.Client.Delete(ctx, &job, &client.DeleteOptions{PropagationPolicy: &pol}); client.IgnoreNotFound(err) != nil {
+		return pi, false, err
+	}
+	if !pi.SharedAccess() {
+		if err := r.Client.Delete(ctx, pi.GetClone()); client.IgnoreNotFound(err) != nil {
+			return pi, false, err
+		}
+	}
+	pi.PreCopied = true
+	return pi, true, nil
+}
+
+// keepPrecopied carries over the progress of the pre-copy from the previous plan to the current PVCs
+func keepPrecopied(planned, current []pvc.Entity) []pvc.Entity {
+	for i, pi := range current {
+		for _, p := range planned {
+			if p.PreCopied && p.SourceName == pi.SourceName && p.BackupName() == pi.BackupName() {
+				current[i].PreCopied = true
+			}
+		}
+	}
+	return current
+}
+
+func newPrecopyJobName(src, dst string) string {
+	maxNameLength := 25
+	// The ignored errors are impossible
+	src, _ = naming.ShortenName(src, maxNameLength)
+	dst, _ = naming.ShortenName(dst, maxNameLength)
+	return strings.ToLower(fmt.Sprintf("precopy-%s-to-%s", src, dst))
+}
+
+func newPrecopyJob(namespace, image, saname, src, dst string) batchv1.Job {
+	job := newJob(namespace, image, saname, src, dst)
+	job.Name = newPrecopyJobName(src, dst)
+	for _, v := range job.Spec.Template.Spec.Volumes {
+		if v.Name == "src" {
+			v.PersistentVolumeClaim.ReadOnly = true
+		}
+	}
+	for i, m := range job.Spec.Template.Spec.Containers[0].VolumeMounts {
+		if m.Name == "src" {
+			job.Spec.Template.Spec.Containers[0].VolumeMounts[i].ReadOnly = true
+		}
+	}
+	return job
+}
@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
+)
+
+func TestPrecopyPVC(t *testing.T) {
+	tcs := map[string]struct {
+		accessMode corev1.PersistentVolumeAccessMode
+		clone      bool
+	}{
+		"shared access": {
+			accessMode: corev1.ReadWriteMany,
+			clone:      false,
+		},
+		"exclusive access": {
+			accessMode: corev1.ReadWriteOnce,
+			clone:      true,
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), RbacObjCtxKey, RbacObjects{})
+			require := require.New(t)
+			assert := assert.New(t)
+
+			source := corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "data-web-0", Namespace: "foo"},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					AccessModes: []corev1.PersistentVolumeAccessMode{tc.accessMode},
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1G")},
+					},
+				},
+			}
+			c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(&source).Build()
+			r := StatefulSetReconciler{Client: c, Recorder: record.NewFakeRecorder(10), SyncContainerImage: "rsync"}
+			pi := pvc.NewEntity(source, resource.MustParse("2G"), nil)
+
+			pi, done, err := r.precopyPVC(ctx, pi)
+			require.NoError(err)
+			assert.False(done)
+			require.NoError(c.Get(ctx, client.ObjectKey{Name: pi.BackupName(), Namespace: "foo"}, &corev1.PersistentVolumeClaim{}))
+
+			src := pi.SourceName
+			clone := corev1.PersistentVolumeClaim{}
+			err = c.Get(ctx, client.ObjectKey{Name: pi.CloneName(), Namespace: "foo"}, &clone)
+			if tc.clone {
+				require.NoError(err)
+				require.NotNil(clone.Spec.DataSource)
+				assert.Equal(pi.SourceName, clone.Spec.DataSource.Name)
+				src = pi.CloneName()
+			} else {
+				assert.True(apierrors.IsNotFound(err))
+			}
+
+			job := batchv1.Job{}
+			require.NoError(c.Get(ctx, client.ObjectKey{Name: newPrecopyJobName(src, pi.BackupName()), Namespace: "foo"}, &job))
+			assert.Equal(src, job.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim.ClaimName)
+			assert.True(job.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim.ReadOnly)
+
+			job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+			require.NoError(c.Status().Update(ctx, &job))
+
+			pi, done, err = r.precopyPVC(ctx, pi)
+			require.NoError(err)
+			assert.True(done)
+			assert.True(pi.PreCopied)
+			err = c.Get(ctx, client.ObjectKey{Name: pi.CloneName(), Namespace: "foo"}, &corev1.PersistentVolumeClaim{})
+			assert.True(apierrors.IsNotFound(err), "clone removed")
+			err = c.Get(ctx, client.ObjectKeyFromObject(&job), &batchv1.Job{})
+			assert.True(apierrors.IsNotFound(err), "job removed")
+		})
+	}
+}
+
+func TestKeepPrecopied(t *testing.T) {
+	newEntity := func(name, size string, precopied bool) pvc.Entity {
+		pi := pvc.NewEntity(corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "foo"},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(size)},
+				},
+			},
+		}, resource.MustParse("10G"), nil)
+		pi.PreCopied = precopied
+		return pi
+	}
+	planned := []pvc.Entity{
+		newEntity("data-web-0", "1G", true),
+		newEntity("data-web-1", "1G", true),
+	}
+	current := []pvc.Entity{
+		newEntity("data-web-0", "1G", false),
+		newEntity("data-web-1", "2G", false),
+		newEntity("data-web-2", "1G", false),
+	}
+	res := keepPrecopied(planned, current)
+	assert.True(t, res[0].PreCopied)
+	assert.False(t, res[1].PreCopied, "source changed")
+	assert.False(t, res[2].PreCopied, "new PVC")
+}
@@ -4,107 +4,200 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"strconv"
-	"strings"
 
 	"github.com/vshn/statefulset-resize-controller/pvc"
 	"github.com/vshn/statefulset-resize-controller/statefulset"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 // getResizablePVCs fetches the information of all PVCs that are smaller than the request of the statefulset
-func fetchResizablePVCs(ctx context.Context, cl client.Client, si statefulset.Entity) ([]pvc.Entity, error) {
+func fetchResizablePVCs(ctx context.Context, cl client.Client, si statefulset.Entity, policy statefulset.OutOfRangePolicy) ([]pvc.Entity, error) {
 	// NOTE(glrf) This will get _all_ PVCs that belonged to the sts. Even the ones not used anymore (i.e. if scaled up and down).
+	// These are handled according to the out of range policy.
 	sts, err := si.StatefulSet()
 	if err != nil {
 		return nil, err
 	}
+	// We do not filter by the selector of the StatefulSet, the labels of the PVCs might have drifted.
 	pvcs := corev1.PersistentVolumeClaimList{}
-	if err := cl.List(ctx, &pvcs, client.InNamespace(sts.Namespace), client.MatchingLabels(sts.Spec.Selector.MatchLabels)); err != nil {
+	if err := cl.List(ctx, &pvcs, client.InNamespace(sts.Namespace)); err != nil {
 		return nil, err
 	}
-	pis := filterResizablePVCs(ctx, *sts, pvcs.Items)
+	others, err := listStatefulSets(ctx, cl, sts.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	pis := filterResizablePVCs(ctx, si, others, pvcs.Items, policy)
 	return pis, nil
 }
 
-// filterResizablePVCs filters out the PVCs that do not match the request of the statefulset
-func filterResizablePVCs(ctx context.Context, sts appsv1.StatefulSet, pvcs []corev1.PersistentVolumeClaim) []pvc.Entity {
+// filterResizablePVCs filters out the PVCs that do not belong to the statefulset or match its request.
+// The request is either the size set in the template or the target size set through the annotations of the statefulset.
+// PVCs of ordinals outside the replicas of the StatefulSet are resized, skipped, or marked to be discarded according to the policy.
+func filterResizablePVCs(ctx context.Context, si statefulset.Entity, others []appsv1.StatefulSet, pvcs []corev1.PersistentVolumeClaim, policy statefulset.OutOfRangePolicy) []pvc.Entity {
 	var res []pvc.Entity
+	sts := *si.Old
+	policy = outOfRangePolicy(ctx, si, policy)
 
 	for _, p := range pvcs {
-		if p.Namespace != sts.Namespace {
+		tpl, ordinal, ok := matchPVC(ctx, sts, others, p)
+		if !ok {
 			continue
 		}
-		for _, tpl := range sts.Spec.VolumeClaimTemplates {
-			if isPVCTooSmall(ctx, p, tpl, sts.Name) {
-				res = append(res, pvc.NewEntity(p, tpl.Spec.Resources.Requests[corev1.ResourceStorage], tpl.Spec.StorageClassName))
-				break
+		size, err := statefulset.TargetSize(sts, tpl)
+		if err != nil {
+			log.FromContext(ctx).Info("Ignoring target size", "Template", tpl.Name, "error", err)
+		}
+		if !isGreaterStorageRequest(p, size) {
+			continue
+		}
+		pi := pvc.NewEntity(p, size, tpl.Spec.StorageClassName)
+		if !si.InRange(ordinal) {
+			if policy == statefulset.OutOfRangeSkip {
+				continue
 			}
+			pi.Discard = policy == statefulset.OutOfRangeDelete
 		}
+		res = append(res, pi)
 	}
 	return res
 }
 
-func isPVCTooSmall(ctx context.Context, p, tpl corev1.PersistentVolumeClaim, stsName string) bool {
-	//TODO Test this separately
-	// StS managed PVCs are created according to the VolumeClaimTemplate.
-	// The name of the resulting PVC will be in the following format:
-	// <template.name>-<sts.name>-<ordinal-number>
-	// This allows us to match the pvcs to the template.
-
-	// Very spammy but could help in error cases
-	l := log.FromContext(ctx).WithValues("Namespace", p.Namespace, "Pvc", p.Name, "StatefulSet", stsName, "Template", tpl.Name).V(2)
-	if !strings.HasPrefix(p.Name, tpl.Name) {
-		l.Info("pvc does not match the template")
-		return false
+// fetchMigratablePVCs fetches the information of all PVCs of the statefulset, to be migrated to the namespace.
+func fetchMigratablePVCs(ctx context.Context, cl client.Client, si statefulset.Entity, namespace string, policy statefulset.OutOfRangePolicy) ([]pvc.Entity, error) {
+	pvcs := corev1.PersistentVolumeClaimList{}
+	if err := cl.List(ctx, &pvcs, client.InNamespace(si.Old.Namespace)); err != nil {
+		return nil, err
 	}
-	n := strings.TrimPrefix(p.Name, fmt.Sprintf("%s-", tpl.Name))
-	if !strings.HasPrefix(n, stsName) {
-		l.Info("pvc does not match the StatefulSet")
-		return false
+	others, err := listStatefulSets(ctx, cl, si.Old.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	return filterMigratablePVCs(ctx, si, others, pvcs.Items, namespace, policy), nil
+}
+
+// filterMigratablePVCs returns all PVCs that belong to the statefulset, to be migrated to the namespace.
+// The migrated PVCs are at least as large as requested by the statefulset.
+// PVCs of ordinals outside the replicas of the StatefulSet are only migrated with the resize policy, we never delete anything while migrating.
+func filterMigratablePVCs(ctx context.Context, si statefulset.Entity, others []appsv1.StatefulSet, pvcs []corev1.PersistentVolumeClaim, namespace string, policy statefulset.OutOfRangePolicy) []pvc.Entity {
+	var res []pvc.Entity
+	sts := *si.Old
+	policy = outOfRangePolicy(ctx, si, policy)
+
+	for _, p := range pvcs {
+		tpl, ordinal, ok := matchPVC(ctx, sts, others, p)
+		if !ok {
+			continue
+		}
+		if !si.InRange(ordinal) && policy != statefulset.OutOfRangeResize {
+			continue
+		}
+		size, err := statefulset.TargetSize(sts, tpl)
+		if err != nil {
+			log.FromContext(ctx).Info("Ignoring target size", "Template", tpl.Name, "error", err)
+		}
+		if !isGreaterStorageRequest(p, size) {
+			size = p.Spec.Resources.Requests[corev1.ResourceStorage]
+		}
+		pi := pvc.NewEntity(p, size, tpl.Spec.StorageClassName)
+		pi.TargetNamespace = namespace
+		res = append(res, pi)
 	}
+	return res
+}
 
-	n = strings.TrimPrefix(n, fmt.Sprintf("%s-", stsName))
-	if _, err := strconv.Atoi(n); err != nil {
-		l.Info("pvc does not end in a number")
-		return false
+func outOfRangePolicy(ctx context.Context, si statefulset.Entity, def statefulset.OutOfRangePolicy) statefulset.OutOfRangePolicy {
+	p, err := si.OutOfRangePolicy(def)
+	if err != nil {
+		log.FromContext(ctx).Info("Ignoring out of range policy", "error", err)
+		return def
 	}
-	return isGreaterStorageRequest(p, tpl)
+	return p
 }
 
-func isGreaterStorageRequest(p, tpl corev1.PersistentVolumeClaim) bool {
+func isGreaterStorageRequest(p corev1.PersistentVolumeClaim, size resource.Quantity) bool {
 	q := p.Spec.Resources.Requests[corev1.ResourceStorage]
-	return q.Cmp(tpl.Spec.Resources.Requests[corev1.ResourceStorage]) < 0 // Returns -1 if q < requested size
+	return q.Cmp(size) < 0 // Returns -1 if q < requested size
 }
 
-func (r *StatefulSetReconciler) resizePVC(ctx context.Context, pi pvc.Entity) (pvc.Entity, bool, error) {
-	pi, done, err := r.backupPVC(ctx, pi)
-	if err != nil || !done {
-		if errors.As(err, &CriticalError{}) {
-			err = CriticalError{
-				Err:           err,
-				Event:         fmt.Sprintf("Failed to backup PVC %s", pi.SourceName),
-				SaveToScaleUp: true,
+// backupPVCs backs up all PVCs.
+// It returns the updated PVCs and whether all of them are backed up.
+// A PVC is only backed up once the intent to do so is recorded.
+func (r *StatefulSetReconciler) backupPVCs(ctx context.Context, oldPIs []pvc.Entity) ([]pvc.Entity, bool, error) {
+	pis := make([]pvc.Entity, 0, len(oldPIs))
+	allDone := true
+	for i, pi := range oldPIs {
+		if !pi.BackedUp && pi.Intent != pvc.StepBackup {
+			// The intent is recorded before the backup starts
+			pi.Intent = pvc.StepBackup
+			allDone = false
+			pis = append(pis, pi)
+			continue
+		}
+		if !pi.BackedUp && !pi.Discard {
+			// Backing up a PVC that was already replaced would overwrite its backup
+			intact, err := r.sourceIntact(ctx, pi)
+			if err == nil && !intact {
+				err = CriticalError{
+					Err:   fmt.Errorf("PVC %s was replaced before its backup completed", pi.SourceName),
+					Event: fmt.Sprintf("PVC %s was replaced before its backup completed. Kept its backup %s", pi.SourceName, pi.BackupName()),
+				}
+			}
+			if err != nil {
+				pis = append(pis, oldPIs[i:]...)
+				return pis, false, err
 			}
 		}
-		return pi, done, err
+		pi, done, err := r.backupPVC(ctx, pi)
+		if err != nil {
+			if errors.As(err, &CriticalError{}) {
+				err = CriticalError{
+					Err:           err,
+					Event:         fmt.Sprintf("Failed to backup PVC %s", pi.SourceName),
+					SaveToScaleUp: true,
+				}
+			}
+			pis = append(pis, oldPIs[i:]...)
+			return pis, false, err
+		}
+		if pi.BackedUp && !oldPIs[i].BackedUp && !pi.Discard {
+			src := pi.SourceSize()
+			r.event(ctx, "BackupCompleted", "Backed up PVC %s (%s)", pi.SourceName, src.String())
+		}
+		allDone = allDone && done
+		pis = append(pis, pi)
 	}
-	return r.restorePVC(ctx, pi)
+	return pis, allDone, nil
 }
 
-func (r *StatefulSetReconciler) resizePVCs(ctx context.Context, oldPIs []pvc.Entity) ([]pvc.Entity, error) {
+// restorePVCs recreates and restores all PVCs.
+// It returns the PVCs that are not yet restored.
+// A PVC is only replaced once the intent to do so is recorded, which requires that its backup is recorded as well.
+func (r *StatefulSetReconciler) restorePVCs(ctx context.Context, oldPIs []pvc.Entity) ([]pvc.Entity, error) {
 	pis := []pvc.Entity{}
 	for i, pi := range oldPIs {
-		pi, done, err := r.resizePVC(ctx, pi)
+		if !pi.Restored && pi.Intent != pvc.StepRestore {
+			// The intent is recorded before the original PVC is touched
+			pi.Intent = pvc.StepRestore
+			pis = append(pis, pi)
+			continue
+		}
+		pi, done, err := r.restorePVC(ctx, pi)
 		if err != nil {
 			pis = append(pis, oldPIs[i:]...)
 			return pis, err
 		}
 		if !done {
 			pis = append(pis, pi)
+			continue
+		}
+		if !oldPIs[i].Restored && !pi.Discard && pi.TargetNamespace == "" {
+			src := pi.SourceSize()
+			r.event(ctx, "RestoreCompleted", "Restored PVC %s, resized from %s to %s", pi.SourceName, src.String(), pi.TargetSize.String())
 		}
 	}
 	return pis, nil
@@ -119,6 +212,7 @@ func resizePVCsInplace(ctx context.Context, cl client.Client, PVCs []pvc.Entity)
 		resizedPVC := pvc.GetResizedSource()
 		resizedPVC.Spec.StorageClassName = pvc.SourceStorageClass
 		resizedPVC.Spec.VolumeName = pvc.Spec.VolumeName
+		resizedPVC.OwnerReferences = pvc.OwnerReferences
 
 		err := cl.Update(ctx, resizedPVC)
 		if err != nil {
@@ -10,6 +10,9 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+
+	"github.com/vshn/statefulset-resize-controller/statefulset"
 )
 
 func TestFilterResizablePVCs(t *testing.T) {
@@ -18,9 +21,11 @@ func TestFilterResizablePVCs(t *testing.T) {
 		size string
 	}
 	type stsIn struct {
-		name      string
-		namespace string
-		templates []tmpl
+		name        string
+		namespace   string
+		templates   []tmpl
+		annotations map[string]string
+		replicas    *int32
 	}
 	type pvcIn struct {
 		name      string
@@ -35,9 +40,11 @@ func TestFilterResizablePVCs(t *testing.T) {
 		}
 	}
 	type tCase struct {
-		sts  stsIn
-		pvcs []pvcIn
-		out  map[string]string
+		sts     stsIn
+		pvcs    []pvcIn
+		policy  statefulset.OutOfRangePolicy
+		out     map[string]string
+		discard map[string]bool
 	}
 
 	tcs := map[string]tCase{
@@ -150,6 +157,34 @@ func TestFilterResizablePVCs(t *testing.T) {
 				"foo:data-test-1": "10G",
 			},
 		},
+		"uses target size annotations": {
+			sts: stsIn{
+				name:      "test",
+				namespace: "foo",
+				templates: []tmpl{
+					{
+						name: "data",
+						size: "1G",
+					},
+					{
+						name: "log",
+						size: "1G",
+					},
+				},
+				annotations: map[string]string{
+					"sts-resize.vshn.net/target-size":     "10G",
+					"sts-resize.vshn.net/target-size.log": "5G",
+				},
+			},
+			pvcs: []pvcIn{
+				newPVCIn("data-test-0", "foo", "1G"),
+				newPVCIn("log-test-0", "foo", "1G"),
+			},
+			out: map[string]string{
+				"foo:data-test-0": "10G",
+				"foo:log-test-0":  "5G",
+			},
+		},
 		"filters out unrelated PVCs": {
 			sts: stsIn{
 				name:      "test",
@@ -175,6 +210,93 @@ func TestFilterResizablePVCs(t *testing.T) {
 				"foo:data-test-1": "10G",
 			},
 		},
+		"resizes out of range PVCs": {
+			sts: stsIn{
+				name:      "test",
+				namespace: "foo",
+				replicas:  pointer.Int32(1),
+				templates: []tmpl{{name: "data", size: "10G"}},
+			},
+			pvcs: []pvcIn{
+				newPVCIn("data-test-0", "foo", "1G"),
+				newPVCIn("data-test-1", "foo", "1G"),
+			},
+			policy: statefulset.OutOfRangeResize,
+			out: map[string]string{
+				"foo:data-test-0": "10G",
+				"foo:data-test-1": "10G",
+			},
+		},
+		"skips out of range PVCs": {
+			sts: stsIn{
+				name:      "test",
+				namespace: "foo",
+				replicas:  pointer.Int32(1),
+				templates: []tmpl{{name: "data", size: "10G"}},
+			},
+			pvcs: []pvcIn{
+				newPVCIn("data-test-0", "foo", "1G"),
+				newPVCIn("data-test-1", "foo", "1G"),
+			},
+			policy: statefulset.OutOfRangeSkip,
+			out: map[string]string{
+				"foo:data-test-0": "10G",
+			},
+		},
+		"discards out of range PVCs": {
+			sts: stsIn{
+				name:      "test",
+				namespace: "foo",
+				replicas:  pointer.Int32(2),
+				templates: []tmpl{{name: "data", size: "10G"}},
+			},
+			pvcs: []pvcIn{
+				newPVCIn("data-test-0", "foo", "1G"),
+				newPVCIn("data-test-1", "foo", "1G"),
+				newPVCIn("data-test-2", "foo", "1G"),
+			},
+			policy: statefulset.OutOfRangeDelete,
+			out: map[string]string{
+				"foo:data-test-0": "10G",
+				"foo:data-test-1": "10G",
+				"foo:data-test-2": "10G",
+			},
+			discard: map[string]bool{"data-test-2": true},
+		},
+		"scaled to zero": {
+			sts: stsIn{
+				name:      "test",
+				namespace: "foo",
+				replicas:  pointer.Int32(0),
+				templates: []tmpl{{name: "data", size: "10G"}},
+			},
+			pvcs: []pvcIn{
+				newPVCIn("data-test-0", "foo", "1G"),
+				newPVCIn("data-test-1", "foo", "1G"),
+			},
+			policy: statefulset.OutOfRangeDelete,
+			out: map[string]string{
+				"foo:data-test-0": "10G",
+				"foo:data-test-1": "10G",
+			},
+		},
+		"annotation overrides policy": {
+			sts: stsIn{
+				name:        "test",
+				namespace:   "foo",
+				replicas:    pointer.Int32(1),
+				templates:   []tmpl{{name: "data", size: "10G"}},
+				annotations: map[string]string{statefulset.OutOfRangeAnnotation: "skip"},
+			},
+			pvcs: []pvcIn{
+				newPVCIn("data-test-0", "foo", "1G"),
+				newPVCIn("data-test-1", "foo", "1G"),
+			},
+			policy: statefulset.OutOfRangeDelete,
+			out: map[string]string{
+				"foo:data-test-0": "10G",
+			},
+		},
 	}
 
 	for k, tc := range tcs {
@@ -182,9 +304,15 @@ func TestFilterResizablePVCs(t *testing.T) {
 		t.Run(k, func(t *testing.T) {
 			assert := assert.New(t)
 
+			replicas := int32(3)
+			if tc.sts.replicas != nil {
+				replicas = *tc.sts.replicas
+			}
 			sts := appsv1.StatefulSet{
-				ObjectMeta: metav1.ObjectMeta{Name: tc.sts.name, Namespace: tc.sts.namespace},
+				ObjectMeta: metav1.ObjectMeta{Name: tc.sts.name, Namespace: tc.sts.namespace, Annotations: tc.sts.annotations},
 				Spec: appsv1.StatefulSetSpec{
+					Replicas:             &replicas,
+					Selector:             &metav1.LabelSelector{MatchLabels: map[string]string{"app": tc.sts.name}},
 					VolumeClaimTemplates: []corev1.PersistentVolumeClaim{},
 				},
 			}
@@ -211,6 +339,7 @@ func TestFilterResizablePVCs(t *testing.T) {
 					ObjectMeta: metav1.ObjectMeta{
 						Name:      p.name,
 						Namespace: p.namespace,
+						Labels:    map[string]string{"app": tc.sts.name},
 					},
 					Spec: corev1.PersistentVolumeClaimSpec{
 						Resources: corev1.ResourceRequirements{
@@ -223,12 +352,15 @@ func TestFilterResizablePVCs(t *testing.T) {
 			}
 
 			ctx := context.Background()
-			rps := filterResizablePVCs(ctx, sts, pvcs)
+			si, err := statefulset.NewEntity(&sts)
+			assert.NoError(err)
+			rps := filterResizablePVCs(ctx, *si, nil, pvcs, tc.policy)
 			assert.Len(rps, len(tc.out))
 			for _, r := range rps {
 				o, ok := tc.out[fmt.Sprintf("%s:%s", r.Namespace, r.SourceName)]
 				assert.True(ok)
 				assert.Equal(r.TargetSize.String(), o)
+				assert.Equal(tc.discard[r.SourceName], r.Discard, r.SourceName)
 			}
 		})
 	}
@@ -0,0 +1,243 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+// defaultStorageClassAnnotation marks the default StorageClass of the cluster
+const defaultStorageClassAnnotation = "storageclass.kubernetes.io/is-default-class"
+
+// holdForStorage checks whether the storage quotas and capacity suffice for all PVCs the resize creates.
+// Once the StatefulSet is scaled down, running out of storage leaves it down until someone intervenes.
+// It returns true and the result to return from the reconcile loop if the resize has to be held back.
+func (r *StatefulSetReconciler) holdForStorage(ctx context.Context, sts *statefulset.Entity, now time.Time) (ctrl.Result, bool, error) {
+	if sts.IgnoreStorageCheck() {
+		return ctrl.Result{}, false, nil
+	}
+	defaultClass, err := r.defaultStorageClass(ctx)
+	if err != nil {
+		return ctrl.Result{}, false, err
+	}
+
+	created := []corev1.PersistentVolumeClaim{}
+	deleted := []corev1.PersistentVolumeClaim{}
+	for _, pi := range sts.Pvcs {
+		c, d := storageChanges(pi)
+		for _, p := range c {
+			// PVCs that already exist, such as pre-copied backups, are part of the used quota
+			err := r.Get(ctx, client.ObjectKeyFromObject(p), &corev1.PersistentVolumeClaim{})
+			if client.IgnoreNotFound(err) != nil {
+				return ctrl.Result{}, false, err
+			}
+			if err == nil {
+				continue
+			}
+			created = append(created, withStorageClass(*p, defaultClass))
+		}
+		for _, p := range d {
+			deleted = append(deleted, withStorageClass(*p, defaultClass))
+		}
+	}
+
+	violations := []string{}
+	for ns, demand := range storageDemand(created, deleted) {
+		quotas := corev1.ResourceQuotaList{}
+		if err := r.List(ctx, &quotas, client.InNamespace(ns)); err != nil {
+			return ctrl.Result{}, false, err
+		}
+		violations = append(violations, quotaViolations(demand, quotas.Items)...)
+	}
+	capacities := storagev1.CSIStorageCapacityList{}
+	if err := r.List(ctx, &capacities); err != nil {
+		return ctrl.Result{}, false, err
+	}
+	violations = append(violations, capacityViolations(created, capacities.Items)...)
+	if len(violations) == 0 {
+		return ctrl.Result{}, false, nil
+	}
+
+	log.FromContext(ctx).V(1).Info("Not enough storage to resize", "violations", violations)
+	return r.holdBlocked(ctx, sts, "InsufficientStorage", "ResizeBlocked",
+		fmt.Sprintf("Not resizing, not enough storage: %s. Set annotation %s=true to resize anyway",
+			strings.Join(violations, "; "), statefulset.IgnoreStorageCheckAnnotation), now)
+}
+
+// defaultStorageClass returns the name of the default StorageClass, or an empty string if there is none
+func (r *StatefulSetReconciler) defaultStorageClass(ctx context.Context) (string, error) {
+	classes := storagev1.StorageClassList{}
+	if err := r.List(ctx, &classes); err != nil {
+		return "", err
+	}
+	for _, sc := range classes.Items {
+		if sc.Annotations[defaultStorageClassAnnotation] == "true" {
+			return sc.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// storageChanges returns the PVCs that a resize of the PVC creates, and the ones it deletes while they still exist.
+// The backups are kept after the resize, so all of them add to the storage at its peak.
+func storageChanges(pi pvc.Entity) (created []*corev1.PersistentVolumeClaim, deleted []*corev1.PersistentVolumeClaim) {
+	switch {
+	case pi.Discard:
+		return nil, nil
+	case pi.TargetNamespace != "":
+		return []*corev1.PersistentVolumeClaim{pi.GetMigrated()}, nil
+	case pi.Rebind:
+		// The original and the new PVC exist at the same time until they are rebound
+		return []*corev1.PersistentVolumeClaim{pi.GetTarget()}, nil
+	}
+	source := &corev1.PersistentVolumeClaim{
+		ObjectMeta: pi.GetResizedSource().ObjectMeta,
+		Spec:       pi.Spec,
+	}
+	source.Spec.StorageClassName = pi.SourceStorageClass
+	return []*corev1.PersistentVolumeClaim{pi.GetBackup(), pi.GetResizedSource()}, []*corev1.PersistentVolumeClaim{source}
+}
+
+func withStorageClass(p corev1.PersistentVolumeClaim, defaultClass string) corev1.PersistentVolumeClaim {
+	if p.Spec.StorageClassName == nil {
+		p.Spec.StorageClassName = &defaultClass
+	}
+	return p
+}
+
+// storageDemand returns the additional quota resources the changes require, per namespace
+func storageDemand(created, deleted []corev1.PersistentVolumeClaim) map[string]corev1.ResourceList {
+	demand := map[string]corev1.ResourceList{}
+	add := func(p corev1.PersistentVolumeClaim, sign int64) {
+		rl, ok := demand[p.Namespace]
+		if !ok {
+			rl = corev1.ResourceList{}
+			demand[p.Namespace] = rl
+		}
+		size := p.Spec.Resources.Requests[corev1.ResourceStorage]
+		names := []corev1.ResourceName{corev1.ResourceRequestsStorage}
+		counts := []corev1.ResourceName{corev1.ResourcePersistentVolumeClaims}
+		if sc := *p.Spec.StorageClassName; sc != "" {
+			names = append(names, corev1.ResourceName(sc+".storageclass.storage.k8s.io/"+string(corev1.ResourceRequestsStorage)))
+			counts = append(counts, corev1.ResourceName(sc+".storageclass.storage.k8s.io/"+string(corev1.ResourcePersistentVolumeClaims)))
+		}
+		for _, n := range names {
+			q := rl[n]
+			if sign < 0 {
+				q.Sub(size)
+			} else {
+				q.Add(size)
+			}
+			rl[n] = q
+		}
+		for _, n := range counts {
+			q := rl[n]
+			q.Add(*resource.NewQuantity(sign, resource.DecimalSI))
+			rl[n] = q
+		}
+	}
+	for _, p := range created {
+		add(p, 1)
+	}
+	for _, p := range deleted {
+		add(p, -1)
+	}
+	return demand
+}
+
+// quotaViolations returns the quotas that do not leave room for the demand
+func quotaViolations(demand corev1.ResourceList, quotas []corev1.ResourceQuota) []string {
+	violations := []string{}
+	for _, quota := range quotas {
+		if len(quota.Spec.Scopes) > 0 || quota.Spec.ScopeSelector != nil {
+			// Scoped quotas do not apply to PVCs
+			continue
+		}
+		names := make([]string, 0, len(demand))
+		for n := range demand {
+			names = append(names, string(n))
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			need := demand[corev1.ResourceName(n)]
+			hard, ok := quota.Status.Hard[corev1.ResourceName(n)]
+			if !ok || need.Sign() <= 0 {
+				continue
+			}
+			available := hard.DeepCopy()
+			available.Sub(quota.Status.Used[corev1.ResourceName(n)])
+			if available.Cmp(need) < 0 {
+				violations = append(violations, fmt.Sprintf("ResourceQuota %s/%s allows %s more %s, the resize needs %s",
+					quota.Namespace, quota.Name, available.String(), n, need.String()))
+			}
+		}
+	}
+	return violations
+}
+
+// capacityViolations returns the StorageClasses whose reported capacity is too small for the created PVCs.
+// StorageClasses without CSIStorageCapacity objects are not checked.
+func capacityViolations(created []corev1.PersistentVolumeClaim, capacities []storagev1.CSIStorageCapacity) []string {
+	byClass := map[string][]storagev1.CSIStorageCapacity{}
+	for _, c := range capacities {
+		byClass[c.StorageClassName] = append(byClass[c.StorageClassName], c)
+	}
+	total := map[string]*resource.Quantity{}
+	largest := map[string]*resource.Quantity{}
+	classes := []string{}
+	for _, p := range created {
+		sc := *p.Spec.StorageClassName
+		if len(byClass[sc]) == 0 {
+			continue
+		}
+		size := p.Spec.Resources.Requests[corev1.ResourceStorage]
+		if total[sc] == nil {
+			classes = append(classes, sc)
+			total[sc] = resource.NewQuantity(0, resource.BinarySI)
+			largest[sc] = resource.NewQuantity(0, resource.BinarySI)
+		}
+		total[sc].Add(size)
+		if size.Cmp(*largest[sc]) > 0 {
+			*largest[sc] = size.DeepCopy()
+		}
+	}
+
+	violations := []string{}
+	for _, sc := range classes {
+		available := resource.NewQuantity(0, resource.BinarySI)
+		fits := false
+		for _, c := range byClass[sc] {
+			if c.Capacity == nil {
+				continue
+			}
+			available.Add(*c.Capacity)
+			max := c.Capacity
+			if c.MaximumVolumeSize != nil {
+				max = c.MaximumVolumeSize
+			}
+			if max.Cmp(*largest[sc]) >= 0 {
+				fits = true
+			}
+		}
+		if !fits {
+			violations = append(violations, fmt.Sprintf("StorageClass %s has no capacity for a volume of %s", sc, largest[sc].String()))
+			continue
+		}
+		if available.Cmp(*total[sc]) < 0 {
+			violations = append(violations, fmt.Sprintf("StorageClass %s has a capacity of %s, the resize needs %s", sc, available.String(), total[sc].String()))
+		}
+	}
+	return violations
+}
@@ -0,0 +1,207 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+func newQuotaTestPVC(name, class string) pvc.Entity {
+	p := corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "foo"},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			StorageClassName: &class,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1G")},
+			},
+		},
+	}
+	return pvc.NewEntity(p, resource.MustParse("2G"), &class)
+}
+
+func TestQuotaViolations(t *testing.T) {
+	tcs := map[string]struct {
+		rebind     bool
+		hard, used corev1.ResourceList
+		violations int
+	}{
+		"no limits": {
+			hard: corev1.ResourceList{corev1.ResourcePods: resource.MustParse("10")},
+			used: corev1.ResourceList{corev1.ResourcePods: resource.MustParse("10")},
+		},
+		"enough storage": {
+			hard: corev1.ResourceList{corev1.ResourceRequestsStorage: resource.MustParse("10G")},
+			used: corev1.ResourceList{corev1.ResourceRequestsStorage: resource.MustParse("2G")},
+		},
+		"backups exceed storage": {
+			// The backups of 2G and the resized PVCs add 4G, while 2G are freed
+			hard:       corev1.ResourceList{corev1.ResourceRequestsStorage: resource.MustParse("5G")},
+			used:       corev1.ResourceList{corev1.ResourceRequestsStorage: resource.MustParse("2G")},
+			violations: 1,
+		},
+		"rebind needs less": {
+			rebind: true,
+			hard:   corev1.ResourceList{corev1.ResourceRequestsStorage: resource.MustParse("6G")},
+			used:   corev1.ResourceList{corev1.ResourceRequestsStorage: resource.MustParse("2G")},
+		},
+		"storage class quota": {
+			hard:       corev1.ResourceList{"ssd.storageclass.storage.k8s.io/requests.storage": resource.MustParse("5G")},
+			used:       corev1.ResourceList{"ssd.storageclass.storage.k8s.io/requests.storage": resource.MustParse("2G")},
+			violations: 1,
+		},
+		"other storage class quota": {
+			hard: corev1.ResourceList{"hdd.storageclass.storage.k8s.io/requests.storage": resource.MustParse("1G")},
+			used: corev1.ResourceList{"hdd.storageclass.storage.k8s.io/requests.storage": resource.MustParse("1G")},
+		},
+		"pvc count": {
+			hard:       corev1.ResourceList{corev1.ResourcePersistentVolumeClaims: resource.MustParse("3")},
+			used:       corev1.ResourceList{corev1.ResourcePersistentVolumeClaims: resource.MustParse("2")},
+			violations: 1,
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			created := []corev1.PersistentVolumeClaim{}
+			deleted := []corev1.PersistentVolumeClaim{}
+			for _, pi := range []pvc.Entity{newQuotaTestPVC("data-web-0", "ssd"), newQuotaTestPVC("data-web-1", "ssd")} {
+				pi.Rebind = tc.rebind
+				c, d := storageChanges(pi)
+				for _, p := range c {
+					created = append(created, withStorageClass(*p, ""))
+				}
+				for _, p := range d {
+					deleted = append(deleted, withStorageClass(*p, ""))
+				}
+			}
+			quota := corev1.ResourceQuota{
+				ObjectMeta: metav1.ObjectMeta{Name: "storage", Namespace: "foo"},
+				Status:     corev1.ResourceQuotaStatus{Hard: tc.hard, Used: tc.used},
+			}
+			demand := storageDemand(created, deleted)
+			assert.Len(t, quotaViolations(demand["foo"], []corev1.ResourceQuota{quota}), tc.violations)
+		})
+	}
+}
+
+func TestCapacityViolations(t *testing.T) {
+	quantity := func(s string) *resource.Quantity {
+		q := resource.MustParse(s)
+		return &q
+	}
+	tcs := map[string]struct {
+		capacities []storagev1.CSIStorageCapacity
+		violations int
+	}{
+		"no capacities": {},
+		"other class": {
+			capacities: []storagev1.CSIStorageCapacity{
+				{StorageClassName: "hdd", Capacity: quantity("1G")},
+			},
+		},
+		"enough capacity": {
+			capacities: []storagev1.CSIStorageCapacity{
+				{StorageClassName: "ssd", Capacity: quantity("3G")},
+				{StorageClassName: "ssd", Capacity: quantity("2G")},
+			},
+		},
+		"not enough capacity": {
+			capacities: []storagev1.CSIStorageCapacity{
+				{StorageClassName: "ssd", Capacity: quantity("3G")},
+			},
+			violations: 1,
+		},
+		"volume too large": {
+			capacities: []storagev1.CSIStorageCapacity{
+				{StorageClassName: "ssd", Capacity: quantity("10G"), MaximumVolumeSize: quantity("1G")},
+			},
+			violations: 1,
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			created := []corev1.PersistentVolumeClaim{}
+			for _, name := range []string{"data-web-0", "data-web-1"} {
+				created = append(created, *newQuotaTestPVC(name, "ssd").GetResizedSource())
+			}
+			assert.Len(t, capacityViolations(created, tc.capacities), tc.violations)
+		})
+	}
+}
+
+func TestHoldForStorage(t *testing.T) {
+	ctx := context.Background()
+	require := require.New(t)
+	assert := assert.New(t)
+
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "foo"},
+	}
+	pi := newQuotaTestPVC("data-web-0", "ssd")
+	quota := &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "storage", Namespace: "foo"},
+		Status: corev1.ResourceQuotaStatus{
+			Hard: corev1.ResourceList{corev1.ResourceRequestsStorage: resource.MustParse("3G")},
+			Used: corev1.ResourceList{corev1.ResourceRequestsStorage: resource.MustParse("2G")},
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(sts, quota).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &StatefulSetReconciler{Client: c, Recorder: recorder, RequeueAfter: 10 * time.Second}
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	hold := func(now time.Time) (*statefulset.Entity, time.Duration, bool) {
+		found := &appsv1.StatefulSet{}
+		require.NoError(c.Get(ctx, client.ObjectKeyFromObject(sts), found))
+		si, err := statefulset.NewEntity(found)
+		require.NoError(err)
+		si.Pvcs = []pvc.Entity{pi}
+		res, held, err := r.holdForStorage(ctx, si, now)
+		require.NoError(err)
+		return si, res.RequeueAfter, held
+	}
+
+	si, requeue, held := hold(start)
+	assert.True(held)
+	assert.Equal(10*time.Second, requeue)
+	require.Len(recorder.Events, 1)
+	assert.Contains(<-recorder.Events, "Warning ResizeBlocked Not resizing, not enough storage: ResourceQuota foo/storage allows 1G more requests.storage, the resize needs 2G")
+	conds, err := si.Conditions()
+	require.NoError(err)
+	blocked := meta.FindStatusCondition(conds, statefulset.ConditionBlocked)
+	require.NotNil(blocked)
+	assert.Equal("InsufficientStorage", blocked.Reason)
+
+	_, requeue, held = hold(start.Add(time.Minute))
+	assert.True(held)
+	assert.Equal(time.Minute, requeue, "backs off")
+	assert.Empty(recorder.Events, "no event while the storage stays insufficient")
+
+	// A pre-copied backup is already part of the used quota
+	require.NoError(c.Create(ctx, pi.GetBackup()))
+	_, _, held = hold(start.Add(time.Hour))
+	assert.False(held)
+
+	require.NoError(c.Delete(ctx, pi.GetBackup()))
+	found := &appsv1.StatefulSet{}
+	require.NoError(c.Get(ctx, client.ObjectKeyFromObject(sts), found))
+	found.Annotations = map[string]string{statefulset.IgnoreStorageCheckAnnotation: "true"}
+	require.NoError(c.Update(ctx, found))
+	_, _, held = hold(start.Add(time.Hour))
+	assert.False(held, "check ignored")
+}
@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+// copyToTarget copies the PVC to a new PVC with the target size, which is later rebound to the name of the original PVC.
+func (r StatefulSetReconciler) copyToTarget(ctx context.Context, pi pvc.Entity) (pvc.Entity, bool, error) {
+	if err := r.getOrCreate(ctx, pi.GetTarget()); err != nil {
+		return pi, false, err
+	}
+	started, done, err := r.copyPVC(ctx,
+		client.ObjectKey{Name: pi.SourceName, Namespace: pi.Namespace},
+		client.ObjectKey{Name: pi.TargetName(), Namespace: pi.Namespace})
+	if started {
+		src := pi.SourceSize()
+		r.event(ctx, "BackupStarted", "Copying PVC %s (%s) to %s (%s), which is rebound later",
+			pi.SourceName, src.String(), pi.TargetName(), pi.TargetSize.String())
+	}
+	if err == nil && done {
+		pi.BackedUp = true
+	}
+	return pi, done, err
+}
+
+// rebindPVC binds the volume of the new PVC to the name of the original PVC.
+// Both volumes are retained while their PVCs are deleted. The volume of the original PVC is kept as the backup.
+// Every call makes at most one step and returns, so that the progress is stored before the next step.
+func (r StatefulSetReconciler) rebindPVC(ctx context.Context, pi pvc.Entity) (pvc.Entity, bool, error) {
+	if pi.TargetVolumeName == "" {
+		target := corev1.PersistentVolumeClaim{}
+		err := r.Get(ctx, client.ObjectKey{Name: pi.TargetName(), Namespace: pi.Namespace}, &target)
+		if apierrors.IsNotFound(err) {
+			return pi, false, CriticalError{Err: fmt.Errorf("PVC %s to rebind is missing", pi.TargetName())}
+		}
+		if err != nil || target.Spec.VolumeName == "" {
+			return pi, false, err
+		}
+		pv := corev1.PersistentVolume{}
+		if err := r.Get(ctx, client.ObjectKey{Name: target.Spec.VolumeName}, &pv); err != nil {
+			return pi, false, err
+		}
+		pi.TargetVolumeName = pv.Name
+		pi.TargetReclaimPolicy = pv.Spec.PersistentVolumeReclaimPolicy
+		return pi, false, nil
+	}
+
+	for _, name := range []string{pi.Spec.VolumeName, pi.TargetVolumeName} {
+		if err := r.setReclaimPolicy(ctx, name, corev1.PersistentVolumeReclaimRetain); err != nil {
+			return pi, false, err
+		}
+	}
+
+	source := corev1.PersistentVolumeClaim{}
+	err := r.Get(ctx, client.ObjectKey{Name: pi.SourceName, Namespace: pi.Namespace}, &source)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return pi, false, err
+	}
+	if err == nil {
+		if source.Spec.VolumeName != pi.TargetVolumeName {
+			// The deletion might take a while to take effect.
+			return pi, false, client.IgnoreNotFound(r.Delete(ctx, &source))
+		}
+		if source.Status.Phase != corev1.ClaimBound {
+			return pi, false, nil
+		}
+		if err := r.setReclaimPolicy(ctx, pi.TargetVolumeName, pi.TargetReclaimPolicy); err != nil {
+			return pi, false, err
+		}
+		pi.Restored = true
+		return pi, true, nil
+	}
+
+	target := corev1.PersistentVolumeClaim{}
+	err = r.Get(ctx, client.ObjectKey{Name: pi.TargetName(), Namespace: pi.Namespace}, &target)
+	if err == nil {
+		return pi, false, client.IgnoreNotFound(r.Delete(ctx, &target))
+	}
+	if !apierrors.IsNotFound(err) {
+		return pi, false, err
+	}
+
+	// Reserve the volume for the original PVC name, which releases it from the deleted new PVC
+	pv := corev1.PersistentVolume{}
+	if err := r.Get(ctx, client.ObjectKey{Name: pi.TargetVolumeName}, &pv); err != nil {
+		return pi, false, err
+	}
+	ref := &corev1.ObjectReference{
+		Kind:       "PersistentVolumeClaim",
+		APIVersion: "v1",
+		Namespace:  pi.Namespace,
+		Name:       pi.SourceName,
+	}
+	if pv.Spec.ClaimRef == nil || *pv.Spec.ClaimRef != *ref {
+		pv.Spec.ClaimRef = ref
+		if err := r.Update(ctx, &pv); err != nil {
+			return pi, false, err
+		}
+	}
+	if err := r.Create(ctx, pi.GetRebound()); err != nil {
+		return pi, false, err
+	}
+	src := pi.SourceSize()
+	r.event(ctx, "SourceRecreated", "Recreated PVC %s with %s (was %s), bound to volume %s",
+		pi.SourceName, pi.TargetSize.String(), src.String(), pi.TargetVolumeName)
+	return pi, false, nil
+}
+
+func (r StatefulSetReconciler) setReclaimPolicy(ctx context.Context, name string, policy corev1.PersistentVolumeReclaimPolicy) error {
+	if name == "" || policy == "" {
+		return nil
+	}
+	pv := corev1.PersistentVolume{}
+	if err := r.Get(ctx, client.ObjectKey{Name: name}, &pv); err != nil {
+		return err
+	}
+	if pv.Spec.PersistentVolumeReclaimPolicy == policy {
+		return nil
+	}
+	patch := client.MergeFrom(pv.DeepCopy())
+	pv.Spec.PersistentVolumeReclaimPolicy = policy
+	return r.Patch(ctx, &pv, patch)
+}
+
+// applyCopyMode marks the PVCs to be rebound, if the StatefulSet uses the rebind copy mode
+func applyCopyMode(ctx context.Context, sts *statefulset.Entity, def statefulset.CopyMode) {
+	mode, err := sts.CopyMode(def)
+	if err != nil {
+		log.FromContext(ctx).Info("Ignoring copy mode", "error", err)
+		mode = def
+	}
+	for i, pi := range sts.Pvcs {
+		sts.Pvcs[i].Rebind = mode == statefulset.CopyModeRebind && !pi.Discard && pi.TargetNamespace == ""
+	}
+}
@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
+)
+
+func TestRebindPVC(t *testing.T) {
+	ctx := context.Background()
+	require := require.New(t)
+	assert := assert.New(t)
+
+	newPV := func(name string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+			},
+		}
+	}
+	source := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data-web-0", Namespace: "foo"},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName: "pv-old",
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1G")},
+			},
+		},
+	}
+	pi := pvc.NewEntity(*source, resource.MustParse("2G"), nil)
+	pi.Rebind = true
+	pi.BackedUp = true
+	target := pi.GetTarget()
+	target.Spec.VolumeName = "pv-new"
+
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).
+		WithObjects(source, target, newPV("pv-old"), newPV("pv-new")).
+		Build()
+	r := StatefulSetReconciler{Client: c, Recorder: record.NewFakeRecorder(10)}
+
+	step := func() bool {
+		var done bool
+		var err error
+		pi, done, err = r.rebindPVC(ctx, pi)
+		require.NoError(err)
+		return done
+	}
+
+	assert.False(step())
+	assert.Equal("pv-new", pi.TargetVolumeName)
+	assert.Equal(corev1.PersistentVolumeReclaimDelete, pi.TargetReclaimPolicy)
+
+	assert.False(step())
+	for _, name := range []string{"pv-old", "pv-new"} {
+		pv := corev1.PersistentVolume{}
+		require.NoError(c.Get(ctx, client.ObjectKey{Name: name}, &pv))
+		assert.Equal(corev1.PersistentVolumeReclaimRetain, pv.Spec.PersistentVolumeReclaimPolicy, name)
+	}
+	err := c.Get(ctx, client.ObjectKeyFromObject(source), &corev1.PersistentVolumeClaim{})
+	assert.True(apierrors.IsNotFound(err), "source deleted")
+
+	assert.False(step())
+	err = c.Get(ctx, client.ObjectKeyFromObject(target), &corev1.PersistentVolumeClaim{})
+	assert.True(apierrors.IsNotFound(err), "target deleted")
+
+	assert.False(step())
+	pv := corev1.PersistentVolume{}
+	require.NoError(c.Get(ctx, client.ObjectKey{Name: "pv-new"}, &pv))
+	require.NotNil(pv.Spec.ClaimRef)
+	assert.Equal("data-web-0", pv.Spec.ClaimRef.Name)
+	rebound := corev1.PersistentVolumeClaim{}
+	require.NoError(c.Get(ctx, client.ObjectKeyFromObject(source), &rebound))
+	assert.Equal("pv-new", rebound.Spec.VolumeName)
+	assert.Equal("2G", rebound.Spec.Resources.Requests.Storage().String())
+
+	assert.False(step(), "waits until bound")
+	rebound.Status.Phase = corev1.ClaimBound
+	require.NoError(c.Status().Update(ctx, &rebound))
+
+	assert.True(step())
+	assert.True(pi.Restored)
+	require.NoError(c.Get(ctx, client.ObjectKey{Name: "pv-new"}, &pv))
+	assert.Equal(corev1.PersistentVolumeReclaimDelete, pv.Spec.PersistentVolumeReclaimPolicy, "original policy restored")
+	require.NoError(c.Get(ctx, client.ObjectKey{Name: "pv-old"}, &pv))
+	assert.Equal(corev1.PersistentVolumeReclaimRetain, pv.Spec.PersistentVolumeReclaimPolicy, "old volume kept as backup")
+}
+
+func TestRebindPVCMissingTarget(t *testing.T) {
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).Build()
+	r := StatefulSetReconciler{Client: c, Recorder: record.NewFakeRecorder(10)}
+	pi := pvc.NewEntity(corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data-web-0", Namespace: "foo"},
+	}, resource.MustParse("2G"), nil)
+	pi.Rebind = true
+
+	_, _, err := r.rebindPVC(context.Background(), pi)
+	assert.NotNil(t, isCritical(err))
+}
@@ -0,0 +1,173 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/vshn/statefulset-resize-controller/naming"
+)
+
+// StashKey is the key of the StatefulSet manifest in a stash ConfigMap
+const StashKey = "statefulset.json"
+
+const stashNamePrefix = "sts-resize-recreate-"
+
+// StashLabel marks a ConfigMap as a stash written by the controller
+const StashLabel = "sts-resize.vshn.net/stash"
+
+// StashOfAnnotation holds the UID of the StatefulSet the stash replaces
+const StashOfAnnotation = "sts-resize.vshn.net/stash-of"
+
+// StashDeletedAnnotation holds the UID of the StatefulSet, once the controller deleted it to recreate it from the stash
+const StashDeletedAnnotation = "sts-resize.vshn.net/stash-deleted"
+
+func stashName(stsName string) string {
+	// Ignored error cannot occur since 63-prefixLen is > 8.
+	stsName, _ = naming.ShortenName(stsName, 63-len(stashNamePrefix))
+	return stashNamePrefix + stsName
+}
+
+// recreateStatefulSet replaces the StatefulSet with the desired one, without deleting its pods.
+// As volumeClaimTemplates are immutable, this is the only way to update them.
+//
+// The desired StatefulSet is first stashed in a ConfigMap, together with the UID of the StatefulSet it replaces.
+// Then the StatefulSet is deleted, orphaning its pods, and the deletion is recorded on the stash.
+// As soon as the deletion completes, the StatefulSet is recreated from the stash, see restoreStash.
+func (r StatefulSetReconciler) recreateStatefulSet(ctx context.Context, old *appsv1.StatefulSet, desired *appsv1.StatefulSet) error {
+	manifest, err := json.Marshal(cleanForCreate(desired))
+	if err != nil {
+		return err
+	}
+	stash := corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      stashName(old.Name),
+			Namespace: old.Namespace,
+			Labels: map[string]string{
+				ManagedLabel: "true",
+				StashLabel:   "true",
+			},
+			Annotations: map[string]string{
+				StashOfAnnotation: string(old.UID),
+			},
+		},
+		Data: map[string]string{
+			StashKey: string(manifest),
+		},
+	}
+	found := corev1.ConfigMap{}
+	err = r.Get(ctx, client.ObjectKeyFromObject(&stash), &found)
+	if apierrors.IsNotFound(err) {
+		err = r.Create(ctx, &stash)
+		found = stash
+	} else if err == nil && (found.Data[StashKey] != stash.Data[StashKey] ||
+		!reflect.DeepEqual(found.Labels, stash.Labels) || !reflect.DeepEqual(found.Annotations, stash.Annotations)) {
+		// Anything else found in the stash was not written by us for this StatefulSet
+		found.Labels = stash.Labels
+		found.Annotations = stash.Annotations
+		found.Data = stash.Data
+		err = r.Update(ctx, &found)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.FromContext(ctx).Info("Recreating StatefulSet to update volumeClaimTemplates")
+	r.Recorder.Event(old, "Normal", "RecreatingStatefulSet", "Recreating StatefulSet to update its volumeClaimTemplates, its pods are kept")
+	pol := metav1.DeletePropagationOrphan
+	// The precondition makes sure we never delete an already recreated StatefulSet
+	err = r.Delete(ctx, old, &client.DeleteOptions{
+		PropagationPolicy: &pol,
+		Preconditions:     &metav1.Preconditions{UID: &old.UID},
+	})
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	// Only a deletion we performed is ever restored
+	found.Annotations[StashDeletedAnnotation] = string(old.UID)
+	return r.Update(ctx, &found)
+}
+
+// restoreStash recreates a deleted StatefulSet from its stash, if there is one.
+// It returns false if the StatefulSet could not yet be recreated.
+//
+// Only stashes written by the controller, for a StatefulSet it deleted itself, are restored.
+// Anybody allowed to create ConfigMaps could otherwise have the controller create any StatefulSet.
+func (r StatefulSetReconciler) restoreStash(ctx context.Context, key types.NamespacedName) (bool, error) {
+	l := log.FromContext(ctx)
+	stash := corev1.ConfigMap{}
+	err := r.Get(ctx, client.ObjectKey{Name: stashName(key.Name), Namespace: key.Namespace}, &stash)
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	uid := stash.Annotations[StashOfAnnotation]
+	if stash.Labels[StashLabel] != "true" || uid == "" || stash.Annotations[StashDeletedAnnotation] != uid {
+		l.Info("Not recreating StatefulSet from a stash the controller did not complete", "stash", stash.Name)
+		r.Recorder.Eventf(&stash, "Warning", "StashIgnored",
+			"Not recreating StatefulSet %s, the stash does not record its deletion by the controller. Recreate it from the stash by hand if needed", key.Name)
+		return true, nil
+	}
+	sts := &appsv1.StatefulSet{}
+	if err := json.Unmarshal([]byte(stash.Data[StashKey]), sts); err != nil {
+		return false, fmt.Errorf("stash %s malformed: %w", stash.Name, err)
+	}
+	if sts.Name != key.Name || sts.Namespace != key.Namespace {
+		return false, fmt.Errorf("stash %s holds StatefulSet %s/%s", stash.Name, sts.Namespace, sts.Name)
+	}
+	l.Info("Recreating StatefulSet from stash")
+	err = r.Create(ctx, sts)
+	if apierrors.IsAlreadyExists(err) {
+		// The old StatefulSet is still being deleted
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	r.Recorder.Event(sts, "Normal", "RecreatedStatefulSet", "Recreated StatefulSet with updated volumeClaimTemplates")
+	return true, client.IgnoreNotFound(r.Delete(ctx, &stash))
+}
+
+// cleanupStash removes a stash that was already used to recreate the StatefulSet.
+func (r StatefulSetReconciler) cleanupStash(ctx context.Context, sts *appsv1.StatefulSet) error {
+	stash := corev1.ConfigMap{}
+	err := r.Get(ctx, client.ObjectKey{Name: stashName(sts.Name), Namespace: sts.Namespace}, &stash)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	stashed := &appsv1.StatefulSet{}
+	if err := json.Unmarshal([]byte(stash.Data[StashKey]), stashed); err != nil {
+		return fmt.Errorf("stash %s malformed: %w", stash.Name, err)
+	}
+	if !reflect.DeepEqual(stashed.Spec.VolumeClaimTemplates, sts.Spec.VolumeClaimTemplates) {
+		// We did not yet recreate the StatefulSet
+		return nil
+	}
+	return client.IgnoreNotFound(r.Delete(ctx, &stash))
+}
+
+// cleanForCreate returns a copy of the StatefulSet that can be used to create a new one
+func cleanForCreate(sts *appsv1.StatefulSet) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		TypeMeta: sts.TypeMeta,
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            sts.Name,
+			Namespace:       sts.Namespace,
+			Labels:          sts.Labels,
+			Annotations:     sts.Annotations,
+			OwnerReferences: sts.OwnerReferences,
+		},
+		Spec: sts.Spec,
+	}
+}
@@ -0,0 +1,192 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+func TestRecreateStatefulSet(t *testing.T) {
+	ctx := context.Background()
+	require := require.New(t)
+	assert := assert.New(t)
+
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "foo",
+			UID:       "1234",
+			Labels:    map[string]string{"app": "web"},
+			Annotations: map[string]string{
+				statefulset.ReplicasAnnotation:   "3",
+				statefulset.TargetSizeAnnotation: "2G",
+			},
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: pointer.Int32(0),
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{
+				ObjectMeta: metav1.ObjectMeta{Name: "data"},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1G")},
+					},
+				},
+			}},
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(sts).Build()
+	r := StatefulSetReconciler{Client: c, Recorder: record.NewFakeRecorder(10)}
+
+	si, err := statefulset.NewEntity(sts)
+	require.NoError(err)
+	desired, requested, err := si.ApplyTargetSizes()
+	require.NoError(err)
+	require.True(requested)
+	current, err := si.StatefulSet()
+	require.NoError(err)
+	require.NoError(r.recreateStatefulSet(ctx, current, desired))
+
+	err = c.Get(ctx, client.ObjectKeyFromObject(sts), &appsv1.StatefulSet{})
+	assert.True(apierrors.IsNotFound(err), "old StatefulSet deleted")
+	stash := &corev1.ConfigMap{}
+	require.NoError(c.Get(ctx, client.ObjectKey{Name: stashName(sts.Name), Namespace: sts.Namespace}, stash))
+	assert.Equal("1234", stash.Annotations[StashOfAnnotation])
+	assert.Equal("1234", stash.Annotations[StashDeletedAnnotation], "deletion recorded")
+
+	restored, err := r.restoreStash(ctx, client.ObjectKeyFromObject(sts))
+	require.NoError(err)
+	assert.True(restored)
+
+	found := &appsv1.StatefulSet{}
+	require.NoError(c.Get(ctx, client.ObjectKeyFromObject(sts), found))
+	assert.Equal("2G", found.Spec.VolumeClaimTemplates[0].Spec.Resources.Requests.Storage().String())
+	assert.Equal("web", found.Labels["app"])
+	assert.Equal("3", found.Annotations[statefulset.ReplicasAnnotation], "keeps the resize state")
+	assert.NotContains(found.Annotations, statefulset.TargetSizeAnnotation)
+	assert.Equal(int32(0), *found.Spec.Replicas)
+
+	err = c.Get(ctx, client.ObjectKey{Name: stashName(sts.Name), Namespace: sts.Namespace}, &corev1.ConfigMap{})
+	assert.True(apierrors.IsNotFound(err), "stash removed")
+
+	restored, err = r.restoreStash(ctx, client.ObjectKeyFromObject(sts))
+	require.NoError(err)
+	assert.True(restored, "nothing to restore without stash")
+}
+
+func TestApplyDesiredTemplates(t *testing.T) {
+	ctx := context.Background()
+	require := require.New(t)
+	assert := assert.New(t)
+
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "foo",
+			UID:       "1234",
+			Labels:    map[string]string{"app": "web"},
+			Annotations: map[string]string{
+				statefulset.TemplatesConfigMapAnnotation: "web-templates",
+			},
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: pointer.Int32(3),
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{
+				ObjectMeta: metav1.ObjectMeta{Name: "data"},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1G")},
+					},
+				},
+			}},
+		},
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-templates", Namespace: "foo"},
+		Data: map[string]string{
+			statefulset.TemplatesKey: `[{"metadata":{"name":"data"},"spec":{"resources":{"requests":{"storage":"1G"}}}}]`,
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(sts, cm).Build()
+	r := StatefulSetReconciler{Client: c, Recorder: record.NewFakeRecorder(10)}
+
+	si, err := statefulset.NewEntity(sts)
+	require.NoError(err)
+	hold, err := r.applyDesiredTemplates(ctx, si)
+	require.NoError(err)
+	assert.False(hold, "templates already match")
+
+	cm.Data[statefulset.TemplatesKey] = `[{"metadata":{"name":"data"},"spec":{"resources":{"requests":{"storage":"2G"}}}}]`
+	require.NoError(c.Update(ctx, cm))
+	hold, err = r.applyDesiredTemplates(ctx, si)
+	require.NoError(err)
+	assert.True(hold)
+
+	err = c.Get(ctx, client.ObjectKeyFromObject(sts), &appsv1.StatefulSet{})
+	assert.True(apierrors.IsNotFound(err), "old StatefulSet deleted")
+	restored, err := r.restoreStash(ctx, client.ObjectKeyFromObject(sts))
+	require.NoError(err)
+	assert.True(restored)
+
+	found := &appsv1.StatefulSet{}
+	require.NoError(c.Get(ctx, client.ObjectKeyFromObject(sts), found))
+	assert.Equal("2G", found.Spec.VolumeClaimTemplates[0].Spec.Resources.Requests.Storage().String())
+	assert.Equal("web", found.Labels["app"])
+	assert.Equal(int32(3), *found.Spec.Replicas)
+
+	cm.Data[statefulset.TemplatesKey] = `invalid`
+	require.NoError(c.Update(ctx, cm))
+	si, err = statefulset.NewEntity(found)
+	require.NoError(err)
+	hold, err = r.applyDesiredTemplates(ctx, si)
+	require.NoError(err)
+	assert.True(hold, "invalid templates block the resize")
+}
+
+func TestRestoreStashIgnoresForeignStash(t *testing.T) {
+	ctx := context.Background()
+	manifest := `{"metadata":{"name":"web","namespace":"foo"},"spec":{"template":{"spec":{"serviceAccountName":"admin"}}}}`
+	tcs := map[string]map[string]string{
+		"hand-made":           nil,
+		"deletion not marked": {StashOfAnnotation: "1234"},
+		"other deletion":      {StashOfAnnotation: "1234", StashDeletedAnnotation: "5678"},
+	}
+	for k, annotations := range tcs {
+		t.Run(k, func(t *testing.T) {
+			stash := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        stashName("web"),
+					Namespace:   "foo",
+					Labels:      map[string]string{ManagedLabel: "true", StashLabel: "true"},
+					Annotations: annotations,
+				},
+				Data: map[string]string{StashKey: manifest},
+			}
+			c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(stash).Build()
+			recorder := record.NewFakeRecorder(10)
+			r := StatefulSetReconciler{Client: c, Recorder: recorder}
+
+			restored, err := r.restoreStash(ctx, client.ObjectKey{Name: "web", Namespace: "foo"})
+			require.NoError(t, err)
+			assert.True(t, restored, "nothing left to restore")
+			err = c.Get(ctx, client.ObjectKey{Name: "web", Namespace: "foo"}, &appsv1.StatefulSet{})
+			assert.True(t, apierrors.IsNotFound(err), "no StatefulSet created")
+			require.Len(t, recorder.Events, 1)
+			assert.Contains(t, <-recorder.Events, "Warning StashIgnored")
+		})
+	}
+}
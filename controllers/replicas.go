@@ -0,0 +1,164 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+// PausedBoundsAnnotation stores the original bounds of a HorizontalPodAutoscaler paused during a resize
+const PausedBoundsAnnotation = "sts-resize.vshn.net/paused-bounds"
+
+type hpaBounds struct {
+	MinReplicas *int32 `json:"minReplicas,omitempty"`
+	MaxReplicas int32  `json:"maxReplicas"`
+}
+
+// fetchHPAs returns all HorizontalPodAutoscalers targeting the StatefulSet
+func (r StatefulSetReconciler) fetchHPAs(ctx context.Context, sts *statefulset.Entity) ([]autoscalingv2.HorizontalPodAutoscaler, error) {
+	hpas := autoscalingv2.HorizontalPodAutoscalerList{}
+	if err := r.List(ctx, &hpas, client.InNamespace(sts.Old.Namespace)); err != nil {
+		return nil, err
+	}
+	res := []autoscalingv2.HorizontalPodAutoscaler{}
+	for _, hpa := range hpas.Items {
+		ref := hpa.Spec.ScaleTargetRef
+		gv, err := schema.ParseGroupVersion(ref.APIVersion)
+		if err != nil {
+			continue
+		}
+		if gv.Group == "apps" && ref.Kind == "StatefulSet" && ref.Name == sts.Old.Name {
+			res = append(res, hpa)
+		}
+	}
+	return res, nil
+}
+
+// pauseHPAs pins the bounds of all HorizontalPodAutoscalers targeting the StatefulSet to its current replicas.
+// While the StatefulSet is scaled to zero, autoscaling is disabled anyway.
+// Pinning the bounds prevents the autoscaler from interfering while scaling back up.
+func (r StatefulSetReconciler) pauseHPAs(ctx context.Context, sts *statefulset.Entity) error {
+	if sts.Old.Spec.Replicas == nil || *sts.Old.Spec.Replicas == 0 {
+		return nil
+	}
+	replicas := *sts.Old.Spec.Replicas
+	hpas, err := r.fetchHPAs(ctx, sts)
+	if err != nil {
+		return err
+	}
+	for _, hpa := range hpas {
+		if _, ok := hpa.Annotations[PausedBoundsAnnotation]; ok {
+			continue
+		}
+		bounds, err := json.Marshal(hpaBounds{
+			MinReplicas: hpa.Spec.MinReplicas,
+			MaxReplicas: hpa.Spec.MaxReplicas,
+		})
+		if err != nil {
+			return err
+		}
+		patch := client.MergeFrom(hpa.DeepCopy())
+		if hpa.Annotations == nil {
+			hpa.Annotations = map[string]string{}
+		}
+		hpa.Annotations[PausedBoundsAnnotation] = string(bounds)
+		hpa.Spec.MinReplicas = &replicas
+		hpa.Spec.MaxReplicas = replicas
+		log.FromContext(ctx).Info("Pausing HorizontalPodAutoscaler", "hpa", hpa.Name)
+		if err := r.Patch(ctx, &hpa, patch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resumeHPAs restores the original bounds of all paused HorizontalPodAutoscalers targeting the StatefulSet
+func (r StatefulSetReconciler) resumeHPAs(ctx context.Context, sts *statefulset.Entity) error {
+	hpas, err := r.fetchHPAs(ctx, sts)
+	if err != nil {
+		return err
+	}
+	for _, hpa := range hpas {
+		v, ok := hpa.Annotations[PausedBoundsAnnotation]
+		if !ok {
+			continue
+		}
+		bounds := hpaBounds{}
+		if err := json.Unmarshal([]byte(v), &bounds); err != nil {
+			return fmt.Errorf("annotation %s of HorizontalPodAutoscaler %s malformed: %w", PausedBoundsAnnotation, hpa.Name, err)
+		}
+		patch := client.MergeFrom(hpa.DeepCopy())
+		delete(hpa.Annotations, PausedBoundsAnnotation)
+		hpa.Spec.MinReplicas = bounds.MinReplicas
+		hpa.Spec.MaxReplicas = bounds.MaxReplicas
+		log.FromContext(ctx).Info("Resuming HorizontalPodAutoscaler", "hpa", hpa.Name)
+		if err := r.Patch(ctx, &hpa, patch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abortExternallyScaled aborts a resize after a third party scaled up the StatefulSet while we expected it to be scaled down.
+// If some of the original PVCs are already replaced, the StatefulSet is scaled down again, as its pods would otherwise start on incomplete data.
+func (r StatefulSetReconciler) abortExternallyScaled(ctx context.Context, sts *statefulset.Entity) error {
+	replicas := *sts.Old.Spec.Replicas
+	intact := true
+	for _, pi := range sts.Pvcs {
+		ok, err := r.sourceIntact(ctx, pi)
+		if err != nil {
+			return err
+		}
+		intact = intact && ok
+		if err := r.stopJobs(ctx, pi); err != nil {
+			return err
+		}
+	}
+	log.FromContext(ctx).Info("StatefulSet was scaled during resize, aborting", "replicas", replicas, "sourcesIntact", intact)
+
+	if intact {
+		// The StatefulSet is running again, let the autoscalers do their job
+		if err := r.resumeHPAs(ctx, sts); err != nil {
+			return err
+		}
+		return CriticalError{
+			Err: fmt.Errorf("replicas changed to %d during resize", replicas),
+			Event: fmt.Sprintf("Replicas changed from 0 to %d by a third party during the resize. "+
+				"Aborted the resize, the original PVCs are untouched", replicas),
+		}
+	}
+	sts.ForceScaleDown()
+	return CriticalError{
+		Err: fmt.Errorf("replicas changed to %d during resize", replicas),
+		Event: fmt.Sprintf("Replicas changed from 0 to %d by a third party during the resize. "+
+			"Some PVCs were already recreated, scaled down again. Restore the remaining PVCs from their backups manually", replicas),
+	}
+}
+
+// sourceIntact returns whether the original PVC still exists and was not yet replaced
+func (r StatefulSetReconciler) sourceIntact(ctx context.Context, pi pvc.Entity) (bool, error) {
+	if pi.TargetNamespace != "" {
+		// Migrating never modifies the source
+		return true, nil
+	}
+	found := corev1.PersistentVolumeClaim{}
+	err := r.Get(ctx, client.ObjectKey{Name: pi.SourceName, Namespace: pi.Namespace}, &found)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	q := found.Spec.Resources.Requests[corev1.ResourceStorage]
+	return found.DeletionTimestamp == nil && q.Cmp(pi.TargetSize) < 0, nil
+}
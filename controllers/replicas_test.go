@@ -0,0 +1,236 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+func TestPauseAndResumeHPAs(t *testing.T) {
+	ctx := context.Background()
+	require := require.New(t)
+	assert := assert.New(t)
+
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "foo"},
+		Spec:       appsv1.StatefulSetSpec{Replicas: pointer.Int32(3)},
+	}
+	newHPA := func(name, kind, target string) *autoscalingv2.HorizontalPodAutoscaler {
+		return &autoscalingv2.HorizontalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "foo"},
+			Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+				ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{
+					APIVersion: "apps/v1",
+					Kind:       kind,
+					Name:       target,
+				},
+				MinReplicas: pointer.Int32(2),
+				MaxReplicas: 10,
+			},
+		}
+	}
+	targeting := newHPA("targeting", "StatefulSet", "web")
+	other := newHPA("other", "StatefulSet", "db")
+	deployment := newHPA("deployment", "Deployment", "web")
+
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(sts, targeting, other, deployment).Build()
+	r := StatefulSetReconciler{Client: c}
+	si, err := statefulset.NewEntity(sts)
+	require.NoError(err)
+
+	require.NoError(r.pauseHPAs(ctx, si))
+	require.NoError(r.pauseHPAs(ctx, si), "pausing twice keeps the original bounds")
+
+	found := &autoscalingv2.HorizontalPodAutoscaler{}
+	require.NoError(c.Get(ctx, client.ObjectKeyFromObject(targeting), found))
+	assert.Equal(int32(3), *found.Spec.MinReplicas)
+	assert.Equal(int32(3), found.Spec.MaxReplicas)
+	assert.Contains(found.Annotations, PausedBoundsAnnotation)
+	for _, hpa := range []*autoscalingv2.HorizontalPodAutoscaler{other, deployment} {
+		require.NoError(c.Get(ctx, client.ObjectKeyFromObject(hpa), found))
+		assert.Equal(int32(10), found.Spec.MaxReplicas, "unrelated HPA %s untouched", hpa.Name)
+	}
+
+	require.NoError(r.resumeHPAs(ctx, si))
+	require.NoError(c.Get(ctx, client.ObjectKeyFromObject(targeting), found))
+	assert.Equal(int32(2), *found.Spec.MinReplicas)
+	assert.Equal(int32(10), found.Spec.MaxReplicas)
+	assert.NotContains(found.Annotations, PausedBoundsAnnotation)
+}
+
+func TestResumeHPAsAfterFailure(t *testing.T) {
+	ctx := context.Background()
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "foo",
+			Annotations: map[string]string{statefulset.ReplicasAnnotation: "3"},
+		},
+		Spec: appsv1.StatefulSetSpec{Replicas: pointer.Int32(0)},
+	}
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "foo",
+			Annotations: map[string]string{PausedBoundsAnnotation: `{"minReplicas":2,"maxReplicas":10}`},
+		},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "web"},
+			MinReplicas:    pointer.Int32(3),
+			MaxReplicas:    3,
+		},
+	}
+	assertResumed := func(t *testing.T, c client.Client) {
+		found := &autoscalingv2.HorizontalPodAutoscaler{}
+		require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(hpa), found))
+		assert.Equal(t, int32(2), *found.Spec.MinReplicas)
+		assert.Equal(t, int32(10), found.Spec.MaxReplicas)
+		assert.NotContains(t, found.Annotations, PausedBoundsAnnotation)
+	}
+
+	t.Run("failed and scaled up", func(t *testing.T) {
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(sts.DeepCopy(), hpa.DeepCopy()).Build()
+		r := StatefulSetReconciler{Client: c, Recorder: &record.FakeRecorder{}}
+		read := &appsv1.StatefulSet{}
+		require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(sts), read))
+		si, err := statefulset.NewEntity(read)
+		require.NoError(t, err)
+
+		require.NoError(t, r.updateStatefulSet(ctx, si, CriticalError{
+			Err:           errors.New("job failed"),
+			SaveToScaleUp: true,
+		}))
+		found := &appsv1.StatefulSet{}
+		require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(sts), found))
+		assert.Equal(t, "true", found.Labels[statefulset.FailedLabel])
+		assert.Equal(t, int32(3), *found.Spec.Replicas)
+		assert.Equal(t, "true", found.Annotations[statefulset.RestartAnnotation])
+		assertResumed(t, c)
+
+		// Removing the failed label by hand retries the resize, it starts over
+		delete(found.Labels, statefulset.FailedLabel)
+		require.NoError(t, c.Update(ctx, found))
+		_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(sts)})
+		require.NoError(t, err)
+		require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(sts), found))
+		assert.NotContains(t, found.Annotations, statefulset.RestartAnnotation)
+		assert.NotContains(t, found.Annotations, statefulset.ScaleUpAnnotation)
+		assert.NotContains(t, found.Annotations, statefulset.ReplicasAnnotation)
+		assert.Equal(t, int32(3), *found.Spec.Replicas)
+	})
+
+	t.Run("failed StatefulSet reconciled", func(t *testing.T) {
+		failed := sts.DeepCopy()
+		failed.Labels = map[string]string{statefulset.FailedLabel: "true"}
+		failed.Annotations[statefulset.ScaleUpAnnotation] = "true"
+		failed.Spec.Replicas = pointer.Int32(3)
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(failed, hpa.DeepCopy()).Build()
+		r := StatefulSetReconciler{Client: c, Recorder: &record.FakeRecorder{}}
+
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(sts)})
+		require.NoError(t, err)
+		assertResumed(t, c)
+	})
+}
+
+func TestAbortExternallyScaled(t *testing.T) {
+	ctx := context.Background()
+
+	newPVC := func(name, size string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "foo"},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(size)},
+				},
+			},
+		}
+	}
+	tcs := map[string]struct {
+		sources       []*corev1.PersistentVolumeClaim
+		scaledDown    bool
+		failedMessage string
+	}{
+		"sources intact": {
+			sources: []*corev1.PersistentVolumeClaim{
+				newPVC("data-web-0", "1G"),
+				newPVC("data-web-1", "1G"),
+			},
+			scaledDown:    false,
+			failedMessage: "original PVCs are untouched",
+		},
+		"source already replaced": {
+			sources: []*corev1.PersistentVolumeClaim{
+				newPVC("data-web-0", "2G"),
+				newPVC("data-web-1", "1G"),
+			},
+			scaledDown:    true,
+			failedMessage: "scaled down again",
+		},
+		"source deleted": {
+			sources: []*corev1.PersistentVolumeClaim{
+				newPVC("data-web-1", "1G"),
+			},
+			scaledDown:    true,
+			failedMessage: "scaled down again",
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			require := require.New(t)
+			assert := assert.New(t)
+			sts := &appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "web",
+					Namespace:   "foo",
+					Annotations: map[string]string{statefulset.ReplicasAnnotation: "2"},
+				},
+				Spec: appsv1.StatefulSetSpec{Replicas: pointer.Int32(2)},
+			}
+			b := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(sts)
+			for _, s := range tc.sources {
+				b = b.WithObjects(s)
+			}
+			c := b.Build()
+			recorder := record.NewFakeRecorder(10)
+			r := StatefulSetReconciler{Client: c, Recorder: recorder}
+
+			si, err := statefulset.NewEntity(sts)
+			require.NoError(err)
+			require.True(si.ScaledExternally())
+			for _, name := range []string{"data-web-0", "data-web-1"} {
+				si.Pvcs = append(si.Pvcs, pvc.NewEntity(*newPVC(name, "1G"), resource.MustParse("2G"), nil))
+			}
+
+			require.NoError(r.updateStatefulSet(ctx, si, r.abortExternallyScaled(ctx, si)))
+
+			found := &appsv1.StatefulSet{}
+			require.NoError(c.Get(ctx, client.ObjectKeyFromObject(sts), found))
+			assert.Equal("true", found.Labels[statefulset.FailedLabel])
+			if tc.scaledDown {
+				assert.Equal(int32(0), *found.Spec.Replicas)
+			} else {
+				assert.Equal(int32(2), *found.Spec.Replicas)
+			}
+			require.Len(recorder.Events, 1)
+			assert.Contains(<-recorder.Events, tc.failedMessage)
+		})
+	}
+}
@@ -2,29 +2,58 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/vshn/statefulset-resize-controller/pvc"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 func (r *StatefulSetReconciler) restorePVC(ctx context.Context, pi pvc.Entity) (pvc.Entity, bool, error) {
 	if pi.Restored {
 		return pi, true, nil
 	}
+	if pi.TargetNamespace != "" {
+		// The migrated copy is complete, we keep the original PVC
+		pi.Restored = true
+		return pi, true, nil
+	}
+	if pi.Rebind {
+		return r.rebindPVC(ctx, pi)
+	}
+	if pi.Discard {
+		err := r.Delete(ctx, pi.GetResizedSource())
+		if client.IgnoreNotFound(err) != nil {
+			return pi, false, err
+		}
+		pi.Restored = true
+		return pi, true, nil
+	}
+	if pi.RetainVolume && pi.SourceVolumeName == "" {
+		return r.recordSourceVolume(ctx, pi)
+	}
 	done, err := r.resizeSource(ctx, pi)
 	if err != nil || !done {
 		return pi, done, err
 	}
 
-	done, err = r.copyPVC(ctx,
+	started, done, err := r.copyPVC(ctx,
 		client.ObjectKey{Name: pi.BackupName(), Namespace: pi.Namespace},
 		client.ObjectKey{Name: pi.SourceName, Namespace: pi.Namespace})
-	if err == nil && done {
-		pi.Restored = true
+	if started {
+		r.event(ctx, "RestoreStarted", "Restoring PVC %s (%s) from %s", pi.SourceName, pi.TargetSize.String(), pi.BackupName())
 	}
-	return pi, done, err
+	if err != nil || !done {
+		return pi, done, err
+	}
+	if err := r.releaseSourceVolume(ctx, pi); err != nil {
+		return pi, false, err
+	}
+	pi.Restored = true
+	return pi, true, nil
 }
 
 func (r *StatefulSetReconciler) resizeSource(ctx context.Context, pi pvc.Entity) (bool, error) {
@@ -33,16 +62,81 @@ func (r *StatefulSetReconciler) resizeSource(ctx context.Context, pi pvc.Entity)
 
 	err := r.Get(ctx, client.ObjectKeyFromObject(source), &found)
 	if apierrors.IsNotFound(err) {
-		return true, r.Create(ctx, source)
+		if err := r.Create(ctx, source); err != nil {
+			return false, err
+		}
+		src := pi.SourceSize()
+		r.event(ctx, "SourceRecreated", "Recreated PVC %s with %s (was %s)", pi.SourceName, pi.TargetSize.String(), src.String())
+		return true, nil
 	}
 	if err != nil {
 		return false, err
 	}
 	q := found.Spec.Resources.Requests[corev1.ResourceStorage]
 	if q.Cmp(pi.TargetSize) < 0 {
+		if err := r.setReclaimPolicy(ctx, pi.SourceVolumeName, corev1.PersistentVolumeReclaimRetain); err != nil {
+			return false, err
+		}
 		// The deletion might take a while to take effect.
 		// Let's backoff to avoid a race condition.
 		return false, r.Delete(ctx, &found)
 	}
 	return true, nil
 }
+
+// recordSourceVolume records the volume of the original PVC and its reclaim policy, before the volume is retained.
+// The policy is recorded before it is changed, so we never mistake our own change for the original policy.
+func (r *StatefulSetReconciler) recordSourceVolume(ctx context.Context, pi pvc.Entity) (pvc.Entity, bool, error) {
+	l := log.FromContext(ctx)
+	if pi.Spec.VolumeName == "" {
+		// There is no volume to protect
+		l.Info("Not retaining volume of unbound PVC", "pvc", pi.SourceName)
+		pi.RetainVolume = false
+		return pi, false, nil
+	}
+	pv := corev1.PersistentVolume{}
+	err := r.Get(ctx, client.ObjectKey{Name: pi.Spec.VolumeName}, &pv)
+	if apierrors.IsNotFound(err) {
+		l.Info("Not retaining missing volume of PVC", "pvc", pi.SourceName, "volume", pi.Spec.VolumeName)
+		pi.RetainVolume = false
+		return pi, false, nil
+	}
+	if err != nil {
+		return pi, false, err
+	}
+	pi.SourceVolumeName = pv.Name
+	pi.SourceReclaimPolicy = pv.Spec.PersistentVolumeReclaimPolicy
+	return pi, false, nil
+}
+
+// releaseSourceVolume restores the reclaim policy of the retained volume of the original PVC.
+// With the policy `Delete`, Kubernetes deletes the released volume.
+// The restored PVC is verified first. If it is not bound to a new volume, the original volume is kept.
+func (r *StatefulSetReconciler) releaseSourceVolume(ctx context.Context, pi pvc.Entity) error {
+	if pi.SourceVolumeName == "" {
+		return nil
+	}
+	restored := corev1.PersistentVolumeClaim{}
+	if err := r.Get(ctx, client.ObjectKey{Name: pi.SourceName, Namespace: pi.Namespace}, &restored); err != nil {
+		return err
+	}
+	q := restored.Spec.Resources.Requests[corev1.ResourceStorage]
+	if restored.Spec.VolumeName == pi.SourceVolumeName || q.Cmp(pi.TargetSize) < 0 {
+		return CriticalError{
+			Err:           fmt.Errorf("restored PVC %s does not use a resized volume", pi.SourceName),
+			Event:         fmt.Sprintf("Restored PVC %s could not be verified. Kept the original volume %s", pi.SourceName, pi.SourceVolumeName),
+			SaveToScaleUp: true,
+		}
+	}
+	err := r.setReclaimPolicy(ctx, pi.SourceVolumeName, pi.SourceReclaimPolicy)
+	return client.IgnoreNotFound(err)
+}
+
+// applyRetainSource marks the PVCs whose original volume is retained until they are restored.
+// Rebound PVCs always keep their original volume, and the original of a migrated PVC is never deleted.
+func applyRetainSource(sts *statefulset.Entity, def bool) {
+	retain := sts.RetainSourceVolume(def)
+	for i, pi := range sts.Pvcs {
+		sts.Pvcs[i].RetainVolume = retain && !pi.Discard && !pi.Rebind && pi.TargetNamespace == ""
+	}
+}
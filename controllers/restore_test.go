@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
+)
+
+func TestRestoreRetainsSourceVolume(t *testing.T) {
+	tcs := map[string]struct {
+		restoredVolume string
+		critical       bool
+		policy         corev1.PersistentVolumeReclaimPolicy
+	}{
+		"released after restore": {
+			restoredVolume: "pv-new",
+			policy:         corev1.PersistentVolumeReclaimDelete,
+		},
+		"kept if not verified": {
+			restoredVolume: "pv-old",
+			critical:       true,
+			policy:         corev1.PersistentVolumeReclaimRetain,
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), RbacObjCtxKey, RbacObjects{})
+			require := require.New(t)
+			assert := assert.New(t)
+
+			source := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "data-web-0", Namespace: "foo"},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					VolumeName: "pv-old",
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1G")},
+					},
+				},
+			}
+			pv := &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "pv-old"},
+				Spec: corev1.PersistentVolumeSpec{
+					PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+				},
+			}
+			pi := pvc.NewEntity(*source, resource.MustParse("2G"), nil)
+			pi.RetainVolume = true
+			pi.BackedUp = true
+
+			c := fake.NewClientBuilder().WithScheme(scheme.Scheme).
+				WithObjects(source, pv).
+				Build()
+			r := StatefulSetReconciler{Client: c, Recorder: record.NewFakeRecorder(10)}
+			policy := func() corev1.PersistentVolumeReclaimPolicy {
+				found := corev1.PersistentVolume{}
+				require.NoError(c.Get(ctx, client.ObjectKey{Name: "pv-old"}, &found))
+				return found.Spec.PersistentVolumeReclaimPolicy
+			}
+
+			var done bool
+			var err error
+			pi, done, err = r.restorePVC(ctx, pi)
+			require.NoError(err)
+			assert.False(done)
+			assert.Equal("pv-old", pi.SourceVolumeName)
+			assert.Equal(corev1.PersistentVolumeReclaimDelete, pi.SourceReclaimPolicy)
+			assert.Equal(corev1.PersistentVolumeReclaimDelete, policy(), "recorded before changing")
+
+			pi, done, err = r.restorePVC(ctx, pi)
+			require.NoError(err)
+			assert.False(done)
+			assert.Equal(corev1.PersistentVolumeReclaimRetain, policy(), "retained before deleting the PVC")
+
+			pi, done, err = r.restorePVC(ctx, pi)
+			require.NoError(err)
+			assert.False(done)
+
+			restored := corev1.PersistentVolumeClaim{}
+			require.NoError(c.Get(ctx, client.ObjectKeyFromObject(source), &restored))
+			restored.Spec.VolumeName = tc.restoredVolume
+			require.NoError(c.Update(ctx, &restored))
+			job := batchv1.Job{}
+			require.NoError(c.Get(ctx, client.ObjectKey{Name: newJobName(pi.BackupName(), pi.SourceName), Namespace: "foo"}, &job))
+			job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+			require.NoError(c.Status().Update(ctx, &job))
+
+			pi, done, err = r.restorePVC(ctx, pi)
+			if tc.critical {
+				assert.NotNil(isCritical(err))
+				assert.False(pi.Restored)
+			} else {
+				require.NoError(err)
+				assert.True(done)
+				assert.True(pi.Restored)
+			}
+			assert.Equal(tc.policy, policy())
+		})
+	}
+}
+
+func TestRestoreWithoutSourceVolume(t *testing.T) {
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).Build()
+	r := StatefulSetReconciler{Client: c, Recorder: record.NewFakeRecorder(10)}
+	pi := pvc.NewEntity(corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data-web-0", Namespace: "foo"},
+		Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pv-missing"},
+	}, resource.MustParse("2G"), nil)
+	pi.RetainVolume = true
+	pi.BackedUp = true
+
+	pi, done, err := r.recordSourceVolume(context.Background(), pi)
+	require.NoError(t, err)
+	assert.False(t, done)
+	assert.False(t, pi.RetainVolume)
+	assert.Empty(t, pi.SourceVolumeName)
+}
@@ -0,0 +1,172 @@
+//go:build integration
+// +build integration
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+// simTimeout is the time a complete resize may take, it needs several requeues
+var simTimeout = time.Second * 30
+
+// TestSimulatedResizes runs complete resizes against envtest.
+// The simulated cluster drives the Jobs, PVCs and StatefulSets, instead of the test patching their status step by step.
+func TestSimulatedResizes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, stop := startTestReconciler(t, ctx, "")
+	defer stop()
+
+	sim := &clusterSim{Client: c, FailJob: func(_ int, job batchv1.Job) bool {
+		switch job.Namespace {
+		case "sim-backup-fails":
+			return job.Name == newJobName("data-test-0", "data-test-0-backup-1g")
+		case "sim-restore-fails":
+			return job.Name == newJobName("data-test-0-backup-1g", "data-test-0")
+		}
+		return false
+	}}
+	go sim.run(ctx, interval)
+
+	t.Run("e2e", func(t *testing.T) { // This allows the subtest to run in parallel
+		t.Run("Resize StatefulSet", func(t *testing.T) {
+			t.Parallel()
+			sts := newSimStatefulSet(t, ctx, c, "sim-resize", "test", 2, nil)
+			eventuallyResized(t, ctx, c, sts, 2)
+		})
+
+		t.Run("Resize StatefulSets in parallel", func(t *testing.T) {
+			t.Parallel()
+			createNamespace(t, ctx, c, "sim-parallel")
+			stss := []*appsv1.StatefulSet{}
+			for i := 0; i < 3; i++ {
+				stss = append(stss, newSimStatefulSet(t, ctx, c, "sim-parallel", fmt.Sprintf("test%d", i), 1, nil))
+			}
+			for _, sts := range stss {
+				eventuallyResized(t, ctx, c, sts, 1)
+			}
+		})
+
+		t.Run("Retain source volumes until restored", func(t *testing.T) {
+			t.Parallel()
+			sts := newSimStatefulSet(t, ctx, c, "sim-retain", "test", 1,
+				map[string]string{statefulset.RetainSourceAnnotation: "true"})
+			original := corev1.PersistentVolumeClaim{}
+			require.Eventually(t, func() bool {
+				err := c.Get(ctx, client.ObjectKey{Name: "data-test-0", Namespace: "sim-retain"}, &original)
+				return err == nil && original.Spec.VolumeName != ""
+			}, simTimeout, interval, "pvc bound")
+
+			eventuallyResized(t, ctx, c, sts, 1)
+			assert.Eventually(t, func() bool {
+				err := c.Get(ctx, client.ObjectKey{Name: original.Spec.VolumeName}, &corev1.PersistentVolume{})
+				return apierrors.IsNotFound(err)
+			}, simTimeout, interval, "original volume reclaimed")
+		})
+
+		t.Run("Scale up if the backup fails", func(t *testing.T) {
+			t.Parallel()
+			sts := newSimStatefulSet(t, ctx, c, "sim-backup-fails", "test", 1, nil)
+			eventuallyFailed(t, ctx, c, sts, 1)
+
+			source := corev1.PersistentVolumeClaim{}
+			require.NoError(t, c.Get(ctx, client.ObjectKey{Name: "data-test-0", Namespace: sts.Namespace}, &source))
+			q := source.Spec.Resources.Requests[corev1.ResourceStorage]
+			assert.Equal(t, "1G", q.String(), "original PVC kept")
+			assert.Equal(t, simData(sts, 0), source.Annotations[dataAnnotation])
+		})
+
+		t.Run("Stay scaled down if the restore fails", func(t *testing.T) {
+			t.Parallel()
+			sts := newSimStatefulSet(t, ctx, c, "sim-restore-fails", "test", 1, nil)
+			eventuallyFailed(t, ctx, c, sts, 0)
+
+			backup := corev1.PersistentVolumeClaim{}
+			require.NoError(t, c.Get(ctx, client.ObjectKey{Name: "data-test-0-backup-1g", Namespace: sts.Namespace}, &backup))
+			assert.Equal(t, simData(sts, 0), backup.Annotations[dataAnnotation], "backup kept")
+		})
+	})
+}
+
+func createNamespace(t *testing.T, ctx context.Context, c client.Client, ns string) {
+	err := c.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns}})
+	if !apierrors.IsAlreadyExists(err) {
+		require.NoError(t, err)
+	}
+}
+
+func simData(sts *appsv1.StatefulSet, ordinal int) string {
+	return fmt.Sprintf("%s/%s-%d", sts.Namespace, sts.Name, ordinal)
+}
+
+// newSimStatefulSet creates a StatefulSet requesting 2G, with PVCs of 1G holding data
+func newSimStatefulSet(t *testing.T, ctx context.Context, c client.Client, ns, name string, replicas int32, annotations map[string]string) *appsv1.StatefulSet {
+	createNamespace(t, ctx, c, ns)
+	sts := newTestStatefulSet(ns, name, replicas, "2G")
+	sts.Annotations = annotations
+	for i := 0; i < int(replicas); i++ {
+		require.NoError(t, c.Create(ctx, newSource(ns, fmt.Sprintf("data-%s-%d", name, i), "1G",
+			func(pvc *corev1.PersistentVolumeClaim) *corev1.PersistentVolumeClaim {
+				pvc.Labels = sts.Spec.Selector.MatchLabels
+				pvc.Annotations = map[string]string{dataAnnotation: simData(sts, i)}
+				return pvc
+			})))
+	}
+	require.NoError(t, c.Create(ctx, sts))
+	return sts
+}
+
+// eventuallyResized waits until the resize completed, and checks that all PVCs are resized with their data
+func eventuallyResized(t *testing.T, ctx context.Context, c client.Client, sts *appsv1.StatefulSet, replicas int32) {
+	require.Eventually(t, func() bool {
+		found := appsv1.StatefulSet{}
+		if err := c.Get(ctx, client.ObjectKeyFromObject(sts), &found); err != nil {
+			return false
+		}
+		si, err := statefulset.NewEntity(&found)
+		if err != nil {
+			return false
+		}
+		return found.Annotations[statefulset.PvcAnnotation] != "" && !si.Started() && !si.Resizing() &&
+			*found.Spec.Replicas == replicas
+	}, simTimeout, interval, "%s/%s resized", sts.Namespace, sts.Name)
+
+	for i := 0; i < int(replicas); i++ {
+		found := corev1.PersistentVolumeClaim{}
+		require.NoError(t, c.Get(ctx, client.ObjectKey{Name: fmt.Sprintf("data-%s-%d", sts.Name, i), Namespace: sts.Namespace}, &found))
+		q := found.Spec.Resources.Requests[corev1.ResourceStorage]
+		assert.Equal(t, "2G", q.String())
+		assert.Equal(t, simData(sts, i), found.Annotations[dataAnnotation])
+	}
+	jobs := batchv1.JobList{}
+	require.NoError(t, c.List(ctx, &jobs, client.InNamespace(sts.Namespace)))
+	for _, job := range jobs.Items {
+		assert.False(t, strings.Contains(job.Name, sts.Name) && job.DeletionTimestamp == nil, "job %s cleaned up", job.Name)
+	}
+}
+
+// eventuallyFailed waits until the resize failed, and checks the replicas of the StatefulSet
+func eventuallyFailed(t *testing.T, ctx context.Context, c client.Client, sts *appsv1.StatefulSet, replicas int32) {
+	found := appsv1.StatefulSet{}
+	require.Eventually(t, func() bool {
+		err := c.Get(ctx, client.ObjectKeyFromObject(sts), &found)
+		return err == nil && found.Labels[statefulset.FailedLabel] == "true"
+	}, simTimeout, interval, "%s/%s failed", sts.Namespace, sts.Name)
+	assert.Equal(t, replicas, *found.Spec.Replicas)
+}
@@ -0,0 +1,264 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// dataAnnotation stands in for the data on a volume. Completed copy Jobs copy it from their source to their destination.
+const dataAnnotation = "test/data"
+
+// pvcProtectionFinalizer is the finalizer Kubernetes adds to PVCs, which delays their deletion
+const pvcProtectionFinalizer = "kubernetes.io/pvc-protection"
+
+// clusterSim plays the part of kube-controller-manager in tests, both with the fake client and with envtest.
+// Every step binds PVCs to new volumes, reclaims released volumes, finishes the deletion of PVCs and Jobs,
+// completes the copy Jobs that can run, and updates the status of the StatefulSets to their replicas.
+type clusterSim struct {
+	client.Client
+
+	// FailJob decides whether the nth copy Job fails instead of completing, counting from 1.
+	// Jobs are counted by name, a recreated Job counts once.
+	FailJob func(n int, job batchv1.Job) bool
+	// DeletionDelay is the number of steps a deleted PVC stays terminating
+	DeletionDelay int
+	// Namespace limits the simulation to the objects of one namespace, all namespaces if empty
+	Namespace string
+
+	jobs        map[client.ObjectKey]bool
+	terminating map[client.ObjectKey]int
+	volumes     int
+}
+
+// run steps the simulated cluster every interval until the context is done.
+// Errors, such as conflicts with the controller, are retried in the next step.
+func (s *clusterSim) run(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+			_ = s.step(ctx)
+		}
+	}
+}
+
+func (s *clusterSim) step(ctx context.Context) error {
+	if s.jobs == nil {
+		s.jobs = map[client.ObjectKey]bool{}
+		s.terminating = map[client.ObjectKey]int{}
+	}
+	for _, f := range []func(context.Context) error{s.stepPVCs, s.stepVolumes, s.stepJobs, s.stepStatefulSets} {
+		if err := f(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stepPVCs binds PVCs to new volumes, and deletes terminating PVCs after the delay
+func (s *clusterSim) stepPVCs(ctx context.Context) error {
+	pvcs := corev1.PersistentVolumeClaimList{}
+	if err := s.List(ctx, &pvcs, client.InNamespace(s.Namespace)); err != nil {
+		return err
+	}
+	for _, p := range pvcs.Items {
+		p := p
+		key := client.ObjectKeyFromObject(&p)
+		if p.DeletionTimestamp != nil {
+			if s.terminating[key] < s.DeletionDelay {
+				s.terminating[key]++
+				continue
+			}
+			delete(s.terminating, key)
+			p.Finalizers = nil
+			if err := s.Update(ctx, &p); client.IgnoreNotFound(err) != nil {
+				return err
+			}
+			continue
+		}
+		if s.DeletionDelay > 0 && len(p.Finalizers) == 0 {
+			p.Finalizers = []string{pvcProtectionFinalizer}
+			if err := s.Update(ctx, &p); err != nil {
+				return err
+			}
+		}
+		if p.Spec.VolumeName == "" {
+			if err := s.bind(ctx, p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// bind provisions a new volume for the PVC
+func (s *clusterSim) bind(ctx context.Context, p corev1.PersistentVolumeClaim) error {
+	s.volumes++
+	pv := corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pv-%s-%d", p.Namespace, s.volumes)},
+		Spec: corev1.PersistentVolumeSpec{
+			AccessModes:                   p.Spec.AccessModes,
+			Capacity:                      corev1.ResourceList{corev1.ResourceStorage: p.Spec.Resources.Requests[corev1.ResourceStorage]},
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{Path: "/tmp/" + p.Name},
+			},
+			ClaimRef: &corev1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: p.Namespace, Name: p.Name, UID: p.UID},
+		},
+	}
+	if err := s.Create(ctx, &pv); err != nil {
+		return err
+	}
+	pv.Status.Phase = corev1.VolumeBound
+	if err := s.Status().Update(ctx, &pv); err != nil {
+		return err
+	}
+	p.Spec.VolumeName = pv.Name
+	if err := s.Update(ctx, &p); err != nil {
+		return err
+	}
+	p.Status.Phase = corev1.ClaimBound
+	p.Status.Capacity = pv.Spec.Capacity
+	return s.Status().Update(ctx, &p)
+}
+
+// stepVolumes reclaims the volumes whose PVC was deleted
+func (s *clusterSim) stepVolumes(ctx context.Context) error {
+	pvs := corev1.PersistentVolumeList{}
+	if err := s.List(ctx, &pvs); err != nil {
+		return err
+	}
+	for _, pv := range pvs.Items {
+		pv := pv
+		if pv.Spec.ClaimRef == nil || pv.Status.Phase == corev1.VolumeReleased ||
+			(s.Namespace != "" && pv.Spec.ClaimRef.Namespace != s.Namespace) {
+			continue
+		}
+		claim := corev1.PersistentVolumeClaim{}
+		err := s.Get(ctx, client.ObjectKey{Name: pv.Spec.ClaimRef.Name, Namespace: pv.Spec.ClaimRef.Namespace}, &claim)
+		if err == nil && claim.UID == pv.Spec.ClaimRef.UID {
+			continue
+		}
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		if pv.Spec.PersistentVolumeReclaimPolicy == corev1.PersistentVolumeReclaimDelete {
+			if err := s.Delete(ctx, &pv); client.IgnoreNotFound(err) != nil {
+				return err
+			}
+			continue
+		}
+		pv.Status.Phase = corev1.VolumeReleased
+		if err := s.Status().Update(ctx, &pv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stepJobs finishes the deletion of Jobs, and runs the copy Jobs whose PVCs can be mounted
+func (s *clusterSim) stepJobs(ctx context.Context) error {
+	jobs := batchv1.JobList{}
+	if err := s.List(ctx, &jobs, client.InNamespace(s.Namespace)); err != nil {
+		return err
+	}
+	for _, job := range jobs.Items {
+		job := job
+		if job.DeletionTimestamp != nil {
+			// There are no pods the garbage collector would have to wait for
+			job.Finalizers = nil
+			if err := s.Update(ctx, &job); client.IgnoreNotFound(err) != nil {
+				return err
+			}
+			continue
+		}
+		if len(job.Status.Conditions) > 0 {
+			continue
+		}
+		claims := map[string]string{}
+		for _, v := range job.Spec.Template.Spec.Volumes {
+			if v.PersistentVolumeClaim != nil {
+				claims[v.Name] = v.PersistentVolumeClaim.ClaimName
+			}
+		}
+		src, srcErr := s.claim(ctx, job.Namespace, claims["src"])
+		dst, dstErr := s.claim(ctx, job.Namespace, claims["dst"])
+		if srcErr != nil || dstErr != nil {
+			// The pod can not start
+			continue
+		}
+		s.jobs[client.ObjectKeyFromObject(&job)] = true
+		cond := batchv1.JobComplete
+		if s.FailJob != nil && s.FailJob(len(s.jobs), job) {
+			cond = batchv1.JobFailed
+		} else {
+			if dst.Annotations == nil {
+				dst.Annotations = map[string]string{}
+			}
+			dst.Annotations[dataAnnotation] = src.Annotations[dataAnnotation]
+			if err := s.Update(ctx, &dst); err != nil {
+				return err
+			}
+		}
+		job.Status.Conditions = []batchv1.JobCondition{{Type: cond, Status: corev1.ConditionTrue}}
+		if err := s.Status().Update(ctx, &job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claim returns the PVC, if it can be mounted
+func (s *clusterSim) claim(ctx context.Context, namespace, name string) (corev1.PersistentVolumeClaim, error) {
+	p := corev1.PersistentVolumeClaim{}
+	if err := s.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, &p); err != nil {
+		return p, err
+	}
+	if p.DeletionTimestamp != nil || p.Spec.VolumeName == "" {
+		return p, apierrors.NewNotFound(corev1.Resource("persistentvolumeclaims"), name)
+	}
+	return p, nil
+}
+
+// stepStatefulSets updates the status of the StatefulSets, as if all their pods were running
+func (s *clusterSim) stepStatefulSets(ctx context.Context) error {
+	stss := appsv1.StatefulSetList{}
+	if err := s.List(ctx, &stss, client.InNamespace(s.Namespace)); err != nil {
+		return err
+	}
+	for _, sts := range stss.Items {
+		sts := sts
+		replicas := int32(1)
+		if sts.Spec.Replicas != nil {
+			replicas = *sts.Spec.Replicas
+		}
+		status := appsv1.StatefulSetStatus{
+			ObservedGeneration: sts.Generation,
+			Replicas:           replicas,
+			ReadyReplicas:      replicas,
+			AvailableReplicas:  replicas,
+			CurrentReplicas:    replicas,
+			UpdatedReplicas:    replicas,
+			CurrentRevision:    sts.Name + "-1",
+			UpdateRevision:     sts.Name + "-1",
+		}
+		if reflect.DeepEqual(sts.Status, status) {
+			continue
+		}
+		sts.Status = status
+		if err := s.Status().Update(ctx, &sts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -4,15 +4,21 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"reflect"
 
 	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	"github.com/vshn/statefulset-resize-controller/statefulset"
 )
 
+// fieldOwner is the field manager of the changes the controller makes to StatefulSets
+const fieldOwner = client.FieldOwner("statefulset-resize-controller")
+
 // CriticalError is an unrecoverable error.
 type CriticalError struct {
 	Err           error
@@ -49,42 +55,172 @@ func (r StatefulSetReconciler) fetchStatefulSet(ctx context.Context, namespacedN
 		return nil, err
 	}
 
-	if !sts.Resizing() {
-		sts.Pvcs, err = fetchResizablePVCs(ctx, r.Client, *sts)
+	// Until the resize started, we always look at the current state of the PVCs.
+	// The StatefulSet might have changed while waiting for approval.
+	if !sts.Started() {
+		if ns := sts.MigrateTo(); ns != "" {
+			sts.Pvcs, err = fetchMigratablePVCs(ctx, r.Client, *sts, ns, r.OutOfRangePolicy)
+			return sts, err
+		}
+		planned := sts.Pvcs
+		sts.Pvcs, err = fetchResizablePVCs(ctx, r.Client, *sts, r.OutOfRangePolicy)
+		applyCopyMode(ctx, sts, r.CopyMode)
+		applyRetainSource(sts, r.RetainSourceVolumes)
+		sts.Pvcs = keepPrecopied(planned, sts.Pvcs)
 		return sts, err
 	}
 	return sts, nil
 }
 
+func (r StatefulSetReconciler) clearStalePlan(ctx context.Context, sts *statefulset.Entity) error {
+	if sts.Old.Annotations[statefulset.PvcAnnotation] == "" &&
+		sts.Old.Annotations[statefulset.HooksCompletedAnnotation] == "" {
+		return nil
+	}
+	sts.ResetHooks()
+	return r.updateStatefulSet(ctx, sts, nil)
+}
+
 func (r StatefulSetReconciler) resizeStatefulSet(ctx context.Context, sts *statefulset.Entity) (bool, error) {
 	stsv1, err := sts.StatefulSet()
 	if err != nil {
 		return false, err
 	}
 	l := log.FromContext(ctx).WithValues("statefulset", fmt.Sprintf("%s/%s", stsv1.Namespace, stsv1.Name))
+	ctx = context.WithValue(ctx, EventTargetCtxKey, sts.Old)
 
+	if !sts.Started() {
+		r.reportDetected(sts)
+		if sts.PrecopyEnabled(r.Precopy) {
+			done, err := r.precopyPVCs(ctx, sts)
+			if err != nil || !done {
+				return false, r.updateStatefulSet(ctx, sts, err)
+			}
+		}
+		done, err := r.runHook(ctx, sts, statefulset.HookPreScaleDown)
+		if err != nil || !done {
+			return false, r.updateStatefulSet(ctx, sts, err)
+		}
+		if err := r.pauseHPAs(ctx, sts); err != nil {
+			return false, err
+		}
+	}
+	if sts.ScaledExternally() {
+		return false, r.updateStatefulSet(ctx, sts, r.abortExternallyScaled(ctx, sts))
+	}
+
+	// An abort drops the PVCs whose original is still intact.
+	// The others were already replaced and are restored first.
+	aborting := sts.Started() && sts.AbortRequested()
+	if aborting {
+		if err := r.abortPVCs(ctx, sts); err != nil {
+			return false, r.updateStatefulSet(ctx, sts, err)
+		}
+		if len(sts.Pvcs) == 0 {
+			return r.finishAbort(ctx, sts)
+		}
+	}
+
+	started := sts.Started()
 	done := sts.PrepareScaleDown()
 	if !done {
-		return done, r.updateStatefulSet(ctx, sts, nil)
+		err := r.updateStatefulSet(ctx, sts, nil)
+		if err == nil && !started {
+			r.event(ctx, "ScalingDown", "Scaling down from %s replicas to resize PVCs %s",
+				stsv1.Annotations[statefulset.ReplicasAnnotation], describePVCSizes(sts.Pvcs))
+		}
+		return done, err
 	}
 
 	objs, err := r.createRbacObjs(ctx, sts)
 	if err != nil {
 		return false, err
 	}
+	ctx = context.WithValue(ctx, RbacObjCtxKey, objs)
+
+	// All PVCs are backed up before we touch any of the original PVCs
+	sts.Pvcs, done, err = r.backupPVCs(ctx, sts.Pvcs)
+	if err != nil || !done {
+		return false, r.updateStatefulSet(ctx, sts, err)
+	}
+	done, err = r.runHook(ctx, sts, statefulset.HookPostBackup)
+	if err != nil || !done {
+		return false, r.updateStatefulSet(ctx, sts, err)
+	}
 
-	sts.Pvcs, err = r.resizePVCs(context.WithValue(ctx, RbacObjCtxKey, objs), sts.Pvcs)
+	sts.Pvcs, err = r.restorePVCs(ctx, sts.Pvcs)
 	if err != nil || len(sts.Pvcs) > 0 {
-		return len(sts.Pvcs) == 0, r.updateStatefulSet(ctx, sts, err)
+		return false, r.updateStatefulSet(ctx, sts, err)
+	}
+	// The completed restore is recorded before the StatefulSet is changed
+	checkpointed, err := sts.Checkpointed()
+	if err != nil || !checkpointed {
+		return false, r.updateStatefulSet(ctx, sts, err)
 	}
 
 	err = r.deleteRbacObjs(ctx, objs)
 	if err != nil {
 		l.Info("Failed to delete Job RBAC objects", "error", err)
 	}
+	if aborting {
+		return r.finishAbort(ctx, sts)
+	}
+
+	// A migrated StatefulSet stays scaled down, its data now lives in another namespace
+	if sts.Migrating() {
+		ns := sts.MigrateTo()
+		replicas, err := sts.FinishMigration()
+		if err != nil {
+			return false, r.updateStatefulSet(ctx, sts, err)
+		}
+		r.Recorder.Event(sts.Old, "Normal", "Migrated",
+			fmt.Sprintf("Migrated PVCs to namespace %s. The StatefulSet stays scaled down, it had %d replicas", ns, replicas))
+		return true, r.updateStatefulSet(ctx, sts, nil)
+	}
 
-	done, err = sts.PrepareScaleUp()
-	return done, r.updateStatefulSet(ctx, sts, err)
+	// If the resize was requested through annotations, the templates still request the old size.
+	// We update them now that the data is migrated, and continue with the recreated StatefulSet.
+	desired, requested, err := sts.ApplyTargetSizes()
+	if err != nil {
+		return false, err
+	}
+	if requested {
+		current, err := sts.StatefulSet()
+		if err != nil {
+			return false, err
+		}
+		return false, r.recreateStatefulSet(ctx, current, desired)
+	}
+	done, err = r.scaleUp(ctx, sts)
+	if done && err == nil {
+		r.event(ctx, "ResizeSucceeded", "Resized StatefulSet, its volumeClaimTemplates request %s", describeTemplateSizes(sts.Old))
+	}
+	return done, err
+}
+
+// scaleUp runs the post-scale-up hook and resumes the autoscalers once the StatefulSet is scaled back up
+func (r StatefulSetReconciler) scaleUp(ctx context.Context, sts *statefulset.Entity) (bool, error) {
+	scaledUp, err := sts.ScaledUp()
+	if err != nil {
+		return false, r.updateStatefulSet(ctx, sts, err)
+	}
+	if scaledUp {
+		done, err := r.runHook(ctx, sts, statefulset.HookPostScaleUp)
+		if err != nil || !done {
+			return false, r.updateStatefulSet(ctx, sts, err)
+		}
+		if err := r.resumeHPAs(ctx, sts); err != nil {
+			return false, err
+		}
+	}
+
+	scalingUp := sts.ScalingUp()
+	done, err := sts.PrepareScaleUp()
+	err = r.updateStatefulSet(ctx, sts, err)
+	if err == nil && !scalingUp && sts.ScalingUp() {
+		r.event(ctx, "ScalingUp", "Scaling up to %s replicas", sts.Old.Annotations[statefulset.ReplicasAnnotation])
+	}
+	return done, err
 }
 
 func (r StatefulSetReconciler) updateStatefulSet(ctx context.Context, si *statefulset.Entity, resizeErr error) error {
@@ -94,22 +230,56 @@ func (r StatefulSetReconciler) updateStatefulSet(ctx context.Context, si *statef
 	}
 	l := log.FromContext(ctx).WithValues("statefulset", fmt.Sprintf("%s/%s", sts.Namespace, sts.Name))
 	if resizeErr != nil {
-		l.Error(err, "failed to resize statefulset")
+		l.Error(resizeErr, "failed to resize statefulset")
 	}
 	if cerr := isCritical(resizeErr); cerr != nil {
 		si.SetFailed()
 		if cerr.SaveToScaleUp {
 			// If we fail here there is not much to do
-			if _, err = si.PrepareScaleUp(); err != nil {
+			if _, err = si.ScaleUpAfterFailure(); err != nil {
 				l.Error(err, "failed to scale up statefulset")
+			} else if err := r.resumeHPAs(ctx, si); err != nil {
+				// Reconcile retries resuming them for the failed StatefulSet
+				l.Error(err, "failed to resume HorizontalPodAutoscalers")
 			}
 		}
 		r.Recorder.Event(sts, "Warning", "ResizeFailed", cerr.Event)
 	}
-	if !reflect.DeepEqual(sts.Annotations, si.Old.Annotations) ||
-		!reflect.DeepEqual(sts.Spec, si.Old.Spec) ||
-		!reflect.DeepEqual(sts.Labels, si.Old.Labels) {
-		return r.Client.Update(ctx, sts)
+	if err := si.UpdateConditions(metav1.Now()); err != nil {
+		return err
+	}
+	if !si.Modified() {
+		return nil
 	}
-	return nil
+	return r.patchStatefulSet(ctx, si)
+}
+
+// patchStatefulSet writes the fields managed by the controller with a merge patch.
+// The patch is rejected with a conflict if the StatefulSet changed since it was read.
+// If only fields of others changed, such as the status written by kube-controller-manager, the patch is retried on the current StatefulSet.
+// Otherwise the state of the entity is stale, and the conflict is returned so the next reconcile starts over.
+func (r StatefulSetReconciler) patchStatefulSet(ctx context.Context, si *statefulset.Entity) error {
+	base := si.Old
+	stale := false
+	return retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsConflict(err) && !stale
+	}, func() error {
+		if base == nil {
+			current := &appsv1.StatefulSet{}
+			if err := r.Get(ctx, client.ObjectKeyFromObject(si.Old), current); err != nil {
+				return err
+			}
+			if si.ChangedIn(current) {
+				stale = true
+				return apierrors.NewConflict(appsv1.Resource("statefulsets"), si.Old.Name,
+					fmt.Errorf("the StatefulSet was changed by someone else"))
+			}
+			base = current
+		}
+		err := r.Patch(ctx, si.ApplyTo(base), client.MergeFromWithOptions(base, client.MergeFromWithOptimisticLock{}), fieldOwner)
+		if apierrors.IsConflict(err) {
+			base = nil
+		}
+		return err
+	})
 }
@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+func TestUpdateStatefulSetConcurrently(t *testing.T) {
+	ctx := context.Background()
+	tcs := map[string]struct {
+		// change is made by someone else, after the controller read the StatefulSet
+		change func(sts *appsv1.StatefulSet)
+		stale  bool
+	}{
+		"unchanged": {
+			change: nil,
+		},
+		"others changed": {
+			change: func(sts *appsv1.StatefulSet) {
+				sts.Annotations = map[string]string{"other": "true"}
+				sts.Labels = map[string]string{"other": "true"}
+				sts.Spec.Template.Labels["other"] = "true"
+			},
+		},
+		"abort requested": {
+			change: func(sts *appsv1.StatefulSet) {
+				sts.Annotations = map[string]string{statefulset.AbortAnnotation: "true"}
+			},
+			stale: true,
+		},
+		"scaled": {
+			change: func(sts *appsv1.StatefulSet) {
+				r := int32(3)
+				sts.Spec.Replicas = &r
+			},
+			stale: true,
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(newFaultStatefulSet()).Build()
+			r := StatefulSetReconciler{Client: c, Recorder: &record.FakeRecorder{}}
+			key := client.ObjectKey{Name: "web", Namespace: "foo"}
+
+			read := &appsv1.StatefulSet{}
+			require.NoError(t, c.Get(ctx, key, read))
+			si, err := statefulset.NewEntity(read)
+			require.NoError(t, err)
+			if tc.change != nil {
+				other := &appsv1.StatefulSet{}
+				require.NoError(t, c.Get(ctx, key, other))
+				tc.change(other)
+				require.NoError(t, c.Update(ctx, other))
+			}
+
+			require.False(t, si.PrepareScaleDown())
+			err = r.updateStatefulSet(ctx, si, nil)
+
+			found := &appsv1.StatefulSet{}
+			require.NoError(t, c.Get(ctx, key, found))
+			if tc.stale {
+				assert.True(t, apierrors.IsConflict(err), "stale state is not written: %v", err)
+				assert.Empty(t, found.Annotations[statefulset.ReplicasAnnotation])
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, int32(0), *found.Spec.Replicas)
+			assert.Equal(t, "2", found.Annotations[statefulset.ReplicasAnnotation])
+			if tc.change != nil {
+				assert.Equal(t, "true", found.Annotations["other"], "annotations of others are kept")
+				assert.Equal(t, "true", found.Labels["other"], "labels of others are kept")
+				assert.Equal(t, "true", found.Spec.Template.Labels["other"], "spec changes of others are kept")
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+// applyDesiredTemplates recreates the StatefulSet if the desired volumeClaimTemplates set through annotations differ from the current ones.
+// It returns true if the StatefulSet is being recreated or the desired templates are invalid, and the resize must not proceed.
+func (r StatefulSetReconciler) applyDesiredTemplates(ctx context.Context, sts *statefulset.Entity) (bool, error) {
+	inline, cmName := sts.DesiredTemplates()
+	if inline == "" && cmName == "" {
+		return false, nil
+	}
+	raw := inline
+	source := fmt.Sprintf("annotation %s", statefulset.TemplatesAnnotation)
+	if cmName != "" {
+		cm := corev1.ConfigMap{}
+		err := r.Get(ctx, client.ObjectKey{Name: cmName, Namespace: sts.Old.Namespace}, &cm)
+		if err != nil {
+			if client.IgnoreNotFound(err) != nil {
+				return true, err
+			}
+			r.Recorder.Event(sts.Old, "Warning", "InvalidVolumeClaimTemplates", fmt.Sprintf("Not resizing, ConfigMap %s not found", cmName))
+			return true, nil
+		}
+		raw = cm.Data[statefulset.TemplatesKey]
+		source = fmt.Sprintf("ConfigMap %s", cmName)
+	}
+
+	tpls, err := statefulset.ParseTemplates(raw)
+	if err != nil {
+		r.Recorder.Event(sts.Old, "Warning", "InvalidVolumeClaimTemplates", fmt.Sprintf("Not resizing, invalid volumeClaimTemplates in %s: %s", source, err))
+		return true, nil
+	}
+	if statefulset.TemplatesMatch(sts.Old.Spec.VolumeClaimTemplates, tpls) {
+		return false, nil
+	}
+
+	desired, err := sts.WithTemplates(tpls)
+	if err != nil {
+		return true, err
+	}
+	return true, r.recreateStatefulSet(ctx, sts.Old, desired)
+}
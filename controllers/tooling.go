@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"context"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+// The functions in this file expose the logic of the controller to other tools, such as the kubectl plugin.
+
+// PlanResize returns the PVCs the controller would resize if the StatefulSet was reconciled now.
+// The policy and mode are the defaults of the controller.
+func PlanResize(ctx context.Context, cl client.Client, sts *statefulset.Entity, policy statefulset.OutOfRangePolicy, mode statefulset.CopyMode) ([]pvc.Entity, error) {
+	if ns := sts.MigrateTo(); ns != "" {
+		return fetchMigratablePVCs(ctx, cl, *sts, ns, policy)
+	}
+	planned := *sts
+	pvcs, err := fetchResizablePVCs(ctx, cl, planned, policy)
+	if err != nil {
+		return nil, err
+	}
+	planned.Pvcs = pvcs
+	applyCopyMode(ctx, &planned, mode)
+	return planned.Pvcs, nil
+}
+
+// DescribePlan returns a human readable summary of the resize planned for the StatefulSet
+func DescribePlan(sts *statefulset.Entity) string {
+	return describePlan(sts)
+}
+
+// ReplacedSources returns the names of the PVCs whose original was already deleted or replaced.
+// Until these PVCs are restored, their data only exists in their backup.
+func ReplacedSources(ctx context.Context, cl client.Client, pvcs []pvc.Entity) ([]string, error) {
+	r := StatefulSetReconciler{Client: cl}
+	replaced := []string{}
+	for _, pi := range pvcs {
+		if pi.Restored || pi.Discard {
+			continue
+		}
+		intact, err := r.sourceIntact(ctx, pi)
+		if err != nil {
+			return nil, err
+		}
+		if !intact {
+			replaced = append(replaced, pi.SourceName)
+		}
+	}
+	return replaced, nil
+}
+
+// Backups returns the backup PVCs of all PVCs of the StatefulSet
+func Backups(ctx context.Context, cl client.Client, sts *statefulset.Entity) ([]corev1.PersistentVolumeClaim, error) {
+	pvcs := corev1.PersistentVolumeClaimList{}
+	if err := cl.List(ctx, &pvcs, client.InNamespace(sts.Old.Namespace)); err != nil {
+		return nil, err
+	}
+	managed := corev1.PersistentVolumeClaimList{}
+	if err := cl.List(ctx, &managed, client.InNamespace(sts.Old.Namespace), client.MatchingLabels{pvc.ManagedLabel: "true"}); err != nil {
+		return nil, err
+	}
+
+	others, err := listStatefulSets(ctx, cl, sts.Old.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []corev1.PersistentVolumeClaim{}
+	for _, b := range managed.Items {
+		for _, p := range pvcs.Items {
+			if _, _, ok := matchPVC(ctx, *sts.Old, others, p); ok && pvc.IsBackupOf(b.Name, p.Name) {
+				backups = append(backups, b)
+				break
+			}
+		}
+	}
+	return backups, nil
+}
+
+// ResumeAutoscalers restores the bounds of the HorizontalPodAutoscalers paused for the resize of the StatefulSet
+func ResumeAutoscalers(ctx context.Context, cl client.Client, sts *statefulset.Entity) error {
+	r := StatefulSetReconciler{Client: cl}
+	return r.resumeHPAs(ctx, sts)
+}
+
+// FailedJobs returns the failed copy and hook Jobs of the resize of the StatefulSet.
+// The controller never recreates a Job that exists, so they have to be deleted to retry the resize.
+func FailedJobs(ctx context.Context, cl client.Client, sts *statefulset.Entity) ([]batchv1.Job, error) {
+	keys := []client.ObjectKey{}
+	for _, h := range []statefulset.Hook{statefulset.HookPreScaleDown, statefulset.HookPostBackup, statefulset.HookPostScaleUp} {
+		keys = append(keys, client.ObjectKey{Name: newHookJobName(sts.Old.Name, h), Namespace: sts.Old.Namespace})
+	}
+	for _, pi := range sts.Pvcs {
+		for _, name := range []string{
+			newJobName(pi.SourceName, pi.BackupName()),
+			newJobName(pi.BackupName(), pi.SourceName),
+			newJobName(pi.SourceName, pi.TargetName()),
+		} {
+			keys = append(keys, client.ObjectKey{Name: name, Namespace: pi.Namespace})
+		}
+		for _, src := range []string{pi.SourceName, pi.CloneName()} {
+			for _, dst := range []string{pi.BackupName(), pi.TargetName()} {
+				keys = append(keys, client.ObjectKey{Name: newPrecopyJobName(src, dst), Namespace: pi.Namespace})
+			}
+		}
+		if pi.TargetNamespace != "" {
+			name := newMigrationName(pi.SourceName)
+			keys = append(keys,
+				client.ObjectKey{Name: name + "-client", Namespace: pi.Namespace},
+				client.ObjectKey{Name: name + "-server", Namespace: pi.TargetNamespace})
+		}
+	}
+
+	failed := []batchv1.Job{}
+	for _, key := range keys {
+		job := batchv1.Job{}
+		err := cl.Get(ctx, key, &job)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := isJobDone(job); err != nil {
+			failed = append(failed, job)
+		}
+	}
+	return failed, nil
+}
@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/vshn/statefulset-resize-controller/schedule"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+// AccessModesAnnotation lists the access modes a StorageClass supports, separated by commas.
+// Kubernetes does not know which access modes a provisioner supports. Without the annotation, all access modes are accepted.
+const AccessModesAnnotation = "sts-resize.vshn.net/access-modes"
+
+// StatefulSetValidator validates StatefulSets on admission, to reject resizes that can not complete.
+// It rejects malformed resize annotations and target StorageClasses that do not exist or do not support the access modes of the PVCs.
+// It warns about PVCs that can not shrink, and lists the PVCs an admitted StatefulSet will resize.
+type StatefulSetValidator struct {
+	client.Client
+
+	// OutOfRangePolicy and CopyMode are the defaults of the controller, to compute the same plan.
+	OutOfRangePolicy statefulset.OutOfRangePolicy
+	CopyMode         statefulset.CopyMode
+}
+
+//+kubebuilder:webhook:path=/validate-apps-v1-statefulset,mutating=false,failurePolicy=ignore,sideEffects=None,groups=apps,resources=statefulsets,verbs=create;update,versions=v1,name=vstatefulset.sts-resize.vshn.net,admissionReviewVersions=v1
+
+// SetupWebhookWithManager registers the webhook with the Manager.
+func (v *StatefulSetValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&appsv1.StatefulSet{}).
+		WithValidator(v).
+		Complete()
+}
+
+// ValidateCreate implements admission.CustomValidator
+func (v *StatefulSetValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return v.validate(ctx, obj)
+}
+
+// ValidateUpdate implements admission.CustomValidator
+func (v *StatefulSetValidator) ValidateUpdate(ctx context.Context, _, newObj runtime.Object) (admission.Warnings, error) {
+	return v.validate(ctx, newObj)
+}
+
+// ValidateDelete implements admission.CustomValidator
+func (v *StatefulSetValidator) ValidateDelete(context.Context, runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (v *StatefulSetValidator) validate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	sts, ok := obj.(*appsv1.StatefulSet)
+	if !ok {
+		return nil, fmt.Errorf("expected a StatefulSet, got %T", obj)
+	}
+	si, err := statefulset.NewEntity(sts)
+	if err != nil {
+		return nil, err
+	}
+	if si.Started() || si.Failed() {
+		// The controller updates the StatefulSet while resizing, we must never get in its way
+		return nil, nil
+	}
+
+	invalid := validateAnnotations(*si)
+	pvcs := corev1.PersistentVolumeClaimList{}
+	if err := v.List(ctx, &pvcs, client.InNamespace(sts.Namespace)); err != nil {
+		return nil, err
+	}
+	others, err := listStatefulSets(ctx, v.Client, sts.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	warnings := shrinkWarnings(ctx, *sts, others, pvcs.Items)
+
+	si.Pvcs = filterResizablePVCs(ctx, *si, others, pvcs.Items, v.OutOfRangePolicy)
+	applyCopyMode(ctx, si, v.CopyMode)
+	for _, pi := range si.Pvcs {
+		if pi.Discard || pi.TargetStorageClass == nil || *pi.TargetStorageClass == "" {
+			continue
+		}
+		sc := storagev1.StorageClass{}
+		err := v.Get(ctx, client.ObjectKey{Name: *pi.TargetStorageClass}, &sc)
+		if apierrors.IsNotFound(err) {
+			invalid = append(invalid, fmt.Sprintf("StorageClass %s of PVC %s does not exist", sc.Name, pi.SourceName))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if modes := unsupportedAccessModes(sc, pi.Spec.AccessModes); len(modes) > 0 {
+			invalid = append(invalid, fmt.Sprintf("StorageClass %s does not support access modes %s of PVC %s",
+				sc.Name, strings.Join(modes, ", "), pi.SourceName))
+		}
+	}
+	if len(invalid) > 0 {
+		return warnings, fmt.Errorf("resize can not complete: %s", strings.Join(invalid, "; "))
+	}
+	if len(si.Pvcs) > 0 {
+		warnings = append(warnings, describePlan(si))
+	}
+	return warnings, nil
+}
+
+// validateAnnotations returns the problems with the resize annotations of the StatefulSet
+func validateAnnotations(si statefulset.Entity) []string {
+	invalid := []string{}
+	if _, err := si.OutOfRangePolicy(statefulset.OutOfRangeResize); err != nil {
+		invalid = append(invalid, err.Error())
+	}
+	if _, err := si.CopyMode(statefulset.CopyModeBackup); err != nil {
+		invalid = append(invalid, err.Error())
+	}
+	if w, ok := si.MaintenanceWindow(); ok {
+		if _, err := schedule.Parse(w); err != nil {
+			invalid = append(invalid, err.Error())
+		}
+	}
+	if inline, _ := si.DesiredTemplates(); inline != "" {
+		if _, err := statefulset.ParseTemplates(inline); err != nil {
+			invalid = append(invalid, err.Error())
+		}
+	}
+	for _, tpl := range si.Old.Spec.VolumeClaimTemplates {
+		if _, err := statefulset.TargetSize(*si.Old, tpl); err != nil {
+			invalid = append(invalid, err.Error())
+		}
+	}
+	return invalid
+}
+
+// shrinkWarnings warns about PVCs that are larger than requested, as PVCs can only grow
+func shrinkWarnings(ctx context.Context, sts appsv1.StatefulSet, others []appsv1.StatefulSet, pvcs []corev1.PersistentVolumeClaim) []string {
+	warnings := []string{}
+	for _, p := range pvcs {
+		tpl, _, ok := matchPVC(ctx, sts, others, p)
+		if !ok {
+			continue
+		}
+		size, err := statefulset.TargetSize(sts, tpl)
+		if err != nil {
+			continue
+		}
+		current := p.Spec.Resources.Requests[corev1.ResourceStorage]
+		if current.Cmp(size) > 0 {
+			warnings = append(warnings, fmt.Sprintf("PVC %s requests %s and can not shrink to %s", p.Name, current.String(), size.String()))
+		}
+	}
+	return warnings
+}
+
+// unsupportedAccessModes returns the access modes the StorageClass does not support according to its annotation
+func unsupportedAccessModes(sc storagev1.StorageClass, modes []corev1.PersistentVolumeAccessMode) []string {
+	v, ok := sc.Annotations[AccessModesAnnotation]
+	if !ok {
+		return nil
+	}
+	supported := map[string]bool{}
+	for _, m := range strings.Split(v, ",") {
+		supported[strings.TrimSpace(m)] = true
+	}
+	unsupported := []string{}
+	for _, m := range modes {
+		if !supported[string(m)] {
+			unsupported = append(unsupported, string(m))
+		}
+	}
+	return unsupported
+}
@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+func TestValidateStatefulSet(t *testing.T) {
+	ssd := "ssd"
+	missing := "missing"
+	storageClass := &storagev1.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        ssd,
+			Annotations: map[string]string{AccessModesAnnotation: "ReadWriteOnce, ReadOnlyMany"},
+		},
+	}
+	newPVC := func(name, size string, mode corev1.PersistentVolumeAccessMode) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "foo", Labels: map[string]string{"app": "web"}},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				AccessModes:      []corev1.PersistentVolumeAccessMode{mode},
+				StorageClassName: &ssd,
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(size)},
+				},
+			},
+		}
+	}
+
+	tcs := map[string]struct {
+		annotations  map[string]string
+		storageClass *string
+		pvcs         []*corev1.PersistentVolumeClaim
+		warnings     []string
+		invalid      bool
+	}{
+		"nothing to resize": {
+			pvcs: []*corev1.PersistentVolumeClaim{newPVC("data-web-0", "2G", corev1.ReadWriteOnce)},
+		},
+		"planned resize": {
+			pvcs: []*corev1.PersistentVolumeClaim{newPVC("data-web-0", "1G", corev1.ReadWriteOnce)},
+			warnings: []string{
+				"Planned resize of 1 PVCs (data-web-0 1G -> 2G), copying up to 2G",
+			},
+		},
+		"can not shrink": {
+			pvcs: []*corev1.PersistentVolumeClaim{newPVC("data-web-0", "3G", corev1.ReadWriteOnce)},
+			warnings: []string{
+				"PVC data-web-0 requests 3G and can not shrink to 2G",
+			},
+		},
+		"missing storage class": {
+			storageClass: &missing,
+			pvcs:         []*corev1.PersistentVolumeClaim{newPVC("data-web-0", "1G", corev1.ReadWriteOnce)},
+			invalid:      true,
+		},
+		"unsupported access mode": {
+			pvcs:    []*corev1.PersistentVolumeClaim{newPVC("data-web-0", "1G", corev1.ReadWriteMany)},
+			invalid: true,
+		},
+		"malformed plan": {
+			annotations: map[string]string{statefulset.PvcAnnotation: "{"},
+			invalid:     true,
+		},
+		"malformed target size": {
+			annotations: map[string]string{statefulset.TargetSizeAnnotation: "large"},
+			invalid:     true,
+		},
+		"malformed copy mode": {
+			annotations: map[string]string{statefulset.CopyModeAnnotation: "teleport"},
+			invalid:     true,
+		},
+		"malformed maintenance window": {
+			annotations: map[string]string{statefulset.MaintenanceWindowAnnotation: "always"},
+			invalid:     true,
+		},
+		"resize in progress": {
+			annotations: map[string]string{statefulset.ReplicasAnnotation: "1"},
+			pvcs:        []*corev1.PersistentVolumeClaim{newPVC("data-web-0", "1G", corev1.ReadWriteMany)},
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			class := &ssd
+			if tc.storageClass != nil {
+				class = tc.storageClass
+			}
+			sts := &appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "foo", Annotations: tc.annotations},
+				Spec: appsv1.StatefulSetSpec{
+					Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+					VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{
+						ObjectMeta: metav1.ObjectMeta{Name: "data"},
+						Spec: corev1.PersistentVolumeClaimSpec{
+							StorageClassName: class,
+							Resources: corev1.ResourceRequirements{
+								Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("2G")},
+							},
+						},
+					}},
+				},
+			}
+			b := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(storageClass)
+			for _, p := range tc.pvcs {
+				b = b.WithObjects(p)
+			}
+			v := &StatefulSetValidator{
+				Client:           b.Build(),
+				OutOfRangePolicy: statefulset.OutOfRangeResize,
+				CopyMode:         statefulset.CopyModeBackup,
+			}
+
+			warnings, err := v.ValidateCreate(context.Background(), sts)
+			if tc.invalid {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.ElementsMatch(t, tc.warnings, warnings)
+
+			warnings, err = v.ValidateUpdate(context.Background(), sts, sts)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, tc.warnings, warnings)
+		})
+	}
+}
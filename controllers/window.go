@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vshn/statefulset-resize-controller/schedule"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// maintenanceWindows returns the maintenance windows that apply to the StatefulSet.
+// The annotation on the StatefulSet takes precedence over the controller-wide default.
+func (r *StatefulSetReconciler) maintenanceWindows(sts *statefulset.Entity) (schedule.Windows, error) {
+	if w, ok := sts.MaintenanceWindow(); ok {
+		return schedule.Parse(w)
+	}
+	return r.MaintenanceWindows, nil
+}
+
+// holdForMaintenanceWindow checks whether a resize that did not start yet has to wait for a maintenance window.
+// It returns true and the result to return from the reconcile loop if the resize has to be held back.
+func (r *StatefulSetReconciler) holdForMaintenanceWindow(ctx context.Context, sts *statefulset.Entity, now time.Time) (ctrl.Result, bool, error) {
+	ws, err := r.maintenanceWindows(sts)
+	if err != nil {
+		log.FromContext(ctx).V(1).Info("Invalid maintenance window", "error", err)
+		return r.holdBlocked(ctx, sts, "InvalidMaintenanceWindow", "InvalidMaintenanceWindow",
+			fmt.Sprintf("Not resizing, annotation %s is invalid: %s", statefulset.MaintenanceWindowAnnotation, err), now)
+	}
+	if ws.Open(now) {
+		return ctrl.Result{}, false, nil
+	}
+
+	next := ws.Next(now)
+	if next.IsZero() {
+		return r.holdBlocked(ctx, sts, "MaintenanceWindow", "ResizePending", "Resize pending, there is no upcoming maintenance window", now)
+	}
+	log.FromContext(ctx).V(1).Info("Resize pending until next maintenance window", "next", next)
+	res, hold, err := r.holdBlocked(ctx, sts, "MaintenanceWindow", "ResizePending",
+		fmt.Sprintf("Resize pending until next maintenance window at %s", next.Format(time.RFC3339)), now)
+	// Do not back off past the opening of the window
+	if until := next.Sub(now); res.RequeueAfter > until {
+		res.RequeueAfter = until
+	}
+	return res, hold, err
+}
@@ -0,0 +1,127 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/vshn/statefulset-resize-controller/schedule"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
+)
+
+func TestHoldForMaintenanceWindow(t *testing.T) {
+	now := time.Date(2021, time.June, 2, 12, 0, 0, 0, time.UTC) // Wednesday
+
+	tcs := map[string]struct {
+		defaultWindow string
+		annotation    *string
+		hold          bool
+		requeueAfter  time.Duration
+	}{
+		"no windows": {
+			hold: false,
+		},
+		"inside default window": {
+			defaultWindow: "0 8 * * * 8h",
+			hold:          false,
+		},
+		"outside default window": {
+			defaultWindow: "0 22 * * * 4h",
+			hold:          true,
+			requeueAfter:  time.Hour,
+		},
+		"annotation overrides default": {
+			defaultWindow: "0 22 * * * 4h",
+			annotation:    pointer.String("0 11 * * * 2h"),
+			hold:          false,
+		},
+		"empty annotation disables default": {
+			defaultWindow: "0 22 * * * 4h",
+			annotation:    pointer.String(""),
+			hold:          false,
+		},
+		"annotation outside window": {
+			annotation:   pointer.String("30 12 * * * 2h"),
+			hold:         true,
+			requeueAfter: 30 * time.Minute,
+		},
+		"invalid annotation": {
+			annotation:   pointer.String("tomorrow"),
+			hold:         true,
+			requeueAfter: time.Hour,
+		},
+	}
+
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			ws, err := schedule.Parse(tc.defaultWindow)
+			require.NoError(t, err)
+			sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "foo", Annotations: map[string]string{}}}
+			if tc.annotation != nil {
+				sts.Annotations[statefulset.MaintenanceWindowAnnotation] = *tc.annotation
+			}
+			r := &StatefulSetReconciler{
+				Client:             fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(sts).Build(),
+				Recorder:           record.NewFakeRecorder(10),
+				RequeueAfter:       time.Hour,
+				MaintenanceWindows: ws,
+			}
+			si, err := statefulset.NewEntity(sts)
+			require.NoError(t, err)
+
+			res, hold, err := r.holdForMaintenanceWindow(context.Background(), si, now)
+			require.NoError(t, err)
+			assert.Equal(t, tc.hold, hold)
+			assert.Equal(t, tc.requeueAfter, res.RequeueAfter, "requeued until the window opens, at most after the requeue interval")
+		})
+	}
+}
+
+func TestHoldForMaintenanceWindowEvents(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2021, time.June, 2, 12, 0, 0, 0, time.UTC) // Wednesday
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+		Name:        "web",
+		Namespace:   "foo",
+		Annotations: map[string]string{statefulset.MaintenanceWindowAnnotation: "0 22 * * * 4h"},
+	}}
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(sts).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &StatefulSetReconciler{Client: c, Recorder: recorder, RequeueAfter: 10 * time.Second}
+
+	hold := func(now time.Time) (time.Duration, bool) {
+		found := &appsv1.StatefulSet{}
+		require.NoError(t, c.Get(ctx, client.ObjectKeyFromObject(sts), found))
+		si, err := statefulset.NewEntity(found)
+		require.NoError(t, err)
+		res, held, err := r.holdForMaintenanceWindow(ctx, si, now)
+		require.NoError(t, err)
+		return res.RequeueAfter, held
+	}
+
+	requeue, held := hold(start)
+	assert.True(t, held)
+	assert.Equal(t, 10*time.Second, requeue)
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "ResizePending Resize pending until next maintenance window at 2021-06-02T22:00:00Z")
+
+	requeue, held = hold(start.Add(time.Minute))
+	assert.True(t, held)
+	assert.Equal(t, time.Minute, requeue, "backs off")
+	requeue, _ = hold(start.Add(9*time.Hour + 58*time.Minute))
+	assert.Equal(t, 2*time.Minute, requeue, "requeued when the window opens")
+	assert.Empty(t, recorder.Events, "no event while waiting for the same window")
+
+	_, held = hold(start.Add(10 * time.Hour))
+	assert.False(t, held)
+}
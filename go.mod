@@ -13,6 +13,7 @@ require (
 	sigs.k8s.io/controller-runtime/tools/setup-envtest v0.0.0-20230728161957-7f0c6dc440f3
 	sigs.k8s.io/controller-tools v0.12.1
 	sigs.k8s.io/kustomize/kustomize/v3 v3.10.0
+	sigs.k8s.io/yaml v1.3.0
 )
 
 require (
@@ -86,7 +87,6 @@ require (
 	sigs.k8s.io/kustomize/cmd/config v0.11.2 // indirect
 	sigs.k8s.io/kustomize/kyaml v0.14.2 // indirect
 	sigs.k8s.io/structured-merge-diff/v4 v4.3.0 // indirect
-	sigs.k8s.io/yaml v1.3.0 // indirect
 )
 
 replace github.com/googleapis/gnostic-models => github.com/googleapis/gnostic v0.5.5
@@ -18,11 +18,14 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	"github.com/vshn/statefulset-resize-controller/controllers"
+	"github.com/vshn/statefulset-resize-controller/schedule"
+	"github.com/vshn/statefulset-resize-controller/statefulset"
 	//+kubebuilder:scaffold:imports
 )
 
 //go:generate go run sigs.k8s.io/controller-tools/cmd/controller-gen object:headerFile="hack/boilerplate.go.txt" paths="./..."
 //go:generate go run sigs.k8s.io/controller-tools/cmd/controller-gen rbac:roleName=controller-manager paths="./..."
+//go:generate go run sigs.k8s.io/controller-tools/cmd/controller-gen webhook paths="./..."
 
 var (
 	scheme   = runtime.NewScheme()
@@ -44,6 +47,13 @@ func main() {
 	var inplaceResize bool
 	var inplaceLabelName string
 	var logLevel int
+	var maintenanceWindow string
+	var requireApproval bool
+	var outOfRange string
+	var precopy bool
+	var copyMode string
+	var retainSourceVolumes bool
+	var enableWebhook bool
 	flag.StringVar(&syncContainerImage, "sync-image", "instrumentisto/rsync-ssh", "A container image containing rsync, used to move data.")
 	flag.StringVar(&syncClusterRole, "sync-cluster-role", "", "ClusterRole to use for the sync jobs."+
 		"For example, this can be used to allow the sync job to run as root on a cluster with PSPs enabled by providing the name of a ClusterRole which allows usage of a privileged PSP.")
@@ -56,6 +66,22 @@ func main() {
 		"If the underlying storage supports direct resizing of the PVCs this should be used.")
 	flag.StringVar(&inplaceLabelName, "inplaceLabelName", "sts-resize.vshn.net/resize-inplace", "If inplace resize is enable the sts needs to have this label with value \"true\" in order to be handled.")
 	flag.IntVar(&logLevel, "log-level", 0, "Set the log level.")
+	flag.StringVar(&maintenanceWindow, "maintenance-window", "", "Default maintenance windows in which a resize may start, "+
+		"as a semicolon separated list of a cron expression followed by a duration, e.g. \"0 22 * * 1-5 4h\". "+
+		"Can be overridden per StatefulSet. By default a resize can start at any time.")
+	flag.BoolVar(&requireApproval, "require-approval", false, "Require every resize to be approved before scaling down the StatefulSet. "+
+		"Can be overridden per StatefulSet.")
+	flag.StringVar(&outOfRange, "out-of-range-pvcs", string(statefulset.OutOfRangeResize), "How to handle PVCs of ordinals outside the replicas of a StatefulSet, left over from an earlier scale down. "+
+		"One of \"resize\", \"skip\", or \"delete\". Can be overridden per StatefulSet.")
+	flag.BoolVar(&precopy, "precopy", false, "Copy the PVCs once while the StatefulSet is still running, to shorten the downtime. "+
+		"Requires PVCs with access mode ReadWriteMany, or a CSI driver supporting volume cloning. Can be overridden per StatefulSet.")
+	flag.StringVar(&copyMode, "copy-mode", string(statefulset.CopyModeBackup), "How to move the data to the resized PVCs. "+
+		"\"backup\" copies the data to a backup and back to the recreated PVC, \"rebind\" copies the data once to a new PVC and binds its volume to the original PVC name. "+
+		"Can be overridden per StatefulSet.")
+	flag.BoolVar(&retainSourceVolumes, "retain-source-volumes", false, "Set the volumes of the original PVCs to the reclaim policy Retain before deleting the PVCs, "+
+		"and restore their reclaim policy only after the restored PVCs were verified. Can be overridden per StatefulSet.")
+	flag.BoolVar(&enableWebhook, "enable-webhook", false, "Enable the validating admission webhook for StatefulSets. "+
+		"It rejects resizes that can not complete and warns about the PVCs a StatefulSet change will resize. Requires a serving certificate.")
 	flag.Parse()
 
 	opts := zap.Options{
@@ -78,13 +104,37 @@ func main() {
 		os.Exit(1)
 	}
 
+	maintenanceWindows, err := schedule.Parse(maintenanceWindow)
+	if err != nil {
+		setupLog.Error(err, "invalid maintenance window")
+		os.Exit(1)
+	}
+
+	outOfRangePolicy, err := statefulset.ParseOutOfRangePolicy(outOfRange)
+	if err != nil {
+		setupLog.Error(err, "invalid out of range policy")
+		os.Exit(1)
+	}
+
+	mode, err := statefulset.ParseCopyMode(copyMode)
+	if err != nil {
+		setupLog.Error(err, "invalid copy mode")
+		os.Exit(1)
+	}
+
 	var stsController controllers.StatefulSetController = &controllers.StatefulSetReconciler{
-		Client:             mgr.GetClient(),
-		Scheme:             mgr.GetScheme(),
-		Recorder:           mgr.GetEventRecorderFor("statefulset-resize-controller"),
-		SyncContainerImage: syncContainerImage,
-		SyncClusterRole:    syncClusterRole,
-		RequeueAfter:       10 * time.Second,
+		Client:              mgr.GetClient(),
+		Scheme:              mgr.GetScheme(),
+		Recorder:            mgr.GetEventRecorderFor("statefulset-resize-controller"),
+		SyncContainerImage:  syncContainerImage,
+		SyncClusterRole:     syncClusterRole,
+		RequeueAfter:        10 * time.Second,
+		MaintenanceWindows:  maintenanceWindows,
+		RequireApproval:     requireApproval,
+		OutOfRangePolicy:    outOfRangePolicy,
+		Precopy:             precopy,
+		CopyMode:            mode,
+		RetainSourceVolumes: retainSourceVolumes,
 	}
 
 	if inplaceResize {
@@ -101,6 +151,17 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "StatefulSet")
 		os.Exit(1)
 	}
+	if enableWebhook {
+		validator := &controllers.StatefulSetValidator{
+			Client:           mgr.GetClient(),
+			OutOfRangePolicy: outOfRangePolicy,
+			CopyMode:         mode,
+		}
+		if err = validator.SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "StatefulSet")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
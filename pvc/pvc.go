@@ -13,6 +13,19 @@ import (
 // ManagedLabel is a label to mark resources to be managed by the controller
 const ManagedLabel = "sts-resize.vshn.net/managed"
 
+// MigratedFromAnnotation marks a PVC created by migrating a PVC from another namespace
+const MigratedFromAnnotation = "sts-resize.vshn.net/migrated-from"
+
+// Step is a step of the resize of a PVC
+type Step string
+
+const (
+	// StepBackup copies the original PVC to its backup, its target, or to the target namespace
+	StepBackup Step = "Backup"
+	// StepRestore replaces the original PVC and restores its data
+	StepRestore Step = "Restore"
+)
+
 // NewEntity returns a new pvc Info
 func NewEntity(pvc corev1.PersistentVolumeClaim, growTo resource.Quantity, storageClassName *string) Entity {
 	sourceStorageClassName := pvc.Spec.StorageClassName
@@ -21,6 +34,7 @@ func NewEntity(pvc corev1.PersistentVolumeClaim, growTo resource.Quantity, stora
 		SourceName:         pvc.Name,
 		Namespace:          pvc.Namespace,
 		Labels:             pvc.Labels,
+		OwnerReferences:    pvc.OwnerReferences,
 		TargetSize:         growTo,
 		TargetStorageClass: storageClassName,
 		SourceStorageClass: sourceStorageClassName,
@@ -34,13 +48,49 @@ type Entity struct {
 	SourceName string
 
 	Labels             map[string]string
+	OwnerReferences    []metav1.OwnerReference
 	Spec               corev1.PersistentVolumeClaimSpec
 	TargetSize         resource.Quantity
 	TargetStorageClass *string
 	SourceStorageClass *string
 
-	BackedUp bool
-	Restored bool
+	// TargetNamespace is set if the PVC is migrated to another namespace instead of resized.
+	// The PVC is copied to a PVC with the same name in the target namespace and the original is kept.
+	TargetNamespace string
+
+	// Rebind is set if the PVC is copied once to a new PVC, whose volume is then bound to the name of the original PVC.
+	// The volume of the original PVC is kept as the backup.
+	Rebind bool
+	// TargetVolumeName is the volume of the new PVC when rebinding
+	TargetVolumeName string
+	// TargetReclaimPolicy is the original reclaim policy of the volume of the new PVC when rebinding
+	TargetReclaimPolicy corev1.PersistentVolumeReclaimPolicy
+
+	// RetainVolume is set if the volume of the original PVC is retained until the restore completed
+	RetainVolume bool
+	// SourceVolumeName is the volume of the original PVC, recorded before it is retained
+	SourceVolumeName string
+	// SourceReclaimPolicy is the original reclaim policy of the volume of the original PVC
+	SourceReclaimPolicy corev1.PersistentVolumeReclaimPolicy
+
+	// Discard marks a PVC of an ordinal outside the replicas of the StatefulSet.
+	// It is deleted instead of resized.
+	Discard bool
+
+	// PreCopied is set once a first copy to the backup completed while the StatefulSet was still running
+	PreCopied bool
+	BackedUp  bool
+	Restored  bool
+
+	// Intent is the step the controller is about to take, or is taking.
+	// It is recorded on the StatefulSet before the step starts.
+	// A restarted controller resumes the interrupted step, and never repeats a step that might have already replaced the original PVC.
+	Intent Step
+}
+
+// SourceSize returns the size of the original PVC
+func (pi Entity) SourceSize() resource.Quantity {
+	return pi.Spec.Resources.Requests[corev1.ResourceStorage]
 }
 
 // BackupName return the name of the backup
@@ -53,6 +103,18 @@ func (pi Entity) BackupName() string {
 	return strings.ToLower(fmt.Sprintf("%s%s", name, suffix))
 }
 
+// IsBackupOf returns whether name is the name of a backup of the PVC source, of any size
+func IsBackupOf(name, source string) bool {
+	maxNameLength := 63
+	i := strings.LastIndex(name, "-backup-")
+	if i < 0 {
+		return false
+	}
+	suffix := name[i:]
+	prefix, err := naming.ShortenName(source, maxNameLength-len(suffix))
+	return err == nil && strings.ToLower(prefix+suffix) == name
+}
+
 // GetBackup returns a pvc resource for the backup
 func (pi Entity) GetBackup() *corev1.PersistentVolumeClaim {
 	return &corev1.PersistentVolumeClaim{
@@ -72,13 +134,87 @@ func (pi Entity) GetBackup() *corev1.PersistentVolumeClaim {
 	}
 }
 
-// GetResizedSource returns a pvc resource for the enlarged original PVC
-func (pi Entity) GetResizedSource() *corev1.PersistentVolumeClaim {
+// CloneName returns the name of the clone used to pre-copy the PVC
+func (pi Entity) CloneName() string {
+	maxNameLength := 63
+	suffix := "-precopy"
+	// The ignored error is impossible
+	name, _ := naming.ShortenName(pi.SourceName, maxNameLength-len(suffix))
+	return strings.ToLower(fmt.Sprintf("%s%s", name, suffix))
+}
+
+// GetClone returns a pvc resource for a clone of the original PVC.
+// The clone is a point in time copy of the PVC, that can be read while the original is in use.
+func (pi Entity) GetClone() *corev1.PersistentVolumeClaim {
 	return &corev1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      pi.SourceName,
+			Name:      pi.CloneName(),
 			Namespace: pi.Namespace,
+			Labels: map[string]string{
+				ManagedLabel: "true",
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: pi.Spec.AccessModes,
+			Resources:   pi.Spec.Resources,
+			// Cloning requires the storage class of the original
+			StorageClassName: pi.SourceStorageClass,
+			VolumeMode:       pi.Spec.VolumeMode,
+			DataSource: &corev1.TypedLocalObjectReference{
+				Kind: "PersistentVolumeClaim",
+				Name: pi.SourceName,
+			},
+		},
+	}
+}
+
+// SharedAccess returns whether the PVC can be mounted by multiple pods, while the StatefulSet is running
+func (pi Entity) SharedAccess() bool {
+	for _, m := range pi.Spec.AccessModes {
+		if m == corev1.ReadWriteMany || m == corev1.ReadOnlyMany {
+			return true
+		}
+	}
+	return false
+}
+
+// TargetName returns the name of the new PVC when rebinding
+func (pi Entity) TargetName() string {
+	maxNameLength := 63
+	suffix := fmt.Sprintf("-resized-%s", pi.TargetSize.String())
+	// The ignored error is impossible
+	name, _ := naming.ShortenName(pi.SourceName, maxNameLength-len(suffix))
+	return strings.ToLower(fmt.Sprintf("%s%s", name, suffix))
+}
+
+// GetTarget returns a pvc resource for the new PVC when rebinding
+func (pi Entity) GetTarget() *corev1.PersistentVolumeClaim {
+	target := pi.GetResizedSource()
+	target.Name = pi.TargetName()
+	target.Labels = map[string]string{
+		ManagedLabel: "true",
+	}
+	target.OwnerReferences = nil
+	return target
+}
+
+// GetRebound returns a pvc resource for the original PVC, bound to the volume of the new PVC
+func (pi Entity) GetRebound() *corev1.PersistentVolumeClaim {
+	source := pi.GetResizedSource()
+	source.Spec.VolumeName = pi.TargetVolumeName
+	return source
+}
+
+// GetMigrated returns a pvc resource for the copy of the PVC in the target namespace
+func (pi Entity) GetMigrated() *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pi.SourceName,
+			Namespace: pi.TargetNamespace,
 			Labels:    pi.Labels,
+			Annotations: map[string]string{
+				MigratedFromAnnotation: pi.Namespace,
+			},
 		},
 		Spec: corev1.PersistentVolumeClaimSpec{
 			AccessModes: pi.Spec.AccessModes,
@@ -92,3 +228,39 @@ func (pi Entity) GetResizedSource() *corev1.PersistentVolumeClaim {
 		},
 	}
 }
+
+// GetResizedSource returns a pvc resource for the enlarged original PVC
+func (pi Entity) GetResizedSource() *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            pi.SourceName,
+			Namespace:       pi.Namespace,
+			Labels:          pi.Labels,
+			OwnerReferences: pi.sourceOwnerReferences(),
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: pi.Spec.AccessModes,
+			Resources: corev1.ResourceRequirements{
+				Requests: map[corev1.ResourceName]resource.Quantity{
+					corev1.ResourceStorage: pi.TargetSize,
+				},
+			},
+			StorageClassName: pi.TargetStorageClass,
+			VolumeMode:       pi.Spec.VolumeMode,
+		},
+	}
+}
+
+// sourceOwnerReferences returns the owner references to carry over to the resized PVC.
+// Pods are deleted while the StatefulSet is scaled down. Carrying over a reference to a pod would cause the garbage collector to delete the resized PVC.
+// The StatefulSet sets the reference to the pod again, if required by its retention policy.
+func (pi Entity) sourceOwnerReferences() []metav1.OwnerReference {
+	var refs []metav1.OwnerReference
+	for _, ref := range pi.OwnerReferences {
+		if ref.Kind == "Pod" && ref.APIVersion == "v1" {
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	return refs
+}
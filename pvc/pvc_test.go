@@ -8,6 +8,7 @@ import (
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestBackup(t *testing.T) {
@@ -63,3 +64,64 @@ func TestBackup(t *testing.T) {
 		})
 	}
 }
+
+func TestIsBackupOf(t *testing.T) {
+	long := "bar-with-quite-a-long-name-to-be-descriptive-right-and-even-longer"
+	backup := func(name, size string) string {
+		pi := Entity{
+			SourceName: name,
+			Spec: corev1.PersistentVolumeClaimSpec{
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(size)},
+				},
+			},
+		}
+		return pi.BackupName()
+	}
+	tcs := map[string]struct {
+		name   string
+		source string
+		backup bool
+	}{
+		"backup": {
+			name:   backup("data-web-0", "1Gi"),
+			source: "data-web-0",
+			backup: true,
+		},
+		"shortened backup": {
+			name:   backup(long, "5G"),
+			source: long,
+			backup: true,
+		},
+		"other PVC": {
+			name:   backup("data-web-10", "1Gi"),
+			source: "data-web-1",
+		},
+		"not a backup": {
+			name:   "data-web-0",
+			source: "data-web-0",
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			assert.Equal(t, tc.backup, IsBackupOf(tc.name, tc.source))
+		})
+	}
+}
+
+func TestResizedSourceOwnerReferences(t *testing.T) {
+	sts := metav1.OwnerReference{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "web", UID: "1234"}
+	pod := metav1.OwnerReference{APIVersion: "v1", Kind: "Pod", Name: "web-0", UID: "5678"}
+
+	p := corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "data-web-0",
+			Namespace:       "test",
+			OwnerReferences: []metav1.OwnerReference{sts, pod},
+		},
+	}
+	pi := NewEntity(p, resource.MustParse("2G"), nil)
+
+	assert.Equal(t, []metav1.OwnerReference{sts}, pi.GetResizedSource().OwnerReferences)
+	assert.Empty(t, pi.GetBackup().OwnerReferences)
+}
@@ -0,0 +1,271 @@
+package pvc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// StateVersion is the version of the format written by MarshalState.
+//
+// Version 1 is the format of the baseline release, a bare list of Entity serialized with its Go field names, or null.
+// It is still read, and migrated to the current version.
+const StateVersion = 2
+
+// stateV2 is the serialized state of a PVC in version 2.
+// It is decoupled from Entity, so that changes to Entity never silently change the format.
+type stateV2 struct {
+	Namespace  string `json:"namespace"`
+	SourceName string `json:"sourceName"`
+
+	Labels             map[string]string                `json:"labels,omitempty"`
+	OwnerReferences    []metav1.OwnerReference          `json:"ownerReferences,omitempty"`
+	Spec               corev1.PersistentVolumeClaimSpec `json:"spec"`
+	TargetSize         resource.Quantity                `json:"targetSize"`
+	TargetStorageClass *string                          `json:"targetStorageClass,omitempty"`
+	SourceStorageClass *string                          `json:"sourceStorageClass,omitempty"`
+	TargetNamespace    string                           `json:"targetNamespace,omitempty"`
+
+	Rebind              bool                                 `json:"rebind,omitempty"`
+	TargetVolumeName    string                               `json:"targetVolumeName,omitempty"`
+	TargetReclaimPolicy corev1.PersistentVolumeReclaimPolicy `json:"targetReclaimPolicy,omitempty"`
+
+	RetainVolume        bool                                 `json:"retainVolume,omitempty"`
+	SourceVolumeName    string                               `json:"sourceVolumeName,omitempty"`
+	SourceReclaimPolicy corev1.PersistentVolumeReclaimPolicy `json:"sourceReclaimPolicy,omitempty"`
+
+	Discard   bool `json:"discard,omitempty"`
+	PreCopied bool `json:"preCopied,omitempty"`
+	BackedUp  bool `json:"backedUp,omitempty"`
+	Restored  bool `json:"restored,omitempty"`
+
+	Intent Step `json:"intent,omitempty"`
+}
+
+// stateListV2 is the serialized state of all PVCs in version 2
+type stateListV2 struct {
+	Version int               `json:"version"`
+	Pvcs    []json.RawMessage `json:"pvcs"`
+}
+
+// stateV1 is the serialized state of a PVC in version 1.
+// Its fields must never change. They are the Go field names of Entity in the baseline release, the last one writing version 1.
+// Everything added since, such as rebinding, retained volumes, discarded PVCs, pre-copies and migrations, only exists in version 2.
+type stateV1 struct {
+	Namespace          string
+	SourceName         string
+	Labels             map[string]string
+	Spec               corev1.PersistentVolumeClaimSpec
+	TargetSize         resource.Quantity
+	TargetStorageClass *string
+	SourceStorageClass *string
+	BackedUp           bool
+	Restored           bool
+}
+
+// MarshalState serializes the state of the PVCs in the current version
+func MarshalState(pis []Entity) (string, error) {
+	list := stateListV2{Version: StateVersion, Pvcs: make([]json.RawMessage, 0, len(pis))}
+	for _, pi := range pis {
+		raw, err := json.Marshal(toV2(pi))
+		if err != nil {
+			return "", err
+		}
+		list.Pvcs = append(list.Pvcs, raw)
+	}
+	v, err := json.Marshal(list)
+	return string(v), err
+}
+
+// UnmarshalState parses the state of the PVCs written by MarshalState, or by older releases.
+// State of older versions is migrated to the current version.
+// It rejects unknown versions and fields, and state that is inconsistent.
+// The errors name the offending field.
+func UnmarshalState(v string) ([]Entity, error) {
+	var states []stateV2
+	var err error
+	if trimmed := bytes.TrimSpace([]byte(v)); bytes.HasPrefix(trimmed, []byte("[")) || string(trimmed) == "null" {
+		states, err = unmarshalV1(v)
+	} else {
+		states, err = unmarshalV2(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	errs := field.ErrorList{}
+	pis := make([]Entity, 0, len(states))
+	for i, s := range states {
+		errs = append(errs, s.validate(field.NewPath("pvcs").Index(i))...)
+		pis = append(pis, s.entity())
+	}
+	if len(errs) > 0 {
+		return nil, errs.ToAggregate()
+	}
+	return pis, nil
+}
+
+func unmarshalV1(v string) ([]stateV2, error) {
+	raws := []json.RawMessage{}
+	if err := json.Unmarshal([]byte(v), &raws); err != nil {
+		return nil, err
+	}
+	states := make([]stateV2, 0, len(raws))
+	for i, raw := range raws {
+		s := stateV1{}
+		if err := decodeStrict(raw, &s); err != nil {
+			return nil, fmt.Errorf("%s: %w", field.NewPath("pvcs").Index(i), err)
+		}
+		states = append(states, migrateV1(s))
+	}
+	return states, nil
+}
+
+func unmarshalV2(v string) ([]stateV2, error) {
+	list := stateListV2{}
+	if err := decodeStrict([]byte(v), &list); err != nil {
+		return nil, err
+	}
+	if list.Version != StateVersion {
+		return nil, field.NotSupported(field.NewPath("version"), list.Version, []string{fmt.Sprint(StateVersion)})
+	}
+	states := make([]stateV2, 0, len(list.Pvcs))
+	for i, raw := range list.Pvcs {
+		s := stateV2{}
+		if err := decodeStrict(raw, &s); err != nil {
+			return nil, fmt.Errorf("%s: %w", field.NewPath("pvcs").Index(i), err)
+		}
+		states = append(states, s)
+	}
+	return states, nil
+}
+
+// decodeStrict decodes JSON and fails on unknown fields.
+// State written by a newer release must not be silently truncated.
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// migrateV1 migrates the state of a PVC from version 1 to version 2.
+// Version 1 did not record intents. A PVC that was backed up might already be replaced, it can only continue with its restore.
+func migrateV1(s stateV1) stateV2 {
+	v2 := stateV2{
+		Namespace:          s.Namespace,
+		SourceName:         s.SourceName,
+		Labels:             s.Labels,
+		Spec:               s.Spec,
+		TargetSize:         s.TargetSize,
+		TargetStorageClass: s.TargetStorageClass,
+		SourceStorageClass: s.SourceStorageClass,
+		BackedUp:           s.BackedUp,
+		Restored:           s.Restored,
+	}
+	if s.BackedUp {
+		v2.Intent = StepRestore
+	}
+	return v2
+}
+
+func (s stateV2) validate(p *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	if s.Namespace == "" {
+		errs = append(errs, field.Required(p.Child("namespace"), ""))
+	}
+	if s.SourceName == "" {
+		errs = append(errs, field.Required(p.Child("sourceName"), ""))
+	}
+	if s.TargetSize.Sign() <= 0 {
+		errs = append(errs, field.Invalid(p.Child("targetSize"), s.TargetSize.String(), "must be positive"))
+	}
+	if s.Discard && (s.Rebind || s.TargetNamespace != "") {
+		errs = append(errs, field.Forbidden(p.Child("discard"), "may not be set when rebinding or migrating"))
+	}
+	if s.Rebind && s.TargetNamespace != "" {
+		errs = append(errs, field.Forbidden(p.Child("rebind"), "may not be set when migrating"))
+	}
+	switch s.Intent {
+	case "", StepBackup:
+	case StepRestore:
+		if !s.BackedUp {
+			errs = append(errs, field.Forbidden(p.Child("intent"), "may only restore once backedUp is set"))
+		}
+	default:
+		errs = append(errs, field.NotSupported(p.Child("intent"), s.Intent, []string{string(StepBackup), string(StepRestore)}))
+	}
+	policies := []string{
+		string(corev1.PersistentVolumeReclaimRetain),
+		string(corev1.PersistentVolumeReclaimDelete),
+		string(corev1.PersistentVolumeReclaimRecycle),
+	}
+	for _, f := range []struct {
+		name   string
+		policy corev1.PersistentVolumeReclaimPolicy
+	}{
+		{"sourceReclaimPolicy", s.SourceReclaimPolicy},
+		{"targetReclaimPolicy", s.TargetReclaimPolicy},
+	} {
+		switch f.policy {
+		case "", corev1.PersistentVolumeReclaimRetain, corev1.PersistentVolumeReclaimDelete, corev1.PersistentVolumeReclaimRecycle:
+		default:
+			errs = append(errs, field.NotSupported(p.Child(f.name), f.policy, policies))
+		}
+	}
+	return errs
+}
+
+func toV2(pi Entity) stateV2 {
+	return stateV2{
+		Namespace:           pi.Namespace,
+		SourceName:          pi.SourceName,
+		Labels:              pi.Labels,
+		OwnerReferences:     pi.OwnerReferences,
+		Spec:                pi.Spec,
+		TargetSize:          pi.TargetSize,
+		TargetStorageClass:  pi.TargetStorageClass,
+		SourceStorageClass:  pi.SourceStorageClass,
+		TargetNamespace:     pi.TargetNamespace,
+		Rebind:              pi.Rebind,
+		TargetVolumeName:    pi.TargetVolumeName,
+		TargetReclaimPolicy: pi.TargetReclaimPolicy,
+		RetainVolume:        pi.RetainVolume,
+		SourceVolumeName:    pi.SourceVolumeName,
+		SourceReclaimPolicy: pi.SourceReclaimPolicy,
+		Discard:             pi.Discard,
+		PreCopied:           pi.PreCopied,
+		BackedUp:            pi.BackedUp,
+		Restored:            pi.Restored,
+		Intent:              pi.Intent,
+	}
+}
+
+func (s stateV2) entity() Entity {
+	return Entity{
+		Namespace:           s.Namespace,
+		SourceName:          s.SourceName,
+		Labels:              s.Labels,
+		OwnerReferences:     s.OwnerReferences,
+		Spec:                s.Spec,
+		TargetSize:          s.TargetSize,
+		TargetStorageClass:  s.TargetStorageClass,
+		SourceStorageClass:  s.SourceStorageClass,
+		TargetNamespace:     s.TargetNamespace,
+		Rebind:              s.Rebind,
+		TargetVolumeName:    s.TargetVolumeName,
+		TargetReclaimPolicy: s.TargetReclaimPolicy,
+		RetainVolume:        s.RetainVolume,
+		SourceVolumeName:    s.SourceVolumeName,
+		SourceReclaimPolicy: s.SourceReclaimPolicy,
+		Discard:             s.Discard,
+		PreCopied:           s.PreCopied,
+		BackedUp:            s.BackedUp,
+		Restored:            s.Restored,
+		Intent:              s.Intent,
+	}
+}
@@ -0,0 +1,172 @@
+package pvc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+)
+
+func newStateEntity() Entity {
+	pi := NewEntity(corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data-web-0", Namespace: "foo", Labels: map[string]string{"app": "web"}},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			StorageClassName: pointer.String("ssd"),
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1G")},
+			},
+		},
+	}, resource.MustParse("2G"), pointer.String("hdd"))
+	pi.RetainVolume = true
+	pi.SourceVolumeName = "pv-1"
+	pi.SourceReclaimPolicy = corev1.PersistentVolumeReclaimDelete
+	pi.BackedUp = true
+	return pi
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	pis := []Entity{newStateEntity()}
+
+	v, err := MarshalState(pis)
+	require.NoError(t, err)
+	assert.Contains(t, v, `"version":2`)
+	assert.Contains(t, v, `"sourceName":"data-web-0"`)
+
+	found, err := UnmarshalState(v)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, "data-web-0", found[0].SourceName)
+	assert.True(t, found[0].TargetSize.Equal(resource.MustParse("2G")))
+	assert.Equal(t, pis[0].Spec, found[0].Spec)
+	assert.Equal(t, corev1.PersistentVolumeReclaimDelete, found[0].SourceReclaimPolicy)
+	assert.True(t, found[0].BackedUp)
+
+	v, err = MarshalState(nil)
+	require.NoError(t, err)
+	assert.Equal(t, `{"version":2,"pvcs":[]}`, v)
+}
+
+func TestStateMigratesV1(t *testing.T) {
+	// The format of the baseline release, as written while a resize was in flight
+	legacy := `[{"Namespace":"foo","SourceName":"data-web-0","Labels":{"app":"web"},` +
+		`"Spec":{"accessModes":["ReadWriteOnce"],"resources":{"requests":{"storage":"1G"}},"storageClassName":"hdd"},` +
+		`"TargetSize":"2G","TargetStorageClass":"hdd","SourceStorageClass":"ssd","BackedUp":true,"Restored":false}]`
+
+	found, err := UnmarshalState(legacy)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	expected := newStateEntity()
+	assert.Equal(t, expected.SourceName, found[0].SourceName)
+	assert.Equal(t, expected.Spec, found[0].Spec)
+	assert.Equal(t, *expected.TargetStorageClass, *found[0].TargetStorageClass)
+	assert.Equal(t, *expected.SourceStorageClass, *found[0].SourceStorageClass)
+	assert.True(t, found[0].BackedUp)
+	assert.Equal(t, StepRestore, found[0].Intent, "a backed up PVC can only continue with its restore")
+
+	for _, v := range []string{"[]", "null"} {
+		found, err := UnmarshalState(v)
+		require.NoError(t, err, v)
+		assert.Empty(t, found, v)
+	}
+
+	// Fields added after the baseline release were never written in version 1
+	for _, f := range []string{`"OwnerReferences":null`, `"TargetNamespace":""`, `"Rebind":false`, `"RetainVolume":true`, `"Discard":false`, `"PreCopied":false`} {
+		_, err := UnmarshalState(`[{"Namespace":"foo","SourceName":"data-web-0","TargetSize":"2G",` + f + `}]`)
+		assert.ErrorContains(t, err, "unknown field", f)
+	}
+}
+
+func TestStateMigratesBaselineRelease(t *testing.T) {
+	// Written by the baseline release, before any of the later fields existed
+	legacy := `[{"Namespace":"foo","SourceName":"data-web-0","Labels":{"app":"web"},` +
+		`"Spec":{"accessModes":["ReadWriteOnce"],"resources":{"requests":{"storage":"1G"}}},` +
+		`"TargetSize":"2G","TargetStorageClass":null,"SourceStorageClass":"ssd","BackedUp":true,"Restored":false}]`
+
+	found, err := UnmarshalState(legacy)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, "foo", found[0].Namespace)
+	assert.Equal(t, "data-web-0", found[0].SourceName)
+	assert.Equal(t, map[string]string{"app": "web"}, found[0].Labels)
+	assert.Equal(t, resource.MustParse("1G"), found[0].SourceSize())
+	assert.Equal(t, resource.MustParse("2G"), found[0].TargetSize)
+	assert.Nil(t, found[0].TargetStorageClass)
+	assert.Equal(t, "ssd", *found[0].SourceStorageClass)
+	assert.True(t, found[0].BackedUp)
+	assert.False(t, found[0].Restored)
+	assert.False(t, found[0].Rebind)
+	assert.False(t, found[0].RetainVolume)
+	assert.Empty(t, found[0].TargetNamespace)
+	assert.Equal(t, StepRestore, found[0].Intent)
+	assert.Equal(t, "data-web-0-backup-1g", found[0].BackupName(), "the backup of the baseline release is found")
+
+	v, err := MarshalState(found)
+	require.NoError(t, err)
+	again, err := UnmarshalState(v)
+	require.NoError(t, err)
+	assert.Equal(t, found, again, "migrated to the current version")
+}
+
+func TestStateValidation(t *testing.T) {
+	tcs := map[string]struct {
+		state string
+		err   string
+	}{
+		"malformed": {
+			state: "{",
+			err:   "unexpected EOF",
+		},
+		"unsupported version": {
+			state: `{"version":3,"pvcs":[]}`,
+			err:   `version: Unsupported value: 3`,
+		},
+		"unknown field": {
+			state: `{"version":2,"pvcs":[{"namespace":"foo","sourceName":"data-web-0","targetSize":"2G","snapshot":true}]}`,
+			err:   `pvcs[0]: json: unknown field "snapshot"`,
+		},
+		"unknown legacy field": {
+			state: `[{"Namespace":"foo","SourceName":"data-web-0","TargetSize":"2G","Snapshot":true}]`,
+			err:   `pvcs[0]: json: unknown field "Snapshot"`,
+		},
+		"wrong type": {
+			state: `{"version":2,"pvcs":[{"namespace":"foo","sourceName":"data-web-0","targetSize":"2G","backedUp":"yes"}]}`,
+			err:   `pvcs[0]: json: cannot unmarshal string into Go struct field stateV2.backedUp of type bool`,
+		},
+		"missing source": {
+			state: `{"version":2,"pvcs":[{"namespace":"foo","sourceName":"data-web-0","targetSize":"2G"},{"namespace":"foo","targetSize":"2G"}]}`,
+			err:   `pvcs[1].sourceName: Required value`,
+		},
+		"missing target size": {
+			state: `[{"Namespace":"foo","SourceName":"data-web-0"}]`,
+			err:   `pvcs[0].targetSize: Invalid value: "0": must be positive`,
+		},
+		"discard and migrate": {
+			state: `{"version":2,"pvcs":[{"namespace":"foo","sourceName":"data-web-0","targetSize":"2G","discard":true,"targetNamespace":"bar"}]}`,
+			err:   `pvcs[0].discard: Forbidden: may not be set when rebinding or migrating`,
+		},
+		"restore before backup": {
+			state: `{"version":2,"pvcs":[{"namespace":"foo","sourceName":"data-web-0","targetSize":"2G","intent":"Restore"}]}`,
+			err:   `pvcs[0].intent: Forbidden: may only restore once backedUp is set`,
+		},
+		"unknown intent": {
+			state: `{"version":2,"pvcs":[{"namespace":"foo","sourceName":"data-web-0","targetSize":"2G","intent":"Shrink"}]}`,
+			err:   `pvcs[0].intent: Unsupported value: "Shrink"`,
+		},
+		"unknown reclaim policy": {
+			state: `{"version":2,"pvcs":[{"namespace":"foo","sourceName":"data-web-0","targetSize":"2G","targetReclaimPolicy":"Keep"}]}`,
+			err:   `pvcs[0].targetReclaimPolicy: Unsupported value: "Keep"`,
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			_, err := UnmarshalState(tc.state)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
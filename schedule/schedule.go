@@ -0,0 +1,230 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLookahead limits how far into the future we search for the next window.
+// Any valid cron expression matches at least once within four years (leap days).
+const maxLookahead = 4 * 366 * 24 * time.Hour
+
+// Window is a recurring maintenance window.
+// It opens whenever its cron expression matches and stays open for Duration.
+type Window struct {
+	Duration time.Duration
+
+	minute, hour, dom, month, dow field
+	domRestricted, dowRestricted  bool
+}
+
+// Windows is a list of maintenance windows.
+// An empty list does not restrict anything, it is always open.
+type Windows []Window
+
+// field is a bitset of the allowed values of a single cron field
+type field uint64
+
+type bounds struct {
+	name     string
+	min, max int
+}
+
+var (
+	minuteBounds = bounds{"minute", 0, 59}
+	hourBounds   = bounds{"hour", 0, 23}
+	domBounds    = bounds{"day of month", 1, 31}
+	monthBounds  = bounds{"month", 1, 12}
+	dowBounds    = bounds{"day of week", 0, 7}
+)
+
+// Parse parses a semicolon separated list of maintenance windows.
+// Each window consists of a standard five field cron expression, describing when the window opens, followed by its duration.
+// For example `0 22 * * 1-5 4h; 0 6 * * 0,6 12h` opens at 22:00 on workdays for four hours and at 06:00 on weekends for twelve hours.
+func Parse(s string) (Windows, error) {
+	ws := Windows{}
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		w, err := ParseWindow(part)
+		if err != nil {
+			return nil, err
+		}
+		ws = append(ws, w)
+	}
+	return ws, nil
+}
+
+// ParseWindow parses a single maintenance window of the form `<minute> <hour> <day of month> <month> <day of week> <duration>`.
+func ParseWindow(s string) (Window, error) {
+	fs := strings.Fields(s)
+	if len(fs) != 6 {
+		return Window{}, fmt.Errorf("window %q: expected 5 cron fields and a duration, got %d fields", s, len(fs))
+	}
+	w := Window{}
+	var err error
+	if w.minute, err = parseField(fs[0], minuteBounds); err != nil {
+		return Window{}, fmt.Errorf("window %q: %w", s, err)
+	}
+	if w.hour, err = parseField(fs[1], hourBounds); err != nil {
+		return Window{}, fmt.Errorf("window %q: %w", s, err)
+	}
+	if w.dom, err = parseField(fs[2], domBounds); err != nil {
+		return Window{}, fmt.Errorf("window %q: %w", s, err)
+	}
+	if w.month, err = parseField(fs[3], monthBounds); err != nil {
+		return Window{}, fmt.Errorf("window %q: %w", s, err)
+	}
+	if w.dow, err = parseField(fs[4], dowBounds); err != nil {
+		return Window{}, fmt.Errorf("window %q: %w", s, err)
+	}
+	// Sunday can be written as 0 or 7
+	if w.dow.has(7) {
+		w.dow |= 1
+	}
+	w.domRestricted = fs[2] != "*"
+	w.dowRestricted = fs[4] != "*"
+
+	w.Duration, err = time.ParseDuration(fs[5])
+	if err != nil {
+		return Window{}, fmt.Errorf("window %q: invalid duration: %w", s, err)
+	}
+	if w.Duration < time.Minute {
+		return Window{}, fmt.Errorf("window %q: duration must be at least one minute", s)
+	}
+	return w, nil
+}
+
+func parseField(s string, b bounds) (field, error) {
+	var f field
+	for _, item := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s field %q", b.name, item)
+			}
+			item = item[:i]
+		}
+
+		lo, hi := b.min, b.max
+		switch {
+		case item == "*":
+		case strings.Contains(item, "-"):
+			parts := strings.SplitN(item, "-", 2)
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(parts[0])
+			hi, err2 = strconv.Atoi(parts[1])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range in %s field %q", b.name, item)
+			}
+		default:
+			v, err := strconv.Atoi(item)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in %s field %q", b.name, item)
+			}
+			lo, hi = v, v
+			if step != 1 {
+				// `5/10` means starting at 5 every 10
+				hi = b.max
+			}
+		}
+		if lo < b.min || hi > b.max || lo > hi {
+			return 0, fmt.Errorf("%s field %q out of range %d-%d", b.name, item, b.min, b.max)
+		}
+		for v := lo; v <= hi; v += step {
+			f |= 1 << uint(v)
+		}
+	}
+	if f == 0 {
+		return 0, errors.New("empty " + b.name + " field")
+	}
+	return f, nil
+}
+
+func (f field) has(v int) bool {
+	return f&(1<<uint(v)) != 0
+}
+
+// opensAt returns whether the window opens at the minute of t
+func (w Window) opensAt(t time.Time) bool {
+	return w.minute.has(t.Minute()) && w.hour.has(t.Hour()) && w.month.has(int(t.Month())) && w.opensOn(t)
+}
+
+// opensOn returns whether the day fields match the day of t
+func (w Window) opensOn(t time.Time) bool {
+	domMatch := w.dom.has(t.Day())
+	dowMatch := w.dow.has(int(t.Weekday()))
+	// Standard cron behavior: if both day fields are restricted, either of them may match
+	if w.domRestricted && w.dowRestricted {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// Open returns whether the window is open at time t.
+// Windows are evaluated in UTC.
+func (w Window) Open(t time.Time) bool {
+	t = t.UTC().Truncate(time.Minute)
+	for s := t; t.Sub(s) < w.Duration; s = s.Add(-time.Minute) {
+		if w.opensAt(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the next time after t at which the window opens, in UTC.
+// It returns the zero time if the window never opens.
+func (w Window) Next(t time.Time) time.Time {
+	start := t.UTC().Truncate(time.Minute).Add(time.Minute)
+	// Skip whole months, days and hours that do not match, so even rare windows take only a few thousand steps
+	for s := start; s.Sub(start) < maxLookahead; {
+		switch {
+		case !w.month.has(int(s.Month())):
+			s = time.Date(s.Year(), s.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !w.opensOn(s):
+			s = time.Date(s.Year(), s.Month(), s.Day()+1, 0, 0, 0, 0, time.UTC)
+		case !w.hour.has(s.Hour()):
+			s = time.Date(s.Year(), s.Month(), s.Day(), s.Hour()+1, 0, 0, 0, time.UTC)
+		case !w.minute.has(s.Minute()):
+			s = s.Add(time.Minute)
+		default:
+			return s
+		}
+	}
+	return time.Time{}
+}
+
+// Open returns whether any of the windows is open at time t.
+// If there are no windows, it always returns true.
+func (ws Windows) Open(t time.Time) bool {
+	if len(ws) == 0 {
+		return true
+	}
+	for _, w := range ws {
+		if w.Open(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the earliest time after t at which any of the windows opens.
+// It returns the zero time if none of the windows ever opens.
+func (ws Windows) Next(t time.Time) time.Time {
+	next := time.Time{}
+	for _, w := range ws {
+		n := w.Next(t)
+		if !n.IsZero() && (next.IsZero() || n.Before(next)) {
+			next = n
+		}
+	}
+	return next
+}
@@ -0,0 +1,186 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestParse(t *testing.T) {
+	tcs := map[string]struct {
+		in    string
+		count int
+		fail  bool
+	}{
+		"empty": {
+			in:    "",
+			count: 0,
+		},
+		"single": {
+			in:    "0 22 * * 1-5 4h",
+			count: 1,
+		},
+		"multiple": {
+			in:    "0 22 * * 1-5 4h; */30 6 1,15 * 0,6 30m",
+			count: 2,
+		},
+		"missing duration": {
+			in:   "0 22 * * 1-5",
+			fail: true,
+		},
+		"invalid duration": {
+			in:   "0 22 * * 1-5 forever",
+			fail: true,
+		},
+		"out of range": {
+			in:   "0 24 * * * 1h",
+			fail: true,
+		},
+		"invalid range": {
+			in:   "0 5-2 * * * 1h",
+			fail: true,
+		},
+		"invalid step": {
+			in:   "*/0 * * * * 1h",
+			fail: true,
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			ws, err := Parse(tc.in)
+			if tc.fail {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, ws, tc.count)
+		})
+	}
+}
+
+func TestWindowsOpen(t *testing.T) {
+	tcs := map[string]struct {
+		windows string
+		at      string
+		open    bool
+	}{
+		"no windows": {
+			windows: "",
+			at:      "2021-06-02T12:00:00Z",
+			open:    true,
+		},
+		"at start": {
+			windows: "0 22 * * 1-5 4h",
+			at:      "2021-06-02T22:00:00Z", // Wednesday
+			open:    true,
+		},
+		"past midnight": {
+			windows: "0 22 * * 1-5 4h",
+			at:      "2021-06-03T01:59:59Z",
+			open:    true,
+		},
+		"after end": {
+			windows: "0 22 * * 1-5 4h",
+			at:      "2021-06-03T02:00:00Z",
+			open:    false,
+		},
+		"wrong day": {
+			windows: "0 22 * * 1-5 4h",
+			at:      "2021-06-05T22:30:00Z", // Saturday
+			open:    false,
+		},
+		"sunday as 7": {
+			windows: "0 10 * * 7 1h",
+			at:      "2021-06-06T10:30:00Z",
+			open:    true,
+		},
+		"in UTC": {
+			windows: "0 22 * * * 1h",
+			at:      "2021-06-02T23:00:00+02:00",
+			open:    false,
+		},
+		"second window": {
+			windows: "0 22 * * 1-5 4h; 0 6 * * 0,6 12h",
+			at:      "2021-06-05T12:00:00Z",
+			open:    true,
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			ws, err := Parse(tc.windows)
+			require.NoError(t, err)
+			assert.Equal(t, tc.open, ws.Open(mustTime(tc.at)))
+		})
+	}
+}
+
+func TestWindowsNext(t *testing.T) {
+	tcs := map[string]struct {
+		windows string
+		at      string
+		next    string
+	}{
+		"same day": {
+			windows: "0 22 * * 1-5 4h",
+			at:      "2021-06-02T12:00:00Z",
+			next:    "2021-06-02T22:00:00Z",
+		},
+		"next week": {
+			windows: "0 22 * * 1-5 4h",
+			at:      "2021-06-04T23:00:00Z", // Friday
+			next:    "2021-06-07T22:00:00Z",
+		},
+		"earliest of multiple": {
+			windows: "0 22 * * 1-5 4h; 0 6 * * 0,6 12h",
+			at:      "2021-06-04T23:00:00Z",
+			next:    "2021-06-05T06:00:00Z",
+		},
+		"day of month or day of week": {
+			windows: "0 0 13 * 5 1h",
+			at:      "2021-06-02T00:00:00Z",
+			next:    "2021-06-04T00:00:00Z",
+		},
+		"next year": {
+			windows: "0 0 1 1 * 1h",
+			at:      "2021-06-02T00:00:00Z",
+			next:    "2022-01-01T00:00:00Z",
+		},
+		"leap day": {
+			windows: "0 0 29 2 * 1h",
+			at:      "2021-06-02T00:00:00Z",
+			next:    "2024-02-29T00:00:00Z",
+		},
+		"in UTC": {
+			windows: "0 22 * * * 1h",
+			at:      "2021-06-02T23:00:00+02:00",
+			next:    "2021-06-02T22:00:00Z",
+		},
+		"never": {
+			windows: "0 0 30 2 * 1h",
+			at:      "2021-06-02T00:00:00Z",
+			next:    "",
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			ws, err := Parse(tc.windows)
+			require.NoError(t, err)
+			next := ws.Next(mustTime(tc.at))
+			if tc.next == "" {
+				assert.True(t, next.IsZero())
+				return
+			}
+			assert.Equal(t, mustTime(tc.next), next)
+		})
+	}
+}
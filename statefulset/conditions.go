@@ -0,0 +1,191 @@
+package statefulset
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ConditionsAnnotation holds the conditions of the resize as a versioned list of metav1.Condition.
+// It is the stable contract for tools observing resizes, the other annotations are internal state of the controller.
+const ConditionsAnnotation = "sts-resize.vshn.net/conditions"
+
+// ConditionsVersion is the version of the format of ConditionsAnnotation
+const ConditionsVersion = 1
+
+// The types of the conditions of a resize
+const (
+	// ConditionDetected is true while a resize is planned or in progress
+	ConditionDetected = "Detected"
+	// ConditionScaledDown is true once the StatefulSet was scaled down for the resize
+	ConditionScaledDown = "ScaledDown"
+	// ConditionBackedUp is true once all PVCs are backed up
+	ConditionBackedUp = "BackedUp"
+	// ConditionRestored is true once all PVCs are restored with their target size
+	ConditionRestored = "Restored"
+	// ConditionScaledUp is true once the StatefulSet was scaled back up after the resize
+	ConditionScaledUp = "ScaledUp"
+	// ConditionFailed is true if the resize failed and needs human intervention
+	ConditionFailed = "Failed"
+	// ConditionBlocked is true while a resize is held back before it started, for example by a PodDisruptionBudget
+	ConditionBlocked = "Blocked"
+)
+
+// ConditionList is the content of ConditionsAnnotation
+type ConditionList struct {
+	Version    int                `json:"version"`
+	Conditions []metav1.Condition `json:"conditions"`
+}
+
+// ParseConditions parses the value of ConditionsAnnotation
+func ParseConditions(v string) ([]metav1.Condition, error) {
+	list := ConditionList{}
+	if err := json.Unmarshal([]byte(v), &list); err != nil {
+		return nil, fmt.Errorf("annotation %s malformed: %w", ConditionsAnnotation, err)
+	}
+	if list.Version != ConditionsVersion {
+		return nil, fmt.Errorf("annotation %s has unsupported version %d", ConditionsAnnotation, list.Version)
+	}
+	return list.Conditions, nil
+}
+
+// Conditions returns the conditions recorded on the StatefulSet.
+// It returns nil if none are recorded.
+func (s Entity) Conditions() ([]metav1.Condition, error) {
+	v, ok := s.sts.Annotations[ConditionsAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	return ParseConditions(v)
+}
+
+// UpdateConditions derives the conditions from the state of the resize and records them on the StatefulSet.
+// StatefulSets resized by older versions of the controller have no conditions yet, or an unknown format.
+// Their conditions are derived from the state in the other annotations alone.
+// A condition, including its generation, is only updated when its status, reason or message changes.
+// The transition time of a condition is only set to now when its status changes.
+func (s *Entity) UpdateConditions(now metav1.Time) error {
+	conds, err := s.Conditions()
+	if err != nil {
+		conds = nil
+	}
+	set := func(t string, status bool, reason, msg string) {
+		s.setCondition(&conds, t, status, reason, msg, now)
+	}
+	isTrue := func(t string) bool {
+		return meta.IsStatusConditionTrue(conds, t)
+	}
+
+	resizing := s.Started() || s.Resizing()
+	wasResizing := isTrue(ConditionDetected)
+	if resizing {
+		set(ConditionDetected, true, "ResizePlanned", "A resize is planned or in progress")
+	} else {
+		set(ConditionDetected, false, "NotResizing", "No resize is planned or in progress")
+	}
+	if resizing && !wasResizing {
+		// A new resize starts from scratch
+		for _, t := range []string{ConditionScaledDown, ConditionBackedUp, ConditionRestored, ConditionScaledUp} {
+			set(t, false, "Pending", "")
+		}
+	}
+
+	scaledDown := s.sts.Spec.Replicas != nil && *s.sts.Spec.Replicas == 0
+	if s.Started() && !s.isScalingUp() && scaledDown && !isTrue(ConditionScaledDown) {
+		set(ConditionScaledDown, true, "ScaledDown",
+			fmt.Sprintf("Scaled down from %s replicas", s.sts.Annotations[ReplicasAnnotation]))
+	}
+	if s.Started() && s.Resizing() && !isTrue(ConditionBackedUp) {
+		backedUp := true
+		for _, pi := range s.Pvcs {
+			backedUp = backedUp && pi.BackedUp
+		}
+		if backedUp {
+			set(ConditionBackedUp, true, "BackedUp", "All PVCs are backed up")
+		}
+	}
+	if s.Started() && !s.Resizing() && !isTrue(ConditionRestored) {
+		if s.AbortRequested() {
+			set(ConditionRestored, false, "Aborted", "The resize was aborted")
+		} else {
+			set(ConditionRestored, true, "Restored", "All PVCs are restored with their target size")
+		}
+	}
+	switch {
+	case s.isScalingUp():
+		set(ConditionScaledUp, false, "ScalingUp", "")
+	case wasResizing && !resizing && s.sts.Annotations[MigratedToAnnotation] != "" &&
+		s.Old.Annotations[MigrateToAnnotation] == s.sts.Annotations[MigratedToAnnotation]:
+		set(ConditionScaledUp, false, "Migrated",
+			fmt.Sprintf("The PVCs were migrated to namespace %s, the StatefulSet stays scaled down", s.sts.Annotations[MigratedToAnnotation]))
+	case wasResizing && !resizing && isTrue(ConditionScaledDown):
+		set(ConditionScaledUp, true, "ScaledUp", "Scaled back up to the original replicas")
+	}
+	if s.Failed() {
+		set(ConditionFailed, true, "ResizeFailed", "The resize failed, see the events of the StatefulSet")
+	} else {
+		set(ConditionFailed, false, "NotFailed", "")
+	}
+
+	return s.setConditions(conds)
+}
+
+// SetBlocked records that the resize is held back for the reason, or that it is not held back anymore if reason is empty.
+// It returns whether the condition changed, and since when the resize is held back.
+func (s *Entity) SetBlocked(reason, msg string, now metav1.Time) (bool, time.Time, error) {
+	conds, err := s.Conditions()
+	if err != nil {
+		conds = nil
+	}
+	if reason == "" && meta.FindStatusCondition(conds, ConditionBlocked) == nil {
+		return false, time.Time{}, nil
+	}
+	var changed bool
+	if reason == "" {
+		changed = s.setCondition(&conds, ConditionBlocked, false, "NotBlocked", "", now)
+	} else {
+		changed = s.setCondition(&conds, ConditionBlocked, true, reason, msg, now)
+	}
+	since := meta.FindStatusCondition(conds, ConditionBlocked).LastTransitionTime.Time
+	if !changed {
+		return false, since, nil
+	}
+	return true, since, s.setConditions(conds)
+}
+
+// setCondition sets the condition, unless its status, reason and message are unchanged.
+// It returns whether the condition changed.
+func (s Entity) setCondition(conds *[]metav1.Condition, t string, status bool, reason, msg string, now metav1.Time) bool {
+	c := metav1.Condition{
+		Type:               t,
+		Status:             metav1.ConditionFalse,
+		Reason:             reason,
+		Message:            msg,
+		ObservedGeneration: s.sts.Generation,
+		LastTransitionTime: now,
+	}
+	if status {
+		c.Status = metav1.ConditionTrue
+	}
+	if found := meta.FindStatusCondition(*conds, t); found != nil &&
+		found.Status == c.Status && found.Reason == c.Reason && found.Message == c.Message {
+		return false
+	}
+	meta.SetStatusCondition(conds, c)
+	return true
+}
+
+func (s *Entity) setConditions(conds []metav1.Condition) error {
+	v, err := json.Marshal(ConditionList{Version: ConditionsVersion, Conditions: conds})
+	if err != nil {
+		return err
+	}
+	if s.sts.Annotations == nil {
+		s.sts.Annotations = map[string]string{}
+	}
+	s.sts.Annotations[ConditionsAnnotation] = string(v)
+	return nil
+}
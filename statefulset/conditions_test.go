@@ -0,0 +1,189 @@
+package statefulset
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
+)
+
+func conditionStatus(t *testing.T, si *Entity) map[string]string {
+	conds, err := si.Conditions()
+	require.NoError(t, err)
+	status := map[string]string{}
+	for _, c := range conds {
+		status[c.Type] = string(c.Status) + "/" + c.Reason
+	}
+	return status
+}
+
+func TestUpdateConditionsMigratesLegacyState(t *testing.T) {
+	tcs := map[string]struct {
+		annotations map[string]string
+		labels      map[string]string
+		replicas    int32
+		backedUp    bool
+		expected    map[string]string
+	}{
+		"planned": {
+			replicas: 3,
+			expected: map[string]string{
+				ConditionDetected:   "True/ResizePlanned",
+				ConditionScaledDown: "False/Pending",
+				ConditionBackedUp:   "False/Pending",
+				ConditionRestored:   "False/Pending",
+				ConditionScaledUp:   "False/Pending",
+				ConditionFailed:     "False/NotFailed",
+			},
+		},
+		"backed up": {
+			annotations: map[string]string{ReplicasAnnotation: "3"},
+			backedUp:    true,
+			expected: map[string]string{
+				ConditionDetected:   "True/ResizePlanned",
+				ConditionScaledDown: "True/ScaledDown",
+				ConditionBackedUp:   "True/BackedUp",
+				ConditionRestored:   "False/Pending",
+				ConditionScaledUp:   "False/Pending",
+				ConditionFailed:     "False/NotFailed",
+			},
+		},
+		"failed": {
+			annotations: map[string]string{ReplicasAnnotation: "3"},
+			labels:      map[string]string{FailedLabel: "true"},
+			expected: map[string]string{
+				ConditionDetected:   "True/ResizePlanned",
+				ConditionScaledDown: "True/ScaledDown",
+				ConditionBackedUp:   "False/Pending",
+				ConditionRestored:   "False/Pending",
+				ConditionScaledUp:   "False/Pending",
+				ConditionFailed:     "True/ResizeFailed",
+			},
+		},
+		"unsupported format": {
+			annotations: map[string]string{
+				ReplicasAnnotation:   "3",
+				ScaleUpAnnotation:    "true",
+				ConditionsAnnotation: `{"version":99}`,
+			},
+			replicas: 3,
+			expected: map[string]string{
+				ConditionDetected:   "True/ResizePlanned",
+				ConditionScaledDown: "False/Pending",
+				ConditionBackedUp:   "False/Pending",
+				ConditionRestored:   "True/Restored",
+				ConditionScaledUp:   "False/ScalingUp",
+				ConditionFailed:     "False/NotFailed",
+			},
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			si, err := NewEntity(&appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Annotations: tc.annotations, Labels: tc.labels},
+				Spec:       appsv1.StatefulSetSpec{Replicas: pointer.Int32(tc.replicas)},
+			})
+			require.NoError(t, err)
+			if !si.isScalingUp() {
+				pi := pvc.NewEntity(corev1.PersistentVolumeClaim{}, resource.MustParse("2G"), nil)
+				pi.BackedUp = tc.backedUp
+				si.Pvcs = []pvc.Entity{pi}
+			}
+
+			require.NoError(t, si.UpdateConditions(metav1.Now()))
+			assert.Equal(t, tc.expected, conditionStatus(t, si))
+		})
+	}
+}
+
+func TestUpdateConditionsLifecycle(t *testing.T) {
+	start := metav1.NewTime(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	end := metav1.NewTime(start.Add(time.Hour))
+
+	si, err := NewEntity(&appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{ReplicasAnnotation: "3"}},
+		Spec:       appsv1.StatefulSetSpec{Replicas: pointer.Int32(0)},
+	})
+	require.NoError(t, err)
+	si.Pvcs = []pvc.Entity{pvc.NewEntity(corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data-web-0", Namespace: "foo"},
+	}, resource.MustParse("2G"), nil)}
+	require.NoError(t, si.UpdateConditions(start))
+
+	// The resize completed and the state was cleared
+	sts, err := si.StatefulSet()
+	require.NoError(t, err)
+	si, err = NewEntity(sts)
+	require.NoError(t, err)
+	si.Pvcs = []pvc.Entity{}
+	si.clearOriginalReplicaCount()
+	si.sts.Spec.Replicas = pointer.Int32(3)
+	require.NoError(t, si.UpdateConditions(end))
+
+	assert.Equal(t, map[string]string{
+		ConditionDetected:   "False/NotResizing",
+		ConditionScaledDown: "True/ScaledDown",
+		ConditionBackedUp:   "False/Pending",
+		ConditionRestored:   "False/Pending",
+		ConditionScaledUp:   "True/ScaledUp",
+		ConditionFailed:     "False/NotFailed",
+	}, conditionStatus(t, si))
+	conds, err := si.Conditions()
+	require.NoError(t, err)
+	assert.True(t, meta.FindStatusCondition(conds, ConditionScaledDown).LastTransitionTime.Equal(&start), "unchanged condition keeps its time")
+	assert.True(t, meta.FindStatusCondition(conds, ConditionScaledUp).LastTransitionTime.Equal(&end))
+}
+
+func TestUpdateConditionsMigration(t *testing.T) {
+	si, err := NewEntity(&appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Annotations: map[string]string{
+			ReplicasAnnotation:  "3",
+			MigrateToAnnotation: "bar",
+		}},
+		Spec: appsv1.StatefulSetSpec{Replicas: pointer.Int32(0)},
+	})
+	require.NoError(t, err)
+	si.Pvcs = []pvc.Entity{pvc.NewEntity(corev1.PersistentVolumeClaim{}, resource.MustParse("2G"), nil)}
+	require.NoError(t, si.UpdateConditions(metav1.Now()))
+
+	_, err = si.FinishMigration()
+	require.NoError(t, err)
+	require.NoError(t, si.UpdateConditions(metav1.Now()))
+	assert.Equal(t, "False/Migrated", conditionStatus(t, si)[ConditionScaledUp])
+}
+
+func TestUpdateConditionsIgnoresGeneration(t *testing.T) {
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Generation: 1, Annotations: map[string]string{ReplicasAnnotation: "3"}},
+		Spec:       appsv1.StatefulSetSpec{Replicas: pointer.Int32(0)},
+	}
+	si, err := NewEntity(sts)
+	require.NoError(t, err)
+	require.NoError(t, si.UpdateConditions(metav1.Now()))
+	updated, err := si.StatefulSet()
+	require.NoError(t, err)
+
+	// Someone else changed the spec
+	updated = updated.DeepCopy()
+	updated.Generation = 2
+	si, err = NewEntity(updated)
+	require.NoError(t, err)
+	require.NoError(t, si.UpdateConditions(metav1.Now()))
+	assert.False(t, si.Modified(), "unchanged conditions are not written again")
+
+	si.SetFailed()
+	require.NoError(t, si.UpdateConditions(metav1.Now()))
+	conds, err := si.Conditions()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), meta.FindStatusCondition(conds, ConditionFailed).ObservedGeneration)
+	assert.Equal(t, int64(1), meta.FindStatusCondition(conds, ConditionDetected).ObservedGeneration)
+}
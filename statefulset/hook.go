@@ -0,0 +1,63 @@
+package statefulset
+
+import (
+	"strings"
+)
+
+// Hook is a fixed point during the resize at which a user defined Job can run
+type Hook string
+
+const (
+	// HookPreScaleDown runs before the StatefulSet is scaled down
+	HookPreScaleDown Hook = "pre-scale-down"
+	// HookPostBackup runs after all PVCs are backed up, before any PVC is recreated
+	HookPostBackup Hook = "post-backup"
+	// HookPostScaleUp runs after the StatefulSet is scaled back up
+	HookPostScaleUp Hook = "post-scale-up"
+)
+
+// HookAnnotationPrefix is the prefix of the annotations referencing the ConfigMap with the Job template of a hook.
+// For example `sts-resize.vshn.net/hook-pre-scale-down`.
+const HookAnnotationPrefix = "sts-resize.vshn.net/hook-"
+
+// HooksCompletedAnnotation stores the hooks that completed during the current resize
+const HooksCompletedAnnotation = "sts-resize.vshn.net/hooks-completed"
+
+// HookTemplate returns the name of the ConfigMap containing the Job template of the hook, if any
+func (s Entity) HookTemplate(h Hook) string {
+	return s.sts.Annotations[HookAnnotationPrefix+string(h)]
+}
+
+// HookCompleted returns whether the hook completed during the current resize
+func (s Entity) HookCompleted(h Hook) bool {
+	for _, c := range s.completedHooks() {
+		if c == string(h) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetHookCompleted marks the hook as completed for the current resize
+func (s *Entity) SetHookCompleted(h Hook) {
+	if s.HookCompleted(h) {
+		return
+	}
+	if s.sts.Annotations == nil {
+		s.sts.Annotations = map[string]string{}
+	}
+	s.sts.Annotations[HooksCompletedAnnotation] = strings.Join(append(s.completedHooks(), string(h)), ",")
+}
+
+// ResetHooks forgets about all completed hooks
+func (s Entity) ResetHooks() {
+	delete(s.sts.Annotations, HooksCompletedAnnotation)
+}
+
+func (s Entity) completedHooks() []string {
+	v := s.sts.Annotations[HooksCompletedAnnotation]
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
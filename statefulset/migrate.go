@@ -0,0 +1,54 @@
+package statefulset
+
+import "fmt"
+
+// MigrateToAnnotation requests to migrate the PVCs of the StatefulSet to another namespace.
+const MigrateToAnnotation = "sts-resize.vshn.net/migrate-to"
+
+// MigratedToAnnotation records the namespace the PVCs of the StatefulSet were migrated to.
+const MigratedToAnnotation = "sts-resize.vshn.net/migrated-to"
+
+// MigrateTo returns the namespace the PVCs of the StatefulSet should be migrated to.
+// It returns an empty string if no migration is requested, or if the PVCs were already migrated to that namespace.
+func (s Entity) MigrateTo() string {
+	ns := s.sts.Annotations[MigrateToAnnotation]
+	if ns == s.sts.Namespace || ns == s.sts.Annotations[MigratedToAnnotation] {
+		return ""
+	}
+	return ns
+}
+
+// FinishMigration records the completed migration and clears the state of the resize.
+// The annotation requesting the migration belongs to the user and is kept, the recorded target namespace keeps it from starting again.
+// The StatefulSet stays scaled down, as its data now lives in another namespace.
+// It returns the number of replicas before the StatefulSet was scaled down.
+func (s *Entity) FinishMigration() (int32, error) {
+	ns := s.MigrateTo()
+	if ns == "" {
+		return 0, fmt.Errorf("no migration in progress")
+	}
+	replicas, err := s.getOriginalReplicaCount()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get original scale as %s is not readable: %w", ReplicasAnnotation, err)
+	}
+	s.sts.Annotations[MigratedToAnnotation] = ns
+	s.clearOriginalReplicaCount()
+	s.clearApproval()
+	s.ResetHooks()
+	s.Pvcs = nil
+	return replicas, nil
+}
+
+// Migrating returns whether the started resize migrates the PVCs to another namespace.
+func (s Entity) Migrating() bool {
+	ns := s.MigrateTo()
+	if ns == "" || !s.Started() {
+		return false
+	}
+	for _, pi := range s.Pvcs {
+		if pi.TargetNamespace != ns {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package statefulset
+
+import (
+	"reflect"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+// OwnedPrefix is the prefix of the annotations and labels managed by the controller
+const OwnedPrefix = "sts-resize.vshn.net/"
+
+// Modified returns whether any of the fields managed by the controller were changed since the StatefulSet was read
+func (s Entity) Modified() bool {
+	return !ownedEqual(s.Old, s.sts)
+}
+
+// ChangedIn returns whether any of the fields managed by the controller differ in current from the StatefulSet that was read.
+// If they do, the state of the entity is stale and must not be written.
+func (s Entity) ChangedIn(current *appsv1.StatefulSet) bool {
+	return !ownedEqual(s.Old, current)
+}
+
+// ApplyTo returns a copy of base with the fields managed by the controller taken from the entity.
+// These are the annotations and labels with the OwnedPrefix, the replicas and the PVC retention policy.
+// All other fields are kept as they are in base, so we do not overwrite the changes of others.
+func (s Entity) ApplyTo(base *appsv1.StatefulSet) *appsv1.StatefulSet {
+	sts := base.DeepCopy()
+	sts.Annotations = withOwned(base.Annotations, s.sts.Annotations)
+	sts.Labels = withOwned(base.Labels, s.sts.Labels)
+	sts.Spec.Replicas = nil
+	if s.sts.Spec.Replicas != nil {
+		r := *s.sts.Spec.Replicas
+		sts.Spec.Replicas = &r
+	}
+	sts.Spec.PersistentVolumeClaimRetentionPolicy = s.sts.Spec.PersistentVolumeClaimRetentionPolicy.DeepCopy()
+	return sts
+}
+
+func ownedEqual(a, b *appsv1.StatefulSet) bool {
+	return reflect.DeepEqual(owned(a.Annotations), owned(b.Annotations)) &&
+		reflect.DeepEqual(owned(a.Labels), owned(b.Labels)) &&
+		reflect.DeepEqual(a.Spec.Replicas, b.Spec.Replicas) &&
+		reflect.DeepEqual(a.Spec.PersistentVolumeClaimRetentionPolicy, b.Spec.PersistentVolumeClaimRetentionPolicy)
+}
+
+func owned(m map[string]string) map[string]string {
+	res := map[string]string{}
+	for k, v := range m {
+		if strings.HasPrefix(k, OwnedPrefix) {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// withOwned returns the entries of base not managed by the controller, and the managed entries of m
+func withOwned(base, m map[string]string) map[string]string {
+	res := owned(m)
+	for k, v := range base {
+		if !strings.HasPrefix(k, OwnedPrefix) {
+			res[k] = v
+		}
+	}
+	if len(res) == 0 && base == nil {
+		return nil
+	}
+	return res
+}
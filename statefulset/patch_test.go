@@ -0,0 +1,46 @@
+package statefulset
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+)
+
+func TestApplyTo(t *testing.T) {
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Annotations: map[string]string{AbortAnnotation: "true", "other": "a"},
+		},
+		Spec: appsv1.StatefulSetSpec{Replicas: pointer.Int32(2)},
+	}
+	si, err := NewEntity(sts)
+	require.NoError(t, err)
+	assert.False(t, si.Modified())
+
+	si.ClearAbort()
+	si.SetFailed()
+	require.False(t, si.PrepareScaleDown())
+	assert.True(t, si.Modified())
+
+	current := sts.DeepCopy()
+	current.Annotations["other"] = "b"
+	current.Labels = map[string]string{"app": "web"}
+	current.Spec.ServiceName = "web"
+	assert.False(t, si.ChangedIn(current), "only fields of others changed")
+
+	found := si.ApplyTo(current)
+	assert.Equal(t, map[string]string{"other": "b", ReplicasAnnotation: "2"}, found.Annotations)
+	assert.Equal(t, map[string]string{"app": "web", FailedLabel: "true"}, found.Labels)
+	assert.Equal(t, int32(0), *found.Spec.Replicas)
+	assert.Equal(t, "web", found.Spec.ServiceName)
+	assert.Equal(t, "b", current.Annotations["other"], "base is not modified")
+	assert.Equal(t, int32(2), *current.Spec.Replicas, "base is not modified")
+
+	current.Annotations[MaintenanceWindowAnnotation] = "Sun 02:00-04:00"
+	assert.True(t, si.ChangedIn(current))
+}
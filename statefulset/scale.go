@@ -3,6 +3,9 @@ package statefulset
 import (
 	"fmt"
 	"strconv"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
+	appsv1 "k8s.io/api/apps/v1"
 )
 
 // ReplicasAnnotation stores the initial number of replicas before scaling down the StatefulSet.
@@ -11,6 +14,12 @@ const ReplicasAnnotation = "sts-resize.vshn.net/replicas"
 // ScaleUpAnnotation marks a replica as in the process of scaling back up and prevents the controller from scaling it down.
 const ScaleUpAnnotation = "sts-resize.vshn.net/scalup"
 
+// RestartAnnotation marks a resize that failed and scaled the StatefulSet back up, it starts over once the failure is cleared
+const RestartAnnotation = "sts-resize.vshn.net/restart"
+
+// WhenScaledAnnotation stores the original whenScaled PVC retention policy while the StatefulSet is scaled down.
+const WhenScaledAnnotation = "sts-resize.vshn.net/when-scaled"
+
 // PrepareScaleDown changes the replica to 0, if applicable.
 // It saves the original state and returns true if it ran successfully before and the StatefulSet is scaled to 0.
 func (s *Entity) PrepareScaleDown() bool {
@@ -18,6 +27,7 @@ func (s *Entity) PrepareScaleDown() bool {
 		return true
 	}
 	s.saveOriginalReplicaCount()
+	s.retainWhenScaled()
 	r := int32(0)
 	s.sts.Spec.Replicas = &r
 	return false
@@ -33,6 +43,9 @@ func (s Entity) PrepareScaleUp() (bool, error) {
 	if s.isScaledUp(scale) {
 		s.unmarkScalingUp()
 		s.clearOriginalReplicaCount()
+		s.restoreWhenScaled()
+		s.clearApproval()
+		s.ResetHooks()
 		return true, nil
 	}
 	s.markScalingUp()
@@ -40,6 +53,35 @@ func (s Entity) PrepareScaleUp() (bool, error) {
 	return false, nil
 }
 
+// ScaledUp returns whether the StatefulSet is in the process of scaling up and reached its original replica count.
+func (s Entity) ScaledUp() (bool, error) {
+	if !s.isScalingUp() {
+		return false, nil
+	}
+	scale, err := s.getOriginalReplicaCount()
+	if err != nil {
+		return false, fmt.Errorf("failed to get original scale as %s is not readable: %w", ReplicasAnnotation, err)
+	}
+	return s.isScaledUp(scale), nil
+}
+
+// ScalingUp returns whether the StatefulSet is being scaled back up after the resize
+func (s Entity) ScalingUp() bool {
+	return s.isScalingUp()
+}
+
+// ScaledExternally returns whether someone else changed the replicas while the StatefulSet should be scaled down.
+func (s Entity) ScaledExternally() bool {
+	return s.Started() && !s.isScalingUp() &&
+		s.sts.Spec.Replicas != nil && *s.sts.Spec.Replicas != 0
+}
+
+// ForceScaleDown scales the StatefulSet down to 0, without touching the saved original replicas.
+func (s *Entity) ForceScaleDown() {
+	r := int32(0)
+	s.sts.Spec.Replicas = &r
+}
+
 func (s Entity) isScaledDown() bool {
 	// NOTE(glrf) Checking CurrentRevision is important to prevent a race condition.
 	// This makes sure that the k8s controller manager ran before us and that the set status is correct and not just uninitialized
@@ -50,10 +92,31 @@ func (s Entity) isScaledDown() bool {
 }
 
 func (s Entity) isScaledUp(scale int32) bool {
-	return s.sts.Spec.Replicas != nil &&
-		*s.sts.Spec.Replicas == scale &&
-		s.sts.Status.CurrentRevision != "" &&
-		s.sts.Status.Replicas == scale
+	// NOTE We only consider the StatefulSet scaled up once all replicas are ready and available, and the status reflects the current spec.
+	// Otherwise we would declare success while the application still fails to start on the new volumes.
+	st := s.sts.Status
+	if s.sts.Spec.Replicas == nil || *s.sts.Spec.Replicas != scale ||
+		st.CurrentRevision == "" || st.ObservedGeneration < s.sts.Generation {
+		return false
+	}
+	if st.Replicas != scale || st.ReadyReplicas != scale || st.AvailableReplicas != scale {
+		return false
+	}
+	// Pods are only updated to the latest revision by a rolling update of all ordinals.
+	// With OnDelete or a partition, some replicas legitimately stay on an older revision.
+	if s.rollsOutAllReplicas() && st.UpdatedReplicas != scale {
+		return false
+	}
+	return true
+}
+
+// rollsOutAllReplicas returns whether the update strategy of the StatefulSet updates every pod to the latest revision
+func (s Entity) rollsOutAllReplicas() bool {
+	strategy := s.sts.Spec.UpdateStrategy
+	if strategy.Type != "" && strategy.Type != appsv1.RollingUpdateStatefulSetStrategyType {
+		return false
+	}
+	return strategy.RollingUpdate == nil || strategy.RollingUpdate.Partition == nil || *strategy.RollingUpdate.Partition == 0
 }
 
 func (s Entity) saveOriginalReplicaCount() {
@@ -91,3 +154,89 @@ func (s Entity) isScalingUp() bool {
 func (s *Entity) unmarkScalingUp() {
 	delete(s.sts.Annotations, ScaleUpAnnotation)
 }
+
+// retainWhenScaled makes sure the StatefulSet does not delete its PVCs while we scale it down.
+// The original policy is saved to restore it after scaling up.
+func (s *Entity) retainWhenScaled() {
+	p := s.sts.Spec.PersistentVolumeClaimRetentionPolicy
+	if p == nil || p.WhenScaled != appsv1.DeletePersistentVolumeClaimRetentionPolicyType {
+		return
+	}
+	if s.sts.Annotations == nil {
+		s.sts.Annotations = map[string]string{}
+	}
+	s.sts.Annotations[WhenScaledAnnotation] = string(p.WhenScaled)
+	p.WhenScaled = appsv1.RetainPersistentVolumeClaimRetentionPolicyType
+}
+
+func (s *Entity) restoreWhenScaled() {
+	v, ok := s.sts.Annotations[WhenScaledAnnotation]
+	if !ok {
+		return
+	}
+	if s.sts.Spec.PersistentVolumeClaimRetentionPolicy == nil {
+		s.sts.Spec.PersistentVolumeClaimRetentionPolicy = &appsv1.StatefulSetPersistentVolumeClaimRetentionPolicy{
+			WhenDeleted: appsv1.RetainPersistentVolumeClaimRetentionPolicyType,
+		}
+	}
+	s.sts.Spec.PersistentVolumeClaimRetentionPolicy.WhenScaled = appsv1.PersistentVolumeClaimRetentionPolicyType(v)
+	delete(s.sts.Annotations, WhenScaledAnnotation)
+}
+
+// Rollback ends the resize without completing it.
+// It restores the original replicas and PVC retention policy, and clears the state of the resize.
+// The StatefulSet is marked as failed, otherwise the controller would start the same resize again right away.
+func (s *Entity) Rollback() error {
+	if s.Started() {
+		scale, err := s.getOriginalReplicaCount()
+		if err != nil {
+			return fmt.Errorf("failed to get original scale as %s is not readable: %w", ReplicasAnnotation, err)
+		}
+		s.sts.Spec.Replicas = &scale
+	}
+	s.unmarkScalingUp()
+	s.clearOriginalReplicaCount()
+	delete(s.sts.Annotations, RestartAnnotation)
+	s.restoreWhenScaled()
+	s.clearApproval()
+	s.ResetHooks()
+	s.Pvcs = []pvc.Entity{}
+	s.SetFailed()
+	return nil
+}
+
+// ScaleUpAfterFailure scales the StatefulSet back up after the resize failed, see PrepareScaleUp.
+// The pods write to the original PVCs again, so the resize is marked to start over once the failure is cleared, see ResetScaleUp.
+func (s *Entity) ScaleUpAfterFailure() (bool, error) {
+	done, err := s.PrepareScaleUp()
+	if err != nil {
+		return done, err
+	}
+	if s.sts.Annotations == nil {
+		s.sts.Annotations = map[string]string{}
+	}
+	s.sts.Annotations[RestartAnnotation] = "true"
+	return done, nil
+}
+
+// RestartRequired returns whether the resize failed and scaled the StatefulSet back up, and has to start over
+func (s Entity) RestartRequired() bool {
+	return s.sts.Annotations[RestartAnnotation] == "true"
+}
+
+// ResetScaleUp clears the state of a resize that failed and scaled the StatefulSet back up.
+// The pods wrote to the original PVCs since, so the progress of the resize is stale.
+// The next resize starts over, plans the PVCs from their current state and scales the StatefulSet down again.
+// It returns false if the resize does not have to start over.
+func (s *Entity) ResetScaleUp() bool {
+	if !s.RestartRequired() {
+		return false
+	}
+	delete(s.sts.Annotations, RestartAnnotation)
+	s.unmarkScalingUp()
+	s.clearOriginalReplicaCount()
+	s.restoreWhenScaled()
+	s.ResetHooks()
+	s.Pvcs = []pvc.Entity{}
+	return true
+}
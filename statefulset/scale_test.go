@@ -7,6 +7,9 @@ import (
 	"github.com/stretchr/testify/require"
 	appsv1 "k8s.io/api/apps/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
 )
 
 func TestScaledown(t *testing.T) {
@@ -114,6 +117,7 @@ func TestScaleUp(t *testing.T) {
 		annotationState   string
 		annotationReplica string
 		statusReplicas    int32
+		notReadyReplicas  int32
 	}
 	type tCase struct {
 		in   state
@@ -148,6 +152,20 @@ func TestScaleUp(t *testing.T) {
 			},
 			done: false,
 		},
+		"should wait for replicas to be ready": {
+			in: state{
+				replicas:          4,
+				statusReplicas:    4,
+				notReadyReplicas:  1,
+				annotationReplica: "4",
+			},
+			out: state{
+				replicas:          4,
+				statusReplicas:    4,
+				annotationReplica: "4",
+			},
+			done: false,
+		},
 		"should proceed": {
 			in: state{
 				replicas:          4,
@@ -177,6 +195,7 @@ func TestScaleUp(t *testing.T) {
 			require := require.New(t)
 
 			sts := newTestStatfulSet(tc.in.annotationReplica, "", tc.in.replicas, tc.in.statusReplicas)
+			sts.Status.ReadyReplicas -= tc.in.notReadyReplicas
 			si := Entity{
 				sts: &sts,
 			}
@@ -198,6 +217,82 @@ func TestScaleUp(t *testing.T) {
 	}
 }
 
+func TestIsScaledUp(t *testing.T) {
+	onDelete := appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType}
+	partitioned := appsv1.StatefulSetUpdateStrategy{
+		Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+		RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: pointer.Int32(2)},
+	}
+	unpartitioned := appsv1.StatefulSetUpdateStrategy{
+		Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+		RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: pointer.Int32(0)},
+	}
+	tcs := map[string]struct {
+		modify   func(sts *appsv1.StatefulSet)
+		scaledUp bool
+	}{
+		"scaled up": {
+			modify:   func(sts *appsv1.StatefulSet) {},
+			scaledUp: true,
+		},
+		"not ready": {
+			modify:   func(sts *appsv1.StatefulSet) { sts.Status.ReadyReplicas = 2 },
+			scaledUp: false,
+		},
+		"not available": {
+			modify:   func(sts *appsv1.StatefulSet) { sts.Status.AvailableReplicas = 2 },
+			scaledUp: false,
+		},
+		"status outdated": {
+			modify: func(sts *appsv1.StatefulSet) {
+				sts.Generation = 3
+				sts.Status.ObservedGeneration = 2
+			},
+			scaledUp: false,
+		},
+		"status current": {
+			modify: func(sts *appsv1.StatefulSet) {
+				sts.Generation = 3
+				sts.Status.ObservedGeneration = 3
+			},
+			scaledUp: true,
+		},
+		"not updated": {
+			modify:   func(sts *appsv1.StatefulSet) { sts.Status.UpdatedReplicas = 2 },
+			scaledUp: false,
+		},
+		"not updated without partition": {
+			modify: func(sts *appsv1.StatefulSet) {
+				sts.Spec.UpdateStrategy = unpartitioned
+				sts.Status.UpdatedReplicas = 2
+			},
+			scaledUp: false,
+		},
+		"not updated on delete": {
+			modify: func(sts *appsv1.StatefulSet) {
+				sts.Spec.UpdateStrategy = onDelete
+				sts.Status.UpdatedReplicas = 0
+			},
+			scaledUp: true,
+		},
+		"not updated with partition": {
+			modify: func(sts *appsv1.StatefulSet) {
+				sts.Spec.UpdateStrategy = partitioned
+				sts.Status.UpdatedReplicas = 1
+			},
+			scaledUp: true,
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			sts := newTestStatfulSet("3", "true", 3, 3)
+			tc.modify(&sts)
+			si := Entity{sts: &sts}
+			assert.Equal(t, tc.scaledUp, si.isScaledUp(3))
+		})
+	}
+}
+
 func newTestStatfulSet(replicaAnnotation, scaleUpAnnotation string, replicas, statusReplicas int32) appsv1.StatefulSet {
 	return appsv1.StatefulSet{
 		ObjectMeta: metav1.ObjectMeta{
@@ -210,9 +305,106 @@ func newTestStatfulSet(replicaAnnotation, scaleUpAnnotation string, replicas, st
 			Replicas: &replicas,
 		},
 		Status: appsv1.StatefulSetStatus{
-			Replicas:        statusReplicas,
-			CurrentRevision: "revision",
+			Replicas:          statusReplicas,
+			ReadyReplicas:     statusReplicas,
+			AvailableReplicas: statusReplicas,
+			UpdatedReplicas:   statusReplicas,
+			CurrentRevision:   "revision",
 		},
 	}
 
 }
+
+func TestScaleRetainsPVCs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	sts := newTestStatfulSet("", "", 3, 3)
+	sts.Spec.PersistentVolumeClaimRetentionPolicy = &appsv1.StatefulSetPersistentVolumeClaimRetentionPolicy{
+		WhenDeleted: appsv1.DeletePersistentVolumeClaimRetentionPolicyType,
+		WhenScaled:  appsv1.DeletePersistentVolumeClaimRetentionPolicyType,
+	}
+	si := Entity{
+		sts: &sts,
+	}
+
+	assert.False(si.PrepareScaleDown())
+	assert.Equal(appsv1.RetainPersistentVolumeClaimRetentionPolicyType, sts.Spec.PersistentVolumeClaimRetentionPolicy.WhenScaled)
+	assert.Equal(appsv1.DeletePersistentVolumeClaimRetentionPolicyType, sts.Spec.PersistentVolumeClaimRetentionPolicy.WhenDeleted)
+	assert.Equal("Delete", sts.Annotations[WhenScaledAnnotation])
+
+	sts.Status.Replicas = 0
+	assert.True(si.PrepareScaleDown())
+	done, err := si.PrepareScaleUp()
+	require.NoError(err)
+	assert.False(done)
+	assert.Equal(appsv1.RetainPersistentVolumeClaimRetentionPolicyType, sts.Spec.PersistentVolumeClaimRetentionPolicy.WhenScaled, "retain until scaled up")
+
+	sts.Status.Replicas = 3
+	done, err = si.PrepareScaleUp()
+	require.NoError(err)
+	assert.True(done)
+	assert.Equal(appsv1.DeletePersistentVolumeClaimRetentionPolicyType, sts.Spec.PersistentVolumeClaimRetentionPolicy.WhenScaled)
+	assert.NotContains(sts.Annotations, WhenScaledAnnotation)
+}
+
+func TestRollback(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	sts := newTestStatfulSet("", "", 3, 3)
+	sts.Spec.PersistentVolumeClaimRetentionPolicy = &appsv1.StatefulSetPersistentVolumeClaimRetentionPolicy{
+		WhenScaled: appsv1.DeletePersistentVolumeClaimRetentionPolicyType,
+	}
+	si := Entity{
+		sts: &sts,
+	}
+	si.PrepareScaleDown()
+	si.SetFailed()
+	require.True(si.Started())
+
+	require.NoError(si.Rollback())
+	assert.False(si.Started())
+	assert.Equal(int32(3), *sts.Spec.Replicas)
+	assert.Equal(appsv1.DeletePersistentVolumeClaimRetentionPolicyType, sts.Spec.PersistentVolumeClaimRetentionPolicy.WhenScaled)
+	assert.Empty(si.Pvcs)
+	assert.True(si.Failed(), "keep the controller from starting over")
+
+	si.ClearFailed()
+	assert.False(si.Failed())
+}
+
+func TestResetScaleUp(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	sts := newTestStatfulSet("", "", 3, 3)
+	sts.Spec.PersistentVolumeClaimRetentionPolicy = &appsv1.StatefulSetPersistentVolumeClaimRetentionPolicy{
+		WhenScaled: appsv1.DeletePersistentVolumeClaimRetentionPolicyType,
+	}
+	si := Entity{
+		sts:  &sts,
+		Pvcs: []pvc.Entity{{SourceName: "data-web-0", BackedUp: true}},
+	}
+	assert.False(si.ResetScaleUp(), "not failed")
+	si.PrepareScaleDown()
+	assert.False(si.ResetScaleUp(), "scaled down")
+	require.Len(si.Pvcs, 1)
+
+	// A critical error scaled it back up
+	si.SetFailed()
+	_, err := si.ScaleUpAfterFailure()
+	require.NoError(err)
+	require.True(si.Started())
+	require.True(si.RestartRequired())
+
+	assert.True(si.ResetScaleUp())
+	assert.False(si.RestartRequired())
+	assert.False(si.Started())
+	assert.Empty(si.Pvcs)
+	assert.Equal(int32(3), *sts.Spec.Replicas)
+	assert.Equal(appsv1.DeletePersistentVolumeClaimRetentionPolicyType, sts.Spec.PersistentVolumeClaimRetentionPolicy.WhenScaled)
+	assert.False(si.PrepareScaleDown(), "scales down again")
+	assert.Equal(int32(0), *sts.Spec.Replicas)
+	assert.Equal("3", sts.Annotations[ReplicasAnnotation])
+}
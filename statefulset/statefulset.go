@@ -1,7 +1,8 @@
 package statefulset
 
 import (
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 
 	"github.com/vshn/statefulset-resize-controller/pvc"
@@ -14,6 +15,89 @@ const FailedLabel = "sts-resize.vshn.net/failed"
 // PvcAnnotation is an annotation in which the initial state of the pvcs is stored in
 const PvcAnnotation = "sts-resize.vshn.net/pvcs"
 
+// RequireApprovalAnnotation marks whether a resize of the StatefulSet has to be approved before it starts.
+// It overrides the default of the controller.
+const RequireApprovalAnnotation = "sts-resize.vshn.net/require-approval"
+
+// ApproveAnnotation approves a resize. Its value has to match the ID of the planned resize.
+const ApproveAnnotation = "sts-resize.vshn.net/approve"
+
+// IgnoreDisruptionBudgetsAnnotation allows scaling down the StatefulSet even if it violates a PodDisruptionBudget
+const IgnoreDisruptionBudgetsAnnotation = "sts-resize.vshn.net/ignore-pdb"
+
+// IgnoreStorageCheckAnnotation allows starting a resize even if the storage quotas or capacity seem insufficient
+const IgnoreStorageCheckAnnotation = "sts-resize.vshn.net/ignore-storage-check"
+
+// AbortAnnotation aborts the resize of the StatefulSet at the next safe point.
+// With the value "true" the backups are kept, with "delete-backups" they are deleted.
+// No new resize starts as long as the annotation is set.
+const AbortAnnotation = "sts-resize.vshn.net/abort"
+
+// AbortDeleteBackups is the value of AbortAnnotation to delete the backups when aborting
+const AbortDeleteBackups = "delete-backups"
+
+// MaintenanceWindowAnnotation restricts when a resize of the StatefulSet may start.
+// It overrides the default maintenance windows of the controller.
+const MaintenanceWindowAnnotation = "sts-resize.vshn.net/maintenance-window"
+
+// OutOfRangeAnnotation sets how PVCs of ordinals outside the replicas of the StatefulSet are handled.
+// It overrides the default of the controller.
+const OutOfRangeAnnotation = "sts-resize.vshn.net/out-of-range-pvcs"
+
+// OutOfRangePolicy defines how PVCs of ordinals outside the replicas of the StatefulSet are handled.
+// These PVCs are usually left over from an earlier scale down.
+type OutOfRangePolicy string
+
+const (
+	// OutOfRangeResize resizes out of range PVCs like all other PVCs
+	OutOfRangeResize OutOfRangePolicy = "resize"
+	// OutOfRangeSkip ignores out of range PVCs
+	OutOfRangeSkip OutOfRangePolicy = "skip"
+	// OutOfRangeDelete deletes out of range PVCs instead of resizing them
+	OutOfRangeDelete OutOfRangePolicy = "delete"
+)
+
+// ParseOutOfRangePolicy parses and validates a policy for out of range PVCs
+func ParseOutOfRangePolicy(s string) (OutOfRangePolicy, error) {
+	switch p := OutOfRangePolicy(s); p {
+	case OutOfRangeResize, OutOfRangeSkip, OutOfRangeDelete:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown policy %q for out of range PVCs, expected one of %s, %s, %s", s, OutOfRangeResize, OutOfRangeSkip, OutOfRangeDelete)
+}
+
+// PrecopyAnnotation marks whether the PVCs of the StatefulSet are copied once before scaling down.
+// It overrides the default of the controller.
+const PrecopyAnnotation = "sts-resize.vshn.net/precopy"
+
+// RetainSourceAnnotation marks whether the volumes of the original PVCs are retained until their data is restored.
+// It overrides the default of the controller.
+const RetainSourceAnnotation = "sts-resize.vshn.net/retain-source-volume"
+
+// CopyModeAnnotation sets how the data of the PVCs is moved to the resized PVCs.
+// It overrides the default of the controller.
+const CopyModeAnnotation = "sts-resize.vshn.net/copy-mode"
+
+// CopyMode defines how the data of the PVCs is moved to the resized PVCs.
+type CopyMode string
+
+const (
+	// CopyModeBackup copies the data to a backup, recreates the PVC, and copies the data back
+	CopyModeBackup CopyMode = "backup"
+	// CopyModeRebind copies the data once to a new PVC and rebinds its volume to the original PVC name.
+	// The original volume is kept as the backup.
+	CopyModeRebind CopyMode = "rebind"
+)
+
+// ParseCopyMode parses and validates a copy mode
+func ParseCopyMode(s string) (CopyMode, error) {
+	switch m := CopyMode(s); m {
+	case CopyModeBackup, CopyModeRebind:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown copy mode %q, expected one of %s, %s", s, CopyModeBackup, CopyModeRebind)
+}
+
 // Entity contains all data to manage a statfulset resizing
 type Entity struct {
 	Old  *appsv1.StatefulSet
@@ -28,27 +112,80 @@ func NewEntity(sts *appsv1.StatefulSet) (*Entity, error) {
 	si.sts = sts.DeepCopy()
 	si.Old = sts
 	if sts.Annotations[PvcAnnotation] != "" {
-		if err := json.Unmarshal([]byte(sts.Annotations[PvcAnnotation]), &si.Pvcs); err != nil {
-			return nil, fmt.Errorf("Annotation %s malformed", PvcAnnotation)
+		pvcs, err := pvc.UnmarshalState(sts.Annotations[PvcAnnotation])
+		if err != nil {
+			return nil, fmt.Errorf("annotation %s malformed: %w", PvcAnnotation, err)
 		}
+		si.Pvcs = pvcs
 	}
 	return &si, nil
 }
 
 // StatefulSet returns the updated StatefulSet resource
 func (s *Entity) StatefulSet() (*appsv1.StatefulSet, error) {
-	annotation, err := json.Marshal(s.Pvcs)
+	annotation, err := pvc.MarshalState(s.Pvcs)
 	if err != nil {
 		return nil, err
 	}
 	if s.sts.Annotations == nil {
 		s.sts.Annotations = map[string]string{}
 	}
-	s.sts.Annotations[PvcAnnotation] = string(annotation)
+	s.sts.Annotations[PvcAnnotation] = annotation
 
 	return s.sts, nil
 }
 
+// Checkpointed returns whether the state of the PVCs is recorded on the StatefulSet as it is now
+func (s Entity) Checkpointed() (bool, error) {
+	v, err := pvc.MarshalState(s.Pvcs)
+	if err != nil {
+		return false, err
+	}
+	return s.Old.Annotations[PvcAnnotation] == v, nil
+}
+
+// OutOfRangePolicy returns how PVCs of ordinals outside the replicas of the StatefulSet are handled.
+// It returns def if the StatefulSet does not override it.
+func (s Entity) OutOfRangePolicy(def OutOfRangePolicy) (OutOfRangePolicy, error) {
+	v, ok := s.sts.Annotations[OutOfRangeAnnotation]
+	if !ok {
+		return def, nil
+	}
+	return ParseOutOfRangePolicy(v)
+}
+
+// CopyMode returns how the data of the PVCs is moved to the resized PVCs.
+// It returns def if the StatefulSet does not override it.
+func (s Entity) CopyMode(def CopyMode) (CopyMode, error) {
+	v, ok := s.sts.Annotations[CopyModeAnnotation]
+	if !ok {
+		return def, nil
+	}
+	return ParseCopyMode(v)
+}
+
+// InRange returns whether the ordinal belongs to one of the replicas of the StatefulSet.
+// During a resize it considers the replicas before scaling down.
+// A StatefulSet scaled to zero has no replicas to compare against, all its ordinals are in range.
+// Otherwise scaling it to zero would have all its PVCs discarded.
+func (s Entity) InRange(ordinal int) bool {
+	replicas, err := s.getOriginalReplicaCount()
+	if err != nil {
+		replicas = 1
+		if s.sts.Spec.Replicas != nil {
+			replicas = *s.sts.Spec.Replicas
+		}
+	}
+	if replicas == 0 {
+		return true
+	}
+	start := 0
+	if s.sts.Spec.Ordinals != nil {
+		start = int(s.sts.Spec.Ordinals.Start)
+	}
+	return ordinal >= start && ordinal < start+int(replicas)
+}
+
 // Failed returns wether we previously failed to resize this statefulset
 func (s Entity) Failed() bool {
 	return s.sts != nil &&
@@ -64,7 +201,126 @@ func (s Entity) SetFailed() {
 	s.sts.Labels[FailedLabel] = "true"
 }
 
+// ClearFailed removes the failed state, so the controller picks up the StatefulSet again
+func (s Entity) ClearFailed() {
+	delete(s.sts.Labels, FailedLabel)
+}
+
+// AbortRequested returns whether the resize should be aborted
+func (s Entity) AbortRequested() bool {
+	v := s.sts.Annotations[AbortAnnotation]
+	return v == "true" || v == AbortDeleteBackups
+}
+
+// AbortDeletesBackups returns whether the backups should be deleted when aborting the resize
+func (s Entity) AbortDeletesBackups() bool {
+	return s.sts.Annotations[AbortAnnotation] == AbortDeleteBackups
+}
+
+// RequestAbort requests to abort the resize, and to delete the backups if deleteBackups is set
+func (s Entity) RequestAbort(deleteBackups bool) {
+	if s.sts.Annotations == nil {
+		s.sts.Annotations = map[string]string{}
+	}
+	s.sts.Annotations[AbortAnnotation] = "true"
+	if deleteBackups {
+		s.sts.Annotations[AbortAnnotation] = AbortDeleteBackups
+	}
+}
+
+// ClearAbort removes the request to abort, so new resizes can start again
+func (s Entity) ClearAbort() {
+	delete(s.sts.Annotations, AbortAnnotation)
+}
+
 // Resizing returns wether we are resizing or should be resizing this statefulset
 func (s Entity) Resizing() bool {
 	return len(s.Pvcs) != 0
 }
+
+// Started returns whether the resize already started, i.e. the StatefulSet was scaled down at least once.
+// A started resize must always be allowed to finish.
+func (s Entity) Started() bool {
+	return s.sts.Annotations[ReplicasAnnotation] != "" || s.isScalingUp()
+}
+
+// MaintenanceWindow returns the maintenance windows set on the StatefulSet, if any
+func (s Entity) MaintenanceWindow() (string, bool) {
+	w, ok := s.sts.Annotations[MaintenanceWindowAnnotation]
+	return w, ok
+}
+
+// ApprovalRequired returns whether a resize has to be approved before it starts.
+// The annotation on the StatefulSet takes precedence over the provided default.
+func (s Entity) ApprovalRequired(def bool) bool {
+	switch s.sts.Annotations[RequireApprovalAnnotation] {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return def
+}
+
+// PrecopyEnabled returns whether the PVCs are copied once before scaling down the StatefulSet.
+// It returns def if the StatefulSet does not override it.
+func (s Entity) PrecopyEnabled(def bool) bool {
+	switch s.sts.Annotations[PrecopyAnnotation] {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return def
+}
+
+// RetainSourceVolume returns whether the volumes of the original PVCs are retained until their data is restored.
+// It returns def if the StatefulSet does not override it.
+func (s Entity) RetainSourceVolume(def bool) bool {
+	switch s.sts.Annotations[RetainSourceAnnotation] {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return def
+}
+
+// PlanID returns a short identifier of the planned resize.
+// It changes whenever the set of PVCs or their target changes, but not with the progress of the resize.
+func (s Entity) PlanID() (string, error) {
+	pvcs := make([]pvc.Entity, 0, len(s.Pvcs))
+	for _, pi := range s.Pvcs {
+		pi.PreCopied = false
+		pvcs = append(pvcs, pi)
+	}
+	plan, err := pvc.MarshalState(pvcs)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(plan))
+	return hex.EncodeToString(h[:])[:10], nil
+}
+
+// Approved returns whether the planned resize was approved
+func (s Entity) Approved() (bool, error) {
+	id, err := s.PlanID()
+	if err != nil {
+		return false, err
+	}
+	return s.sts.Annotations[ApproveAnnotation] == id, nil
+}
+
+func (s Entity) clearApproval() {
+	delete(s.sts.Annotations, ApproveAnnotation)
+}
+
+// IgnoreDisruptionBudgets returns whether the StatefulSet may be scaled down even if it violates a PodDisruptionBudget
+func (s Entity) IgnoreDisruptionBudgets() bool {
+	return s.sts.Annotations[IgnoreDisruptionBudgetsAnnotation] == "true"
+}
+
+// IgnoreStorageCheck returns whether the resize may start even if the storage quotas or capacity seem insufficient
+func (s Entity) IgnoreStorageCheck() bool {
+	return s.sts.Annotations[IgnoreStorageCheckAnnotation] == "true"
+}
@@ -0,0 +1,150 @@
+package statefulset
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+
+	"github.com/vshn/statefulset-resize-controller/pvc"
+)
+
+func TestInRange(t *testing.T) {
+	tcs := map[string]struct {
+		replicas    int32
+		start       *int32
+		annotations map[string]string
+		in, out     []int
+	}{
+		"replicas": {
+			replicas: 2,
+			in:       []int{0, 1},
+			out:      []int{-1, 2, 3},
+		},
+		"scaled down": {
+			replicas:    0,
+			annotations: map[string]string{ReplicasAnnotation: "2"},
+			in:          []int{0, 1},
+			out:         []int{2},
+		},
+		"scaled to zero": {
+			replicas: 0,
+			in:       []int{0, 1, 5},
+		},
+		"scaled to zero during resize": {
+			replicas:    0,
+			annotations: map[string]string{ReplicasAnnotation: "0"},
+			in:          []int{0, 1, 5},
+		},
+		"ordinal start": {
+			replicas: 2,
+			start:    pointer.Int32(5),
+			in:       []int{5, 6},
+			out:      []int{0, 4, 7},
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			sts := &appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Annotations: tc.annotations},
+				Spec:       appsv1.StatefulSetSpec{Replicas: pointer.Int32(tc.replicas)},
+			}
+			if tc.start != nil {
+				sts.Spec.Ordinals = &appsv1.StatefulSetOrdinals{Start: *tc.start}
+			}
+			si, err := NewEntity(sts)
+			require.NoError(t, err)
+			for _, o := range tc.in {
+				assert.True(t, si.InRange(o), o)
+			}
+			for _, o := range tc.out {
+				assert.False(t, si.InRange(o), o)
+			}
+		})
+	}
+}
+
+func TestOutOfRangePolicy(t *testing.T) {
+	si, err := NewEntity(&appsv1.StatefulSet{})
+	require.NoError(t, err)
+	p, err := si.OutOfRangePolicy(OutOfRangeSkip)
+	require.NoError(t, err)
+	assert.Equal(t, OutOfRangeSkip, p)
+
+	si, err = NewEntity(&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{OutOfRangeAnnotation: "delete"},
+	}})
+	require.NoError(t, err)
+	p, err = si.OutOfRangePolicy(OutOfRangeSkip)
+	require.NoError(t, err)
+	assert.Equal(t, OutOfRangeDelete, p)
+
+	si, err = NewEntity(&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{OutOfRangeAnnotation: "archive"},
+	}})
+	require.NoError(t, err)
+	_, err = si.OutOfRangePolicy(OutOfRangeSkip)
+	assert.Error(t, err)
+}
+
+func TestFinishMigration(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "old",
+			Annotations: map[string]string{
+				MigrateToAnnotation: "new",
+				ReplicasAnnotation:  "3",
+			},
+		},
+		Spec: appsv1.StatefulSetSpec{Replicas: pointer.Int32(0)},
+	}
+	si, err := NewEntity(sts)
+	require.NoError(err)
+	si.Pvcs = []pvc.Entity{{SourceName: "data-web-0", TargetNamespace: "new"}}
+	assert.True(si.Migrating())
+
+	replicas, err := si.FinishMigration()
+	require.NoError(err)
+	assert.Equal(int32(3), replicas)
+	assert.Empty(si.MigrateTo())
+	assert.False(si.Started())
+
+	updated, err := si.StatefulSet()
+	require.NoError(err)
+	assert.Equal("new", updated.Annotations[MigratedToAnnotation])
+	assert.Equal("new", updated.Annotations[MigrateToAnnotation], "the annotation of the user is kept")
+	assert.Equal(int32(0), *updated.Spec.Replicas, "stays scaled down")
+
+	si, err = NewEntity(updated)
+	require.NoError(err)
+	assert.Empty(si.MigrateTo(), "already migrated")
+
+	updated.Annotations[MigrateToAnnotation] = "other"
+	si, err = NewEntity(updated)
+	require.NoError(err)
+	assert.Equal("other", si.MigrateTo(), "a new target namespace starts another migration")
+}
+
+func TestPlanIDIgnoresProgress(t *testing.T) {
+	si, err := NewEntity(&appsv1.StatefulSet{})
+	require.NoError(t, err)
+	si.Pvcs = []pvc.Entity{{SourceName: "data-web-0"}}
+	id, err := si.PlanID()
+	require.NoError(t, err)
+
+	si.Pvcs[0].PreCopied = true
+	precopied, err := si.PlanID()
+	require.NoError(t, err)
+	assert.Equal(t, id, precopied)
+
+	si.Pvcs = append(si.Pvcs, pvc.Entity{SourceName: "data-web-1"})
+	changed, err := si.PlanID()
+	require.NoError(t, err)
+	assert.NotEqual(t, id, changed)
+}
@@ -0,0 +1,156 @@
+package statefulset
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/yaml"
+)
+
+// TargetSizeAnnotation requests a new size for the PVCs of all volumeClaimTemplates, without changing the templates themselves.
+const TargetSizeAnnotation = "sts-resize.vshn.net/target-size"
+
+// TargetSizeAnnotationPrefix requests a new size for the PVCs of a single volumeClaimTemplate.
+// For example `sts-resize.vshn.net/target-size.data` for the template `data`.
+// It takes precedence over TargetSizeAnnotation.
+const TargetSizeAnnotationPrefix = TargetSizeAnnotation + "."
+
+// TemplatesAnnotation holds the desired volumeClaimTemplates of the StatefulSet, as a YAML or JSON list.
+const TemplatesAnnotation = "sts-resize.vshn.net/volume-claim-templates"
+
+// TemplatesConfigMapAnnotation references a ConfigMap holding the desired volumeClaimTemplates of the StatefulSet.
+const TemplatesConfigMapAnnotation = "sts-resize.vshn.net/volume-claim-templates-from"
+
+// TemplatesKey is the key of the desired volumeClaimTemplates in the ConfigMap referenced by TemplatesConfigMapAnnotation
+const TemplatesKey = "volumeClaimTemplates.yaml"
+
+// TargetSize returns the size the PVCs of the template should have.
+// This is the size requested through the annotations of the StatefulSet, if it is larger than the request of the template.
+func TargetSize(sts appsv1.StatefulSet, tpl corev1.PersistentVolumeClaim) (resource.Quantity, error) {
+	size := tpl.Spec.Resources.Requests[corev1.ResourceStorage]
+
+	key := TargetSizeAnnotationPrefix + tpl.Name
+	v, ok := sts.Annotations[key]
+	if !ok {
+		key = TargetSizeAnnotation
+		v, ok = sts.Annotations[key]
+	}
+	if !ok {
+		return size, nil
+	}
+	target, err := resource.ParseQuantity(strings.TrimSpace(v))
+	if err != nil {
+		return size, fmt.Errorf("annotation %s malformed: %w", key, err)
+	}
+	if target.Cmp(size) > 0 {
+		return target, nil
+	}
+	return size, nil
+}
+
+// ApplyTargetSizes returns a copy of the StatefulSet with the target sizes written to its volumeClaimTemplates and the target size annotations removed.
+// It returns false if the target sizes do not change any of the volumeClaimTemplates.
+func (s *Entity) ApplyTargetSizes() (*appsv1.StatefulSet, bool, error) {
+	sts, err := s.StatefulSet()
+	if err != nil {
+		return nil, false, err
+	}
+	sts = sts.DeepCopy()
+
+	changed := false
+	for i, tpl := range sts.Spec.VolumeClaimTemplates {
+		size, err := TargetSize(*sts, tpl)
+		if err != nil {
+			return nil, false, err
+		}
+		if size.Cmp(tpl.Spec.Resources.Requests[corev1.ResourceStorage]) == 0 {
+			continue
+		}
+		if sts.Spec.VolumeClaimTemplates[i].Spec.Resources.Requests == nil {
+			sts.Spec.VolumeClaimTemplates[i].Spec.Resources.Requests = corev1.ResourceList{}
+		}
+		sts.Spec.VolumeClaimTemplates[i].Spec.Resources.Requests[corev1.ResourceStorage] = size
+		changed = true
+	}
+	if !changed {
+		return sts, false, nil
+	}
+	for k := range sts.Annotations {
+		if k == TargetSizeAnnotation || strings.HasPrefix(k, TargetSizeAnnotationPrefix) {
+			delete(sts.Annotations, k)
+		}
+	}
+	return sts, true, nil
+}
+
+// DesiredTemplates returns the raw desired volumeClaimTemplates set in the annotation, or the name of the ConfigMap containing them.
+func (s Entity) DesiredTemplates() (inline string, configMap string) {
+	return s.sts.Annotations[TemplatesAnnotation], s.sts.Annotations[TemplatesConfigMapAnnotation]
+}
+
+// ParseTemplates parses a YAML or JSON list of volumeClaimTemplates
+func ParseTemplates(s string) ([]corev1.PersistentVolumeClaim, error) {
+	tpls := []corev1.PersistentVolumeClaim{}
+	if err := yaml.UnmarshalStrict([]byte(s), &tpls); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for i, tpl := range tpls {
+		if tpl.Name == "" {
+			return nil, fmt.Errorf("template %d has no name", i)
+		}
+		if names[tpl.Name] {
+			return nil, fmt.Errorf("duplicate template %s", tpl.Name)
+		}
+		names[tpl.Name] = true
+		if _, ok := tpl.Spec.Resources.Requests[corev1.ResourceStorage]; !ok {
+			return nil, fmt.Errorf("template %s does not request storage", tpl.Name)
+		}
+	}
+	return tpls, nil
+}
+
+// TemplatesMatch returns whether the current volumeClaimTemplates already fulfill the desired ones.
+// Only the fields set in the desired templates are compared, as the API server defaults the others.
+func TemplatesMatch(current, desired []corev1.PersistentVolumeClaim) bool {
+	if len(current) != len(desired) {
+		return false
+	}
+	byName := map[string]corev1.PersistentVolumeClaim{}
+	for _, tpl := range current {
+		byName[tpl.Name] = tpl
+	}
+	for _, d := range desired {
+		c, ok := byName[d.Name]
+		if !ok {
+			return false
+		}
+		cq := c.Spec.Resources.Requests[corev1.ResourceStorage]
+		if cq.Cmp(d.Spec.Resources.Requests[corev1.ResourceStorage]) != 0 {
+			return false
+		}
+		if d.Spec.StorageClassName != nil &&
+			(c.Spec.StorageClassName == nil || *c.Spec.StorageClassName != *d.Spec.StorageClassName) {
+			return false
+		}
+		if len(d.Spec.AccessModes) > 0 && !reflect.DeepEqual(c.Spec.AccessModes, d.Spec.AccessModes) {
+			return false
+		}
+	}
+	return true
+}
+
+// WithTemplates returns a copy of the StatefulSet using the provided volumeClaimTemplates
+func (s *Entity) WithTemplates(tpls []corev1.PersistentVolumeClaim) (*appsv1.StatefulSet, error) {
+	sts, err := s.StatefulSet()
+	if err != nil {
+		return nil, err
+	}
+	sts = sts.DeepCopy()
+	sts.Spec.VolumeClaimTemplates = tpls
+	return sts, nil
+}
@@ -0,0 +1,198 @@
+package statefulset
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTemplate(name, size string) corev1.PersistentVolumeClaim {
+	return corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(size)},
+			},
+		},
+	}
+}
+
+func TestApplyTargetSizes(t *testing.T) {
+	tcs := map[string]struct {
+		annotations map[string]string
+		requested   bool
+		fail        bool
+		out         map[string]string
+	}{
+		"no annotation": {
+			annotations: map[string]string{},
+			requested:   false,
+			out:         map[string]string{"data": "1G", "log": "5G"},
+		},
+		"all templates": {
+			annotations: map[string]string{TargetSizeAnnotation: "2G"},
+			requested:   true,
+			out:         map[string]string{"data": "2G", "log": "5G"},
+		},
+		"per template": {
+			annotations: map[string]string{
+				TargetSizeAnnotation:               "2G",
+				TargetSizeAnnotationPrefix + "log": "10G",
+			},
+			requested: true,
+			out:       map[string]string{"data": "2G", "log": "10G"},
+		},
+		"smaller than template": {
+			annotations: map[string]string{TargetSizeAnnotation: "500M"},
+			requested:   false,
+			out:         map[string]string{"data": "1G", "log": "5G"},
+		},
+		"malformed": {
+			annotations: map[string]string{TargetSizeAnnotation: "big"},
+			fail:        true,
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			sts := &appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Annotations: tc.annotations},
+				Spec: appsv1.StatefulSetSpec{
+					VolumeClaimTemplates: []corev1.PersistentVolumeClaim{
+						newTemplate("data", "1G"),
+						newTemplate("log", "5G"),
+					},
+				},
+			}
+			si, err := NewEntity(sts)
+			require.NoError(t, err)
+			updated, requested, err := si.ApplyTargetSizes()
+			if tc.fail {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.requested, requested)
+			for _, tpl := range updated.Spec.VolumeClaimTemplates {
+				q := tpl.Spec.Resources.Requests[corev1.ResourceStorage]
+				assert.Equal(t, tc.out[tpl.Name], q.String(), tpl.Name)
+			}
+			if tc.requested {
+				assert.NotContains(t, updated.Annotations, TargetSizeAnnotation)
+				assert.NotContains(t, updated.Annotations, TargetSizeAnnotationPrefix+"log")
+			}
+			assert.Equal(t, "1G", sts.Spec.VolumeClaimTemplates[0].Spec.Resources.Requests.Storage().String(), "original untouched")
+		})
+	}
+}
+
+func TestParseTemplates(t *testing.T) {
+	tcs := map[string]struct {
+		in   string
+		out  map[string]string
+		fail bool
+	}{
+		"yaml": {
+			in: `
+- metadata:
+    name: data
+  spec:
+    resources:
+      requests:
+        storage: 2G
+`,
+			out: map[string]string{"data": "2G"},
+		},
+		"json": {
+			in:  `[{"metadata":{"name":"data"},"spec":{"resources":{"requests":{"storage":"2G"}}}},{"metadata":{"name":"log"},"spec":{"resources":{"requests":{"storage":"5G"}}}}]`,
+			out: map[string]string{"data": "2G", "log": "5G"},
+		},
+		"missing name": {
+			in:   `[{"spec":{"resources":{"requests":{"storage":"2G"}}}}]`,
+			fail: true,
+		},
+		"duplicate name": {
+			in:   `[{"metadata":{"name":"data"},"spec":{"resources":{"requests":{"storage":"2G"}}}},{"metadata":{"name":"data"},"spec":{"resources":{"requests":{"storage":"2G"}}}}]`,
+			fail: true,
+		},
+		"missing storage": {
+			in:   `[{"metadata":{"name":"data"}}]`,
+			fail: true,
+		},
+		"unknown field": {
+			in:   `[{"metadata":{"name":"data"},"spec":{"size":"2G"}}]`,
+			fail: true,
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			tpls, err := ParseTemplates(tc.in)
+			if tc.fail {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, tpls, len(tc.out))
+			for _, tpl := range tpls {
+				q := tpl.Spec.Resources.Requests[corev1.ResourceStorage]
+				assert.Equal(t, tc.out[tpl.Name], q.String(), tpl.Name)
+			}
+		})
+	}
+}
+
+func TestTemplatesMatch(t *testing.T) {
+	withClass := func(tpl corev1.PersistentVolumeClaim, class string) corev1.PersistentVolumeClaim {
+		tpl.Spec.StorageClassName = &class
+		return tpl
+	}
+	defaulted := newTemplate("data", "1G")
+	defaulted.Spec.AccessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
+	defaulted.Status.Phase = corev1.ClaimPending
+
+	tcs := map[string]struct {
+		current []corev1.PersistentVolumeClaim
+		desired []corev1.PersistentVolumeClaim
+		match   bool
+	}{
+		"equal": {
+			current: []corev1.PersistentVolumeClaim{newTemplate("data", "1G")},
+			desired: []corev1.PersistentVolumeClaim{newTemplate("data", "1G")},
+			match:   true,
+		},
+		"defaulted fields": {
+			current: []corev1.PersistentVolumeClaim{withClass(defaulted, "ssd")},
+			desired: []corev1.PersistentVolumeClaim{newTemplate("data", "1000M")},
+			match:   true,
+		},
+		"larger": {
+			current: []corev1.PersistentVolumeClaim{newTemplate("data", "1G")},
+			desired: []corev1.PersistentVolumeClaim{newTemplate("data", "2G")},
+			match:   false,
+		},
+		"storage class": {
+			current: []corev1.PersistentVolumeClaim{withClass(newTemplate("data", "1G"), "ssd")},
+			desired: []corev1.PersistentVolumeClaim{withClass(newTemplate("data", "1G"), "hdd")},
+			match:   false,
+		},
+		"renamed": {
+			current: []corev1.PersistentVolumeClaim{newTemplate("data", "1G")},
+			desired: []corev1.PersistentVolumeClaim{newTemplate("db", "1G")},
+			match:   false,
+		},
+		"added": {
+			current: []corev1.PersistentVolumeClaim{newTemplate("data", "1G")},
+			desired: []corev1.PersistentVolumeClaim{newTemplate("data", "1G"), newTemplate("log", "1G")},
+			match:   false,
+		},
+	}
+	for k, tc := range tcs {
+		t.Run(k, func(t *testing.T) {
+			assert.Equal(t, tc.match, TemplatesMatch(tc.current, tc.desired))
+		})
+	}
+}